@@ -0,0 +1,204 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tagsAnnotation is the annotation listing the tag that protects the image of each container of a workload
+const tagsAnnotation = "kube-ecr-tagger/tags"
+
+// revisionAnnotation is the annotation with which the Deployment controller numbers the revisions of a Deployment
+// and of its ReplicaSets
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// annotatedTTL is how long the tags annotation of a workload is cached
+const annotatedTTL = time.Hour
+
+// annotatedWorkload is the tags annotation set on a workload from the Pods of one of its controllers
+type annotatedWorkload struct {
+	workload types.UID
+	// tags is nil if the Pods belong to a previous ReplicaSet of a Deployment
+	tags map[string]string
+	at   time.Time
+}
+
+var annotateOwners bool
+
+func init() {
+	rootCmd.Flags().BoolVar(&annotateOwners, "annotate-owners", false, "Annotate the Deployments, StatefulSets and DaemonSets managing Pods with the tags that protect their images")
+}
+
+// annotateOwner sets the tags annotation of the workload managing the Pod to the given container tags.
+// The Pods of a Deployment only annotate it if they belong to its current ReplicaSet, so that the Pods of
+// the previous ReplicaSet do not overwrite the annotation during a rollout.
+// The workload is only patched when the annotation changes
+func (t *tagger) annotateOwner(pod *corev1.Pod, protections map[string]string) error {
+	if !t.annotateOwners || len(protections) == 0 {
+		return nil
+	}
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return nil
+	}
+	if t.isAnnotated(controller.UID, protections) {
+		return nil
+	}
+	ref := &corev1.ObjectReference{Kind: controller.Kind, Namespace: pod.Namespace, Name: controller.Name, UID: controller.UID}
+	revision := ""
+	if controller.Kind == "ReplicaSet" {
+		replicaSet, err := t.clientset.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), controller.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		deployment := metav1.GetControllerOf(replicaSet)
+		if deployment == nil {
+			return nil
+		}
+		ref = &corev1.ObjectReference{Kind: deployment.Kind, Namespace: pod.Namespace, Name: deployment.Name, UID: deployment.UID}
+		revision = replicaSet.Annotations[revisionAnnotation]
+	}
+	annotations, err := t.workloadAnnotations(ref)
+	if err != nil {
+		return err
+	}
+	if annotations == nil {
+		// The Pod is not managed by a supported workload
+		return nil
+	}
+	if ref.Kind == "Deployment" && annotations[revisionAnnotation] != revision {
+		// The Pod belongs to a previous ReplicaSet of the Deployment
+		t.setAnnotated(controller.UID, ref.UID, nil)
+		return nil
+	}
+
+	value, err := json.Marshal(protections)
+	if err != nil {
+		return err
+	}
+	if annotations[tagsAnnotation] != string(value) {
+		if err := t.patchWorkloadAnnotation(ref, protections); err != nil {
+			return err
+		}
+	}
+	t.setAnnotated(controller.UID, ref.UID, protections)
+	return nil
+}
+
+// workloadAnnotations returns the annotations of the referenced workload,
+// or nil if the workload is not a Deployment, StatefulSet or DaemonSet
+func (t *tagger) workloadAnnotations(ref *corev1.ObjectReference) (map[string]string, error) {
+	var meta metav1.ObjectMeta
+	switch ref.Kind {
+	case "Deployment":
+		deployment, err := t.clientset.AppsV1().Deployments(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = deployment.ObjectMeta
+	case "StatefulSet":
+		statefulSet, err := t.clientset.AppsV1().StatefulSets(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = statefulSet.ObjectMeta
+	case "DaemonSet":
+		daemonSet, err := t.clientset.AppsV1().DaemonSets(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = daemonSet.ObjectMeta
+	default:
+		return nil, nil
+	}
+	if meta.Annotations == nil {
+		return map[string]string{}, nil
+	}
+	return meta.Annotations, nil
+}
+
+// patchWorkloadAnnotation sets the tags annotation of the referenced workload
+func (t *tagger) patchWorkloadAnnotation(ref *corev1.ObjectReference, tags map[string]string) error {
+	value, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{tagsAnnotation: string(value)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	switch ref.Kind {
+	case "Deployment":
+		_, err = t.clientset.AppsV1().Deployments(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = t.clientset.AppsV1().StatefulSets(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	case "DaemonSet":
+		_, err = t.clientset.AppsV1().DaemonSets(ref.Namespace).Patch(context.TODO(), ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	return err
+}
+
+// isAnnotated reports whether the workload managing the Pods of the given controller was already annotated
+// with the given container tags, or whether these Pods belong to a previous ReplicaSet of a Deployment
+func (t *tagger) isAnnotated(controller types.UID, protections map[string]string) bool {
+	t.annotatedMu.Lock()
+	defer t.annotatedMu.Unlock()
+	annotated, ok := t.annotated[controller]
+	if !ok || time.Since(annotated.at) > annotatedTTL {
+		return false
+	}
+	if annotated.tags == nil {
+		return true
+	}
+	if len(annotated.tags) != len(protections) {
+		return false
+	}
+	for container, tag := range protections {
+		if annotated.tags[container] != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// setAnnotated caches the tags annotation set on the given workload from the Pods of the given controller,
+// or that these Pods belong to a previous ReplicaSet of the workload if tags is nil.
+// The entries of the workload's other controllers and the expired entries are evicted
+func (t *tagger) setAnnotated(controller, workload types.UID, tags map[string]string) {
+	t.annotatedMu.Lock()
+	defer t.annotatedMu.Unlock()
+	if t.annotated == nil {
+		t.annotated = make(map[types.UID]*annotatedWorkload)
+	}
+	now := time.Now()
+	for uid, annotated := range t.annotated {
+		if now.Sub(annotated.at) > annotatedTTL || (tags != nil && annotated.workload == workload && annotated.tags != nil) {
+			delete(t.annotated, uid)
+		}
+	}
+	t.annotated[controller] = &annotatedWorkload{workload: workload, tags: tags, at: now}
+}
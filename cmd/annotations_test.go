@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAnnotateOwner(t *testing.T) {
+	isController := true
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "app",
+				UID:       "1",
+				Annotations: map[string]string{
+					tagsAnnotation:     `{"app":"deployed1599999999","removed":"deployed1599999999"}`,
+					revisionAnnotation: "2",
+				},
+			},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "app-1234",
+				UID:         "2",
+				Annotations: map[string]string{revisionAnnotation: "2"},
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", UID: "1", Controller: &isController},
+				},
+			},
+		},
+		&appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "app-5678",
+				UID:         "3",
+				Annotations: map[string]string{revisionAnnotation: "1"},
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", UID: "1", Controller: &isController},
+				},
+			},
+		},
+	)
+	podTagger := &tagger{clientset: clientset, annotateOwners: true}
+	pod := definePod("default", "app-1234-abcd", "test-image:latest")
+	pod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-1234", UID: "2", Controller: &isController},
+	}
+	oldPod := definePod("default", "app-5678-abcd", "test-image:previous")
+	oldPod.OwnerReferences = []metav1.OwnerReference{
+		{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-5678", UID: "3", Controller: &isController},
+	}
+
+	// The Pods of the previous ReplicaSet do not annotate the Deployment
+	if err := podTagger.annotateOwner(oldPod, map[string]string{"app": "deployed1499999999"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := podTagger.annotateOwner(pod, map[string]string{"app": "deployed1699999999"}); err != nil {
+		t.Fatal(err)
+	}
+	deployment, err := clientset.AppsV1().Deployments("default").Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(deployment.Annotations[tagsAnnotation]), &tags); err != nil {
+		t.Fatal(err)
+	}
+	// The annotation is replaced, the tags of containers that were removed from the Pods are dropped
+	expected := map[string]string{"app": "deployed1699999999"}
+	if diff := cmp.Diff(tags, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", tags, diff)
+	}
+
+	// The workload must not be fetched again when its annotation is up to date
+	actions := len(clientset.Actions())
+	if err := podTagger.annotateOwner(pod, map[string]string{"app": "deployed1699999999"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := podTagger.annotateOwner(oldPod, map[string]string{"app": "deployed1499999999"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(clientset.Actions()) != actions {
+		t.Errorf("Expected no API calls, but got %v", clientset.Actions()[actions:])
+	}
+}
+
+func TestSetAnnotatedEvicts(t *testing.T) {
+	podTagger := &tagger{}
+	podTagger.setAnnotated("expired", "other", map[string]string{"app": "deployed1"})
+	podTagger.annotated["expired"].at = time.Now().Add(-2 * annotatedTTL)
+	podTagger.setAnnotated("previous", "workload", map[string]string{"app": "deployed1"})
+	podTagger.setAnnotated("stale", "workload", nil)
+	podTagger.setAnnotated("current", "workload", map[string]string{"app": "deployed2"})
+
+	var controllers []string
+	for controller := range podTagger.annotated {
+		controllers = append(controllers, string(controller))
+	}
+	sort.Strings(controllers)
+	if diff := cmp.Diff(controllers, []string{"current", "stale"}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", controllers, diff)
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecrimage"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	imageResources      bool
+	imageResourcePeriod time.Duration
+)
+
+func init() {
+	rootCmd.Flags().BoolVar(&imageResources, "image-resources", false, "Maintain an EcrImage object for each image from ECR used by Pods, identified by its digest")
+	rootCmd.Flags().DurationVar(&imageResourcePeriod, "image-resource-period", time.Minute, "How often EcrImage objects are updated")
+}
+
+// syncImageResources creates, updates and deletes EcrImage objects so that there is one for each digest of
+// an image from ECR used by the given Pods. Images whose digest is unknown because no Pod using them started are left out
+func (t *tagger) syncImageResources(ctx context.Context, objs []interface{}) {
+	pods := make([]*corev1.Pod, 0, len(objs))
+	for _, obj := range objs {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	// Pods with the same controller belong to the same workload, it is only looked up once
+	workloads := make(map[types.UID]string)
+	workload := func(pod *corev1.Pod) string {
+		controller := metav1.GetControllerOf(pod)
+		if controller == nil {
+			return podWorkload(t.clientset, pod)
+		}
+		if _, ok := workloads[controller.UID]; !ok {
+			workloads[controller.UID] = podWorkload(t.clientset, pod)
+		}
+		return workloads[controller.UID]
+	}
+	prefixes := t.managedPrefixes()
+	desired := make(map[string]*ecrimage.EcrImage)
+	for _, used := range groupUsedImages(pods, workload) {
+		if used.image.ImageId.ImageDigest == nil {
+			continue
+		}
+		image := ecrimage.New(*used.image.RegistryId, *used.image.RepositoryName, *used.image.ImageId.ImageDigest)
+		image.Status.Workloads = used.workloads
+		record, ok := t.store.Get(state.Key(image.Spec.Registry, image.Spec.Repository, image.Spec.Digest, ""))
+		if !ok {
+			record, ok = t.store.Get(state.Key(image.Spec.Registry, image.Spec.Repository, "", *used.image.ImageId.ImageTag))
+		}
+		if ok {
+			image.Status.Tags = record.Tags
+			lastChecked := metav1.NewTime(record.CheckedAt.Truncate(time.Second))
+			image.Status.LastChecked = &lastChecked
+			for _, prefix := range prefixes {
+				image.Status.Protected = image.Status.Protected || record.HasTagWithPrefix(prefix)
+			}
+		}
+		desired[image.Name] = image
+	}
+
+	resource := t.dynamicClient.Resource(ecrimage.Resource)
+	existing, err := resource.List(ctx, metav1.ListOptions{LabelSelector: ecrimage.ManagedByLabel + "=" + ecrimage.ManagedBy})
+	if err != nil {
+		log.WithError(err).Warn("Could not list EcrImage objects")
+		return
+	}
+	for i := range existing.Items {
+		object := &existing.Items[i]
+		image, ok := desired[object.GetName()]
+		if !ok {
+			if err := resource.Delete(ctx, object.GetName(), metav1.DeleteOptions{}); err != nil {
+				log.WithError(err).WithField("ecrImage", object.GetName()).Warn("Could not delete EcrImage object")
+			}
+			continue
+		}
+		delete(desired, image.Name)
+		current, err := ecrimage.FromUnstructured(object)
+		if err == nil && equality.Semantic.DeepEqual(current.Spec, image.Spec) && equality.Semantic.DeepEqual(current.Status, image.Status) {
+			continue
+		}
+		image.ResourceVersion = object.GetResourceVersion()
+		updated, err := image.ToUnstructured()
+		if err == nil {
+			_, err = resource.Update(ctx, updated, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			log.WithError(err).WithField("ecrImage", image.Name).Warn("Could not update EcrImage object")
+		}
+	}
+	for _, image := range desired {
+		created, err := image.ToUnstructured()
+		if err == nil {
+			_, err = resource.Create(ctx, created, metav1.CreateOptions{})
+		}
+		if err != nil {
+			log.WithError(err).WithField("ecrImage", image.Name).Warn("Could not create EcrImage object")
+		}
+	}
+}
+
+// managedPrefixes returns the prefixes of the tags added by the tagger, given by its flags and by its policies
+func (t *tagger) managedPrefixes() []string {
+	_, prefix := t.nextTag()
+	prefixes := []string{prefix}
+	for _, p := range t.policies.List() {
+		if p.Err == nil {
+			prefixes = append(prefixes, p.ManagedPrefix())
+		}
+	}
+	return prefixes
+}
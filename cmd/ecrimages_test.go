@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecrimage"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSyncImageResources(t *testing.T) {
+	ctx := context.Background()
+	checkedAt := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	stale, err := ecrimage.New("123456789012", "removed", "sha256:5678").ToUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outdated := ecrimage.New("123456789012", "team/app", "sha256:1234")
+	outdated.Status.Tags = []string{"latest"}
+	existing, err := outdated.ToUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient := newFakeDynamicClient(stale, existing)
+
+	store := state.NewMemoryStore()
+	_ = store.Put(state.Key("123456789012", "team/app", "sha256:1234", ""), &state.Record{
+		Registry:   "123456789012",
+		Repository: "team/app",
+		Digest:     "sha256:1234",
+		Tags:       []string{"latest", "deployed1599999999"},
+		CheckedAt:  checkedAt,
+	})
+	podTagger := &tagger{
+		clientset:     fake.NewSimpleClientset(),
+		dynamicClient: dynamicClient,
+		store:         store,
+		tagPrefix:     "deployed",
+	}
+	started := definePod("default", "started", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/team/app:latest")
+	started.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		ImageID: "docker-pullable://123456789012.dkr.ecr.eu-central-1.amazonaws.com/team/app@sha256:1234",
+	}}
+	pending := definePod("default", "pending", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/pending:latest")
+
+	podTagger.syncImageResources(ctx, []interface{}{started, pending})
+
+	list, err := dynamicClient.Resource(ecrimage.Resource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("Expected 1 EcrImage object, but got %d instead", len(list.Items))
+	}
+	image, err := ecrimage.FromUnstructured(&list.Items[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if image.Name != "team.app.1234.123456789012.d1b8e1e6" {
+		t.Errorf("Expected EcrImage 'team.app.1234.123456789012.d1b8e1e6', but got '%s' instead", image.Name)
+	}
+	lastChecked := metav1.NewTime(checkedAt)
+	expected := ecrimage.Status{
+		Tags:        []string{"latest", "deployed1599999999"},
+		Protected:   true,
+		Workloads:   []string{"Pod default/started"},
+		LastChecked: &lastChecked,
+	}
+	if diff := cmp.Diff(image.Status, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", image.Status, diff)
+	}
+}
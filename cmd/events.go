@@ -0,0 +1,116 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Reasons of the Events recorded by the tagger
+const (
+	eventReasonImageTagged    = "ImageTagged"
+	eventReasonImageTagFailed = "ImageTagFailed"
+	eventReasonImageMissing   = "ImageMissing"
+	eventReasonScanBlocked    = "ImageScanBlocked"
+	eventReasonQuarantined    = "ImageQuarantined"
+)
+
+// Objects on which Events are recorded
+const (
+	eventTargetPod   = "pod"
+	eventTargetOwner = "owner"
+	eventTargetNone  = "none"
+)
+
+var eventTarget string
+
+func init() {
+	rootCmd.Flags().StringVar(&eventTarget, "event-target", eventTargetPod, "Object on which Events about tagged images are recorded, one of 'pod', 'owner' (the Pod's Deployment, StatefulSet, DaemonSet, etc.) or 'none'")
+}
+
+// newEventRecorder returns an EventRecorder that sends Events to the API server,
+// or nil if Events are disabled
+func newEventRecorder(clientset kubernetes.Interface, target string) (record.EventRecorder, error) {
+	switch target {
+	case eventTargetPod, eventTargetOwner:
+	case eventTargetNone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown event target '%s'", target)
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "kube-ecr-tagger"}), nil
+}
+
+// recordEvent records an Event about the given Pod's images on the Pod or on its owner
+func (t *tagger) recordEvent(pod *corev1.Pod, eventType, reason, messageFmt string, args ...interface{}) {
+	if t.recorder == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	if t.eventTarget != eventTargetOwner {
+		t.recorder.Event(pod, eventType, reason, message)
+		return
+	}
+	owner, err := podOwner(t.clientset, pod)
+	if err != nil {
+		log.WithFields(log.Fields{"namespace": pod.Namespace, "pod": pod.Name}).WithError(err).Warn("Could not get owner of Pod, recording Event on the Pod instead")
+		t.recorder.Event(pod, eventType, reason, message)
+		return
+	}
+	if owner == nil {
+		t.recorder.Event(pod, eventType, reason, message)
+		return
+	}
+	t.recorder.Event(owner, eventType, reason, fmt.Sprintf("Pod %s: %s", pod.Name, message))
+}
+
+// podOwner returns a reference to the workload that manages the given Pod,
+// or nil if the Pod is not managed by a controller.
+// Pods created by a ReplicaSet that is managed by a Deployment are attributed to the Deployment
+func podOwner(clientset kubernetes.Interface, pod *corev1.Pod) (runtime.Object, error) {
+	controller := metav1.GetControllerOf(pod)
+	if controller == nil {
+		return nil, nil
+	}
+	if controller.Kind == "ReplicaSet" {
+		replicaSet, err := clientset.AppsV1().ReplicaSets(pod.Namespace).Get(context.TODO(), controller.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if deployment := metav1.GetControllerOf(replicaSet); deployment != nil {
+			controller = deployment
+		}
+	}
+	return &corev1.ObjectReference{
+		APIVersion: controller.APIVersion,
+		Kind:       controller.Kind,
+		Namespace:  pod.Namespace,
+		Name:       controller.Name,
+		UID:        controller.UID,
+	}, nil
+}
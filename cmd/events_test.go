@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// describingECRClient is a mockECRClient that finds images without tags
+type describingECRClient struct {
+	mockECRClient
+}
+
+func (m *describingECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	var output ecr.DescribeImagesOutput
+	for range input.ImageIds {
+		output.ImageDetails = append(output.ImageDetails, &ecr.ImageDetail{})
+	}
+	return &output, nil
+}
+
+func TestTaggingRecordsEvents(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	mockSession := session.Must(session.NewSession(&aws.Config{
+		DisableSSL: aws.Bool(true),
+		Endpoint:   aws.String(server.URL),
+		Region:     aws.String("eu-central-1"),
+	}))
+	recorder := record.NewFakeRecorder(10)
+	podTagger := &tagger{
+		clientset:   fake.NewSimpleClientset(),
+		ecrClient:   &registry.Client{ECRAPI: &describingECRClient{mockECRClient{ecr.New(mockSession)}}},
+		store:       state.NewMemoryStore(),
+		recorder:    recorder,
+		eventTarget: eventTargetPod,
+	}
+
+	pod := definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest")
+	pod.Spec.Containers[0].Name = "app"
+	podTagger.tagPodImages(context.Background(), "production", "production", pod)
+
+	select {
+	case event := <-recorder.Events:
+		expected := "Normal ImageTagged Added tag production to image test-image:latest of container app"
+		if !strings.HasPrefix(event, expected) {
+			t.Errorf("Expected event to start with '%s', but got '%s' instead", expected, event)
+		}
+	default:
+		t.Error("Expected an event to be recorded")
+	}
+}
+
+func TestPodOwner(t *testing.T) {
+	isController := true
+	deployment := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", UID: "1", Controller: &isController}
+	replicaSet := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-1234", UID: "2", Controller: &isController}
+	statefulSet := metav1.OwnerReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", UID: "3", Controller: &isController}
+	clientset := fake.NewSimpleClientset(&appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "app-1234",
+			OwnerReferences: []metav1.OwnerReference{deployment},
+		},
+	})
+
+	var tests = []struct {
+		description string
+		owners      []metav1.OwnerReference
+		expected    string
+	}{
+		{"no owner", nil, ""},
+		{"deployment", []metav1.OwnerReference{replicaSet}, "Deployment/app"},
+		{"statefulset", []metav1.OwnerReference{statefulSet}, "StatefulSet/db"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			pod := definePod("default", "pod", "test-image:latest")
+			pod.OwnerReferences = test.owners
+			owner, err := podOwner(clientset, pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			if owner != nil {
+				ref := owner.(*corev1.ObjectReference)
+				got = ref.Kind + "/" + ref.Name
+			}
+			if got != test.expected {
+				t.Errorf("Expected owner '%s', but got '%s' instead", test.expected, got)
+			}
+		})
+	}
+}
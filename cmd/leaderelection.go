@@ -0,0 +1,128 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var (
+	leaderElect              bool
+	leaderElectNamespace     string
+	leaderElectName          string
+	leaderElectLeaseDuration time.Duration
+	leaderElectRenewDeadline time.Duration
+	leaderElectRetryPeriod   time.Duration
+)
+
+func init() {
+	rootCmd.Flags().BoolVar(&leaderElect, "leader-elect", false, "Elect a leader among the replicas using a Lease so that only the leader tags images")
+	rootCmd.Flags().StringVar(&leaderElectNamespace, "leader-elect-namespace", "kube-system", "Namespace of the Lease used for leader election")
+	rootCmd.Flags().StringVar(&leaderElectName, "leader-elect-name", "kube-ecr-tagger", "Name of the Lease used for leader election")
+	rootCmd.Flags().DurationVar(&leaderElectLeaseDuration, "leader-elect-lease-duration", 15*time.Second, "Duration that non-leader replicas wait before trying to acquire the leadership")
+	rootCmd.Flags().DurationVar(&leaderElectRenewDeadline, "leader-elect-renew-deadline", 10*time.Second, "Duration that the leader retries renewing its leadership before giving up")
+	rootCmd.Flags().DurationVar(&leaderElectRetryPeriod, "leader-elect-retry-period", 2*time.Second, "Duration that replicas wait between two attempts to acquire or renew the leadership")
+}
+
+// runWithLeaderElection blocks until the replica with the given identity becomes the leader and then calls run.
+// The context passed to run is cancelled when the leadership is lost or the given context is done.
+// It returns once run returned, after which the lease is released, or once the given context is done
+// if the replica never became the leader
+func runWithLeaderElection(ctx context.Context, clientset kubernetes.Interface, identity string, run func(ctx context.Context)) error {
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		leaderElectNamespace,
+		leaderElectName,
+		clientset.CoreV1(),
+		clientset.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity},
+	)
+	if err != nil {
+		return err
+	}
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	// The election runs until run returned, so that the lease is only released once run finished what it is doing
+	// and no other replica can start tagging images in the meantime
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+	var mu sync.Mutex
+	leading := false
+	go func() {
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		if !leading {
+			stopElection()
+		}
+	}()
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaderElectLeaseDuration,
+		RenewDeadline: leaderElectRenewDeadline,
+		RetryPeriod:   leaderElectRetryPeriod,
+		// The lease is released once run returned so that another replica takes over without waiting for it to expire
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				mu.Lock()
+				leading = true
+				mu.Unlock()
+				close(started)
+				defer close(finished)
+				defer stopElection()
+				log.Infof("Replica '%s' started leading", identity)
+				runCtx, cancel := context.WithCancel(leaderCtx)
+				defer cancel()
+				go func() {
+					select {
+					case <-ctx.Done():
+						cancel()
+					case <-runCtx.Done():
+					}
+				}()
+				run(runCtx)
+			},
+			OnStoppedLeading: func() {
+				log.Infof("Replica '%s' stopped leading", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("Replica '%s' is the leader", leader)
+				}
+			},
+		},
+		Name: leaderElectName,
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run(electionCtx)
+	// Wait for run to return so that it can finish what it is doing
+	select {
+	case <-started:
+		<-finished
+	default:
+	}
+	return nil
+}
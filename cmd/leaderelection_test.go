@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElection(t *testing.T) {
+	leaderElectNamespace = "kube-system"
+	leaderElectName = "kube-ecr-tagger"
+	leaderElectLeaseDuration = 2 * time.Second
+	leaderElectRenewDeadline = time.Second
+	leaderElectRetryPeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := fake.NewSimpleClientset()
+	leaders := make(chan string, 2)
+	for _, identity := range []string{"replica-1", "replica-2"} {
+		go func(identity string) {
+			err := runWithLeaderElection(ctx, client, identity, func(ctx context.Context) {
+				leaders <- identity
+				<-ctx.Done()
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(identity)
+	}
+
+	select {
+	case <-leaders:
+	case <-ctx.Done():
+		t.Fatal("Expected one of the replicas to become the leader")
+	}
+	select {
+	case leader := <-leaders:
+		t.Errorf("Expected a single leader, but '%s' also started leading", leader)
+	case <-time.After(3 * time.Second):
+	}
+}
+
+func TestLeaderElectionReleasesLeaseAfterRun(t *testing.T) {
+	leaderElectNamespace = "kube-system"
+	leaderElectName = "kube-ecr-tagger"
+	leaderElectLeaseDuration = 2 * time.Second
+	leaderElectRenewDeadline = time.Second
+	leaderElectRetryPeriod = 100 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := fake.NewSimpleClientset()
+	holder := func() string {
+		lease, err := client.CoordinationV1().Leases(leaderElectNamespace).Get(context.Background(), leaderElectName, metav1.GetOptions{})
+		if err != nil || lease.Spec.HolderIdentity == nil {
+			return ""
+		}
+		return *lease.Spec.HolderIdentity
+	}
+
+	leading := make(chan struct{})
+	draining := make(chan struct{})
+	drained := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- runWithLeaderElection(ctx, client, "replica-1", func(ctx context.Context) {
+			close(leading)
+			<-ctx.Done()
+			// Simulate in-flight Pods being processed after the context is done
+			close(draining)
+			<-drained
+		})
+	}()
+	select {
+	case <-leading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the replica to become the leader")
+	}
+	cancel()
+	<-draining
+	// The lease is held while run is still finishing its work
+	time.Sleep(3 * leaderElectRetryPeriod)
+	if actual := holder(); actual != "replica-1" {
+		t.Errorf("Expected the lease to be held by 'replica-1' while draining, but got '%s' instead", actual)
+	}
+	close(drained)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if actual := holder(); actual != "" {
+		t.Errorf("Expected the lease to be released, but it is held by '%s'", actual)
+	}
+}
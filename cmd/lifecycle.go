@@ -0,0 +1,377 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/imagetag"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/lifecycle"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	lifecycleNamespace string
+	lifecycleTag       string
+	lifecycleTagPrefix string
+)
+
+// lifecycleCmd represents the lifecycle-policy command
+var lifecycleCmd = &cobra.Command{
+	Use:   "lifecycle-policy",
+	Short: "Works with the ECR lifecycle policies of the repositories used by Pods in cluster",
+}
+
+// simulateCmd represents the lifecycle-policy simulate command
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Lists the images used by Pods in cluster that lifecycle policies would expire",
+	Long: `A command that evaluates the lifecycle policy of each ECR repository used by Pods in the kubernetes cluster
+against the repository's images and lists the images in use that the policy would expire,
+both as they are and once they are tagged by the tagger.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ecrClient, err := registry.NewClient(registry.DefaultOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientset, err := newClientset()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx := context.Background()
+		used, err := listUsedImages(ctx, clientset, lifecycleNamespace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		managedTag := lifecycleTag
+		if managedTag == "" {
+			managedTag = lifecycleTagPrefix + strconv.FormatInt(time.Now().Unix(), 10)
+		}
+		var results []simulationResult
+		for _, repository := range groupByRepository(used) {
+			policy, images, err := fetchRepositoryPolicy(ctx, ecrClient, repository)
+			if errors.Is(err, registry.ErrLifecyclePolicyNotFound) {
+				log.WithField("repository", repository.name).Info("Repository has no lifecycle policy")
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			results = append(results, simulate(policy, images, repository, managedTag, managedPrefix(), time.Now())...)
+		}
+		if err := writeSimulation(os.Stdout, results); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// generateCmd represents the lifecycle-policy generate command
+var generateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generates a lifecycle policy that keeps the images tagged by the tagger",
+	Long: `A command that prints a lifecycle policy keeping the images with a tag that starts with the tag prefix
+and expiring the other images by age or count.
+With --apply, the policy is set on the given repositories or on all repositories used by Pods in cluster.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		policy, err := lifecycle.Generate(lifecycle.GenerateOptions{
+			TagPrefix:    managedPrefix(),
+			UntaggedDays: generateUntaggedDays,
+			KeepCount:    generateKeepCount,
+			MaxAgeDays:   generateMaxAgeDays,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(policy)
+		if !generateApply {
+			return
+		}
+		ecrClient, err := registry.NewClient(registry.DefaultOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		repositories, err := generateRepositories()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, repository := range repositories {
+			repoLog := log.WithFields(log.Fields{"registry": repository.registryID, "repository": repository.name})
+			if err := ecrClient.PutLifecyclePolicy(context.Background(), repository.registryID, repository.name, policy.String()); err != nil {
+				repoLog.WithError(err).Fatal("Could not apply lifecycle policy")
+			}
+			repoLog.Info("Applied lifecycle policy")
+		}
+	},
+}
+
+// checkCmd represents the lifecycle-policy check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks that lifecycle policies cannot expire the images tagged by the tagger",
+	Long: `A command that reads the lifecycle policy of each ECR repository used by Pods in the kubernetes cluster
+and reports the rules that could expire images with a tag that starts with the tag prefix.
+It exits with a non-zero status if any rule is reported.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ecrClient, err := registry.NewClient(registry.DefaultOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientset, err := newClientset()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ctx := context.Background()
+		used, err := listUsedImages(ctx, clientset, lifecycleNamespace)
+		if err != nil {
+			log.Fatal(err)
+		}
+		failed := false
+		for _, repository := range groupByRepository(used) {
+			findings, err := checkRepositoryPolicy(ctx, ecrClient, repository, managedPrefix())
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, finding := range findings {
+				fmt.Printf("%s/%s: %s\n", repository.registryID, repository.name, finding)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// checkRepositoryPolicy returns the rules of the repository's lifecycle policy that could expire
+// images with a tag starting with the given prefix
+func checkRepositoryPolicy(ctx context.Context, ecrClient *registry.Client, repository *repositoryImages, tagPrefix string) ([]lifecycle.Finding, error) {
+	text, err := ecrClient.GetLifecyclePolicy(ctx, repository.registryID, repository.name)
+	if errors.Is(err, registry.ErrLifecyclePolicyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy, err := lifecycle.Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Repository '%s': %v", repository.name, err)
+	}
+	return policy.Check(tagPrefix), nil
+}
+
+var (
+	generateUntaggedDays int
+	generateKeepCount    int
+	generateMaxAgeDays   int
+	generateApply        bool
+	generateRepository   []string
+)
+
+// generateRepositories returns the repositories on which the generated policy is applied
+func generateRepositories() ([]*repositoryImages, error) {
+	if len(generateRepository) > 0 {
+		var repositories []*repositoryImages
+		for _, name := range generateRepository {
+			repositories = append(repositories, &repositoryImages{name: name})
+		}
+		return repositories, nil
+	}
+	clientset, err := newClientset()
+	if err != nil {
+		return nil, err
+	}
+	used, err := listUsedImages(context.Background(), clientset, lifecycleNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return groupByRepository(used), nil
+}
+
+func init() {
+	rootCmd.AddCommand(lifecycleCmd)
+	lifecycleCmd.AddCommand(simulateCmd)
+	lifecycleCmd.AddCommand(generateCmd)
+	lifecycleCmd.AddCommand(checkCmd)
+	generateCmd.Flags().IntVar(&generateUntaggedDays, "untagged-days", 14, "Number of days after which untagged images expire. Set to 0 to keep them")
+	generateCmd.Flags().IntVar(&generateKeepCount, "keep-count", 100, "Number of most recently pushed images kept among the images without a managed tag. Set to 0 to keep them all")
+	generateCmd.Flags().IntVar(&generateMaxAgeDays, "max-age-days", 0, "Number of days after which images without a managed tag expire. Requires --keep-count=0")
+	generateCmd.Flags().BoolVar(&generateApply, "apply", false, "Set the generated policy on the repositories with PutLifecyclePolicy")
+	generateCmd.Flags().StringSliceVar(&generateRepository, "repository", nil, "Repository on which the policy is applied, in the account's default registry. Defaults to all repositories used by Pods in cluster")
+	lifecycleCmd.PersistentFlags().StringVar(&lifecycleNamespace, "namespace", corev1.NamespaceAll, "namespace from which images will be listed. Defaults to all namespaces")
+	lifecycleCmd.PersistentFlags().StringVar(&lifecycleTag, "tag", "", "Tag added by the tagger. If left empty, tag-prefix is used instead")
+	lifecycleCmd.PersistentFlags().StringVar(&lifecycleTagPrefix, "tag-prefix", "deployed", "Prefix of the tags added by the tagger")
+}
+
+// managedPrefix returns the prefix of the tags that protect images, like the tagger does
+func managedPrefix() string {
+	if lifecycleTag != "" {
+		return lifecycleTag
+	}
+	return lifecycleTagPrefix
+}
+
+// repositoryImages are the images of a repository used by Pods in the cluster
+type repositoryImages struct {
+	registryID string
+	name       string
+	used       []*usedImage
+}
+
+// groupByRepository groups the given images by repository, keeping their order
+func groupByRepository(used []*usedImage) []*repositoryImages {
+	var repositories []*repositoryImages
+	index := make(map[string]*repositoryImages)
+	for _, image := range used {
+		key := *image.image.RegistryId + "/" + *image.image.RepositoryName
+		repository, ok := index[key]
+		if !ok {
+			repository = &repositoryImages{registryID: *image.image.RegistryId, name: *image.image.RepositoryName}
+			index[key] = repository
+			repositories = append(repositories, repository)
+		}
+		repository.used = append(repository.used, image)
+	}
+	return repositories
+}
+
+// fetchRepositoryPolicy returns the lifecycle policy and all images of the given repository
+func fetchRepositoryPolicy(ctx context.Context, ecrClient *registry.Client, repository *repositoryImages) (*lifecycle.Policy, []*ecr.ImageDetail, error) {
+	text, err := ecrClient.GetLifecyclePolicy(ctx, repository.registryID, repository.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := lifecycle.Parse(text)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Repository '%s': %v", repository.name, err)
+	}
+	images, err := ecrClient.ListImages(ctx, repository.registryID, repository.name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return policy, images, nil
+}
+
+// simulationResult is the outcome of a lifecycle policy for an image used by Pods in the cluster
+type simulationResult struct {
+	registryID string
+	repository string
+	image      lifecycle.Image
+	workloads  []string
+	// rule is the rule that expires the image
+	rule *lifecycle.Rule
+	// expired reports whether the image would be expired as it is
+	expired bool
+	// expiredAfterTagging reports whether the image would be expired once it is tagged
+	expiredAfterTagging bool
+}
+
+// simulate evaluates the given lifecycle policy against the images of a repository and returns
+// the images in use that it would expire, as they are or once those without a tag starting with
+// tagPrefix are tagged with managedTag
+func simulate(policy *lifecycle.Policy, details []*ecr.ImageDetail, repository *repositoryImages, managedTag, tagPrefix string, now time.Time) []simulationResult {
+	images := make([]lifecycle.Image, len(details))
+	for i, detail := range details {
+		images[i] = lifecycle.Image{
+			Digest:   aws.StringValue(detail.ImageDigest),
+			Tags:     aws.StringValueSlice(detail.ImageTags),
+			PushedAt: aws.TimeValue(detail.ImagePushedAt),
+		}
+	}
+	// Find which of the repository's images are used and what they look like once tagged
+	workloads := make(map[int][]string)
+	tagged := make([]lifecycle.Image, len(images))
+	copy(tagged, images)
+	for _, used := range repository.used {
+		for i, image := range images {
+			if !isImage(image, used.image) {
+				continue
+			}
+			workloads[i] = append(workloads[i], used.workloads...)
+			if !imagetag.HasPrefix(image.Tags, tagPrefix) {
+				tagged[i].Tags = append(append([]string(nil), image.Tags...), managedTag)
+			}
+		}
+	}
+
+	before := policy.Evaluate(images, now)
+	after := policy.Evaluate(tagged, now)
+	var results []simulationResult
+	for i := range images {
+		if _, ok := workloads[i]; !ok {
+			continue
+		}
+		if !before[i].Expired && !after[i].Expired {
+			continue
+		}
+		rule := after[i].Rule
+		if !after[i].Expired {
+			rule = before[i].Rule
+		}
+		results = append(results, simulationResult{
+			registryID:          repository.registryID,
+			repository:          repository.name,
+			image:               images[i],
+			workloads:           workloads[i],
+			rule:                rule,
+			expired:             before[i].Expired,
+			expiredAfterTagging: after[i].Expired,
+		})
+	}
+	return results
+}
+
+// isImage reports whether the given repository image is the given ECR image,
+// comparing digests if the ECR image has one and tags otherwise
+func isImage(image lifecycle.Image, ecrImage *ecr.Image) bool {
+	if ecrImage.ImageId.ImageDigest != nil {
+		return image.Digest == *ecrImage.ImageId.ImageDigest
+	}
+	for _, tag := range image.Tags {
+		if tag == aws.StringValue(ecrImage.ImageId.ImageTag) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSimulation writes the given simulation results as a table
+func writeSimulation(w io.Writer, results []simulationResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REGISTRY\tREPOSITORY\tDIGEST\tTAGS\tEXPIRED\tEXPIRED AFTER TAGGING\tRULE\tWORKLOADS")
+	for _, result := range results {
+		rule := "-"
+		if result.rule != nil {
+			rule = strconv.Itoa(result.rule.RulePriority)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%t\t%s\t%s\n",
+			result.registryID, result.repository, result.image.Digest, strings.Join(result.image.Tags, ","),
+			result.expired, result.expiredAfterTagging, rule, strings.Join(result.workloads, ","))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/lifecycle"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSimulate(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	details := []*ecr.ImageDetail{
+		{ImageDigest: aws.String("sha256:1"), ImageTags: aws.StringSlice([]string{"v1"}), ImagePushedAt: aws.Time(now.Add(-30 * 24 * time.Hour))},
+		{ImageDigest: aws.String("sha256:2"), ImageTags: aws.StringSlice([]string{"v2"}), ImagePushedAt: aws.Time(now.Add(-20 * 24 * time.Hour))},
+		{ImageDigest: aws.String("sha256:3"), ImageTags: aws.StringSlice([]string{"v3"}), ImagePushedAt: aws.Time(now.Add(-10 * 24 * time.Hour))},
+	}
+	repository := &repositoryImages{
+		registryID: "123456789012",
+		name:       "test-image",
+		used: []*usedImage{
+			{image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:1")}}, workloads: []string{"Deployment default/old"}},
+			{image: &ecr.Image{ImageId: &ecr.ImageIdentifier{ImageTag: aws.String("v2")}}, workloads: []string{"Deployment default/app"}},
+		},
+	}
+	expireAll := lifecycle.Rule{
+		RulePriority: 2,
+		Selection:    lifecycle.Selection{TagStatus: lifecycle.TagStatusAny, CountType: lifecycle.CountTypeImageCountMoreThan, CountNumber: 1},
+		Action:       lifecycle.Action{Type: lifecycle.ActionExpire},
+	}
+	keepDeployed := lifecycle.Rule{
+		RulePriority: 1,
+		Selection:    lifecycle.Selection{TagStatus: lifecycle.TagStatusTagged, TagPrefixList: []string{"deployed"}, CountType: lifecycle.CountTypeImageCountMoreThan, CountNumber: 9999},
+		Action:       lifecycle.Action{Type: lifecycle.ActionExpire},
+	}
+
+	var tests = []struct {
+		description string
+		rules       []lifecycle.Rule
+		expected    map[string][2]bool
+	}{
+		{"tagging protects images", []lifecycle.Rule{expireAll, keepDeployed}, map[string][2]bool{
+			"sha256:1": {true, false},
+			"sha256:2": {true, false},
+		}},
+		{"tagging does not protect images", []lifecycle.Rule{expireAll}, map[string][2]bool{
+			"sha256:1": {true, true},
+			"sha256:2": {true, true},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			policy := &lifecycle.Policy{Rules: test.rules}
+			actual := make(map[string][2]bool)
+			for _, result := range simulate(policy, details, repository, "deployed1600000000", "deployed", now) {
+				actual[result.image.Digest] = [2]bool{result.expired, result.expiredAfterTagging}
+			}
+			if diff := cmp.Diff(actual, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", actual, diff)
+			}
+		})
+	}
+}
+
+// mockLifecyclePolicyClient returns the lifecycle policies of the repositories it knows
+type mockLifecyclePolicyClient struct {
+	ecriface.ECRAPI
+	policies map[string]string
+}
+
+func (m *mockLifecyclePolicyClient) GetLifecyclePolicyWithContext(ctx aws.Context, input *ecr.GetLifecyclePolicyInput, opts ...request.Option) (*ecr.GetLifecyclePolicyOutput, error) {
+	text, ok := m.policies[*input.RepositoryName]
+	if !ok {
+		return nil, awserr.New(ecr.ErrCodeLifecyclePolicyNotFoundException, "Lifecycle policy does not exist", nil)
+	}
+	return &ecr.GetLifecyclePolicyOutput{LifecyclePolicyText: aws.String(text)}, nil
+}
+
+func TestCheckRepositoryPolicy(t *testing.T) {
+	ecrClient := &registry.Client{ECRAPI: &mockLifecyclePolicyClient{policies: map[string]string{
+		"safe":   `{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "tagged", "tagPrefixList": ["deployed"], "countType": "imageCountMoreThan", "countNumber": 10000}, "action": {"type": "expire"}}, {"rulePriority": 2, "selection": {"tagStatus": "any", "countType": "imageCountMoreThan", "countNumber": 10}, "action": {"type": "expire"}}]}`,
+		"unsafe": `{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "any", "countType": "imageCountMoreThan", "countNumber": 10}, "action": {"type": "expire"}}]}`,
+		"broken": `{"rules": `,
+	}}}
+
+	var tests = []struct {
+		description string
+		repository  string
+		expected    int
+		expectedErr bool
+	}{
+		{"no policy", "missing", 0, false},
+		{"safe policy", "safe", 0, false},
+		{"unsafe policy", "unsafe", 1, false},
+		{"invalid policy", "broken", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			findings, err := checkRepositoryPolicy(context.Background(), ecrClient, &repositoryImages{registryID: "123456789012", name: test.repository}, "deployed")
+			if (err != nil) != test.expectedErr {
+				t.Fatalf("Expected error to be %t, but got '%v' instead", test.expectedErr, err)
+			}
+			if len(findings) != test.expected {
+				t.Errorf("Expected %d findings, but got %v instead", test.expected, findings)
+			}
+		})
+	}
+}
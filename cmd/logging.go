@@ -0,0 +1,61 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	logLevel  string
+	logFormat string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level, one of 'debug', 'info', 'warn' or 'error'")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "logfmt", "Log format, one of 'logfmt' or 'json'")
+}
+
+func initLogging() {
+	if err := configureLogger(log.StandardLogger(), logLevel, logFormat); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configureLogger sets the level and the format of the given logger
+func configureLogger(logger *log.Logger, level, format string) error {
+	switch level {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("Unknown log level '%s'", level)
+	}
+	parsedLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "logfmt":
+		logger.SetFormatter(&log.TextFormatter{DisableColors: true, FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format '%s'", format)
+	}
+	logger.SetLevel(parsedLevel)
+	return nil
+}
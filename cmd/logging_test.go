@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestConfigureLogger(t *testing.T) {
+	var tests = []struct {
+		description string
+		level       string
+		format      string
+		expectedErr bool
+	}{
+		{"logfmt", "info", "logfmt", false},
+		{"json", "debug", "json", false},
+		{"unknown level", "trace", "json", true},
+		{"unknown format", "info", "xml", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := configureLogger(log.New(), test.level, test.format)
+			if (err != nil) != test.expectedErr {
+				t.Errorf("Expected error to be %t, but got '%v' instead", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestJSONLogFields(t *testing.T) {
+	logger := log.New()
+	if err := configureLogger(logger, "warn", "json"); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	logger.SetOutput(&buffer)
+	logger.WithField("repository", "test").Info("Not logged")
+	logger.WithField("repository", "test").Warn("Logged")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected a single JSON log entry, but got '%s' instead", buffer.String())
+	}
+	if entry["repository"] != "test" || entry["level"] != "warning" || entry["msg"] != "Logged" {
+		t.Errorf("Expected entry to contain the repository, level and message, but got %v instead", entry)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"sync"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+)
+
+// trackedImages tracks images in some state, e.g. missing from ECR, by key of the Pods using them.
+// It lets the tagger record an Event when an image enters the state instead of every time its Pod is processed
+type trackedImages struct {
+	mu   sync.Mutex
+	pods map[string]map[string]bool
+}
+
+// has reports whether the given image was tracked when the given Pod was last processed
+func (m *trackedImages) has(podKey, imageKey string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pods[podKey][imageKey]
+}
+
+// set replaces the tracked images of the given Pod, which is forgotten if there are none
+func (m *trackedImages) set(podKey string, imageKeys map[string]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.replace(podKey, imageKeys)
+}
+
+// replace replaces the tracked images of the given Pod and returns the number of distinct tracked images.
+// The caller must hold the lock
+func (m *trackedImages) replace(podKey string, imageKeys map[string]bool) int {
+	if len(imageKeys) == 0 {
+		delete(m.pods, podKey)
+	} else {
+		if m.pods == nil {
+			m.pods = make(map[string]map[string]bool)
+		}
+		m.pods[podKey] = imageKeys
+	}
+	images := make(map[string]bool)
+	for _, imageKeys := range m.pods {
+		for imageKey := range imageKeys {
+			images[imageKey] = true
+		}
+	}
+	return len(images)
+}
+
+// missingImages tracks the images whose repository or image is missing from ECR.
+// Such Pods keep running but fail to start once they are rescheduled
+type missingImages struct {
+	trackedImages
+}
+
+// set replaces the missing images of the given Pod, which is forgotten if there are none
+func (m *missingImages) set(podKey string, imageKeys map[string]bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics.ImagesMissing.Set(float64(m.replace(podKey, imageKeys)))
+}
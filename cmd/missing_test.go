@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// missingECRClient is a mockECRClient on which no image exists
+type missingECRClient struct {
+	mockECRClient
+}
+
+func (m *missingECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return nil, awserr.New(ecr.ErrCodeImageNotFoundException, "image not found", nil)
+}
+
+func TestMissingImages(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	// The image was tagged before it was deleted from ECR, its record expired since then
+	store := state.NewMemoryStore()
+	_ = store.Put(state.Key("123456789012", "test-image", "", "latest"), &state.Record{
+		Registry:   "123456789012",
+		Repository: "test-image",
+		Tags:       []string{"latest", "production1599999999"},
+		CheckedAt:  time.Now().Add(-48 * time.Hour),
+	})
+	podTagger := &tagger{
+		clientset:   fake.NewSimpleClientset(),
+		ecrClient:   &registry.Client{ECRAPI: &missingECRClient{}},
+		store:       store,
+		recorder:    recorder,
+		eventTarget: eventTargetPod,
+		recordTTL:   24 * time.Hour,
+	}
+
+	pod := definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest")
+	pod.Spec.Containers[0].Name = "app"
+	// The Pod is processed again on every resync, the Event is only recorded once
+	podTagger.tagPodImages(context.Background(), "production", "production", pod)
+	podTagger.tagPodImages(context.Background(), "production", "production", pod)
+
+	if len(recorder.Events) != 1 {
+		t.Fatalf("Expected 1 event to be recorded, but got %d instead", len(recorder.Events))
+	}
+	event := <-recorder.Events
+	expected := "Warning ImageMissing Image test-image:latest of container app is missing from ECR: ImageNotFoundException"
+	if !strings.HasPrefix(event, expected) {
+		t.Errorf("Expected event to start with '%s', but got '%s' instead", expected, event)
+	}
+	if missing := testutil.ToFloat64(metrics.ImagesMissing); missing != 1 {
+		t.Errorf("Expected 1 missing image, but got %v instead", missing)
+	}
+	if _, ok := podTagger.store.Get(state.Key("123456789012", "test-image", "", "latest")); ok {
+		t.Error("Expected the record of the missing image to be removed")
+	}
+
+	// Deleted Pods are no longer in the indexer once they are processed
+	queue := workqueue.New()
+	defer queue.ShutDown()
+	queue.Add("default/pod")
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	podTagger.processNextPod(context.Background(), queue, indexer)
+	if missing := testutil.ToFloat64(metrics.ImagesMissing); missing != 0 {
+		t.Errorf("Expected no missing image, but got %v instead", missing)
+	}
+}
@@ -0,0 +1,327 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/policy"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	taggingPolicies       bool
+	policyReconcilePeriod time.Duration
+)
+
+// usedAtRefreshPeriod is how old the record of an image in use must be before the time at which the image
+// was last seen in use is updated. It keeps the tagger from saving the state store on every reconciliation
+const usedAtRefreshPeriod = time.Hour
+
+func init() {
+	rootCmd.Flags().BoolVar(&taggingPolicies, "tagging-policies", false, "Apply the TaggingPolicy and ClusterTaggingPolicy objects to the Pods they select")
+	rootCmd.Flags().DurationVar(&policyReconcilePeriod, "policy-reconcile-period", time.Minute, "How often the status of tagging policies is updated and their rotation and cleanup rules are applied")
+}
+
+// watchPolicies keeps the tagger's policies up to date with the TaggingPolicy and ClusterTaggingPolicy objects
+// and returns functions reporting whether the informers watching them are synced
+func (t *tagger) watchPolicies(ctx context.Context) []cache.InformerSynced {
+	if t.policies == nil {
+		t.policies = policy.NewSet()
+	}
+	if t.namespace != "" {
+		log.Warn("Rotation and cleanup rules of tagging policies are not applied when watching a single namespace")
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc: t.putPolicy,
+		UpdateFunc: func(old interface{}, new interface{}) {
+			t.putPolicy(new)
+		},
+		DeleteFunc: t.deletePolicy,
+	}
+	namespaced := dynamicinformer.NewFilteredDynamicSharedInformerFactory(t.dynamicClient, 0, t.namespace, nil).
+		ForResource(policy.TaggingPolicyResource).Informer()
+	clusterScoped := dynamicinformer.NewDynamicSharedInformerFactory(t.dynamicClient, 0).
+		ForResource(policy.ClusterTaggingPolicyResource).Informer()
+	var synced []cache.InformerSynced
+	for _, informer := range []cache.SharedIndexInformer{namespaced, clusterScoped} {
+		informer.AddEventHandler(handler)
+		go informer.Run(ctx.Done())
+		synced = append(synced, informer.HasSynced)
+	}
+	return synced
+}
+
+func (t *tagger) putPolicy(obj interface{}) {
+	object, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	taggingPolicy, err := policy.FromUnstructured(object)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	compiled := policy.Compile(taggingPolicy)
+	if compiled.Err != nil {
+		log.WithError(compiled.Err).WithField("policy", compiled.Key()).Warn("Ignoring invalid tagging policy")
+	}
+	t.policies.Put(compiled)
+}
+
+func (t *tagger) deletePolicy(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	t.policies.Delete(key)
+}
+
+// podTag returns the tag to add to the images of the given Pod and the prefix of the tags that make adding it unnecessary.
+// They are given by the policy that applies to the Pod, if any, and by the command's flags otherwise
+func (t *tagger) podTag(obj interface{}) (tag, tagPrefix string, err error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		tag, tagPrefix = t.nextTag()
+		return tag, tagPrefix, nil
+	}
+	if match := t.policies.Match(pod); match != nil {
+		return match.NextTag(pod, time.Now())
+	}
+	tag, tagPrefix = t.nextTag()
+	return tag, tagPrefix, nil
+}
+
+// podPolicy returns the key of the policy that applies to the given Pod, if any
+func (t *tagger) podPolicy(pod *corev1.Pod) string {
+	if t.policies == nil {
+		return ""
+	}
+	if match := t.policies.Match(pod); match != nil {
+		return match.Key()
+	}
+	return ""
+}
+
+// reconcilePolicies updates the status of the policies with the number of images used by the given Pods
+// that each of them covers, then applies their rotation and cleanup rules
+func (t *tagger) reconcilePolicies(ctx context.Context, pods []interface{}) {
+	now := time.Now()
+	inUse := make(map[string]bool)
+	covered := make(map[string]map[string]bool)
+	for _, obj := range pods {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		keys, tagKeys := t.podImageKeys(ctx, pod)
+		for _, key := range append(keys, tagKeys...) {
+			inUse[key] = true
+		}
+		match := t.policies.Match(pod)
+		if match == nil {
+			continue
+		}
+		if covered[match.Key()] == nil {
+			covered[match.Key()] = make(map[string]bool)
+		}
+		for _, key := range keys {
+			covered[match.Key()][key] = true
+		}
+	}
+	policies := t.policies.List()
+	for _, p := range policies {
+		t.updatePolicyStatus(ctx, p, len(covered[p.Key()]), now)
+	}
+	t.cleanUpImages(ctx, policies, inUse, now)
+}
+
+// podImageKeys returns the state store keys of the images used by the Pod's containers that the tagger can tag,
+// and the keys of the tags they are referenced with for the images whose digest is known
+func (t *tagger) podImageKeys(ctx context.Context, pod *corev1.Pod) (keys, tagKeys []string) {
+	digests := imageDigests(pod)
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, container := range containers {
+			image, err := t.imageRegistry().ParseImageName(ctx, imageRewrites.Rewrite(container.Image))
+			if err != nil {
+				continue
+			}
+			registryID, repository, imageTag := *image.RegistryId, *image.RepositoryName, *image.ImageId.ImageTag
+			keys = append(keys, state.Key(registryID, repository, digests[container.Name], imageTag))
+			if digests[container.Name] != "" {
+				tagKeys = append(tagKeys, state.Key(registryID, repository, "", imageTag))
+			}
+		}
+	}
+	return keys, tagKeys
+}
+
+func (t *tagger) updatePolicyStatus(ctx context.Context, p *policy.Policy, coveredImages int, now time.Time) {
+	status, changed := p.UpdatedStatus(coveredImages, now)
+	if !changed {
+		return
+	}
+	updated := *p.TaggingPolicy
+	updated.Status = status
+	object, err := updated.ToUnstructured()
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	resource := policy.TaggingPolicyResource
+	if p.Namespace == "" {
+		resource = policy.ClusterTaggingPolicyResource
+	}
+	_, err = t.dynamicClient.Resource(resource).Namespace(p.Namespace).UpdateStatus(ctx, object, metav1.UpdateOptions{})
+	if err != nil {
+		log.WithError(err).WithField("policy", p.Key()).Warn("Could not update status of tagging policy")
+	}
+}
+
+// cleanUpImages removes the tags managed by the policies from the images no longer in use
+// that are beyond the number of images kept by the rotation rule of a policy,
+// or that were not used for longer than its cleanup rule allows.
+// Only the images that the tagger tagged for the Pods selected by a policy and whose digest is known are considered
+// by the policy. Nothing is cleaned up when a single namespace is watched, since the images used by the Pods
+// of the other namespaces would look unused
+func (t *tagger) cleanUpImages(ctx context.Context, policies []*policy.Policy, inUse map[string]bool, now time.Time) {
+	var cleaning []*policy.Policy
+	for _, p := range policies {
+		if p.Err == nil && (p.Spec.Rotation != nil || p.Spec.Cleanup != nil) {
+			cleaning = append(cleaning, p)
+		}
+	}
+	if len(cleaning) == 0 {
+		return
+	}
+	records := t.store.List()
+	for key, record := range records {
+		if recordInUse(key, record, inUse) && now.Sub(record.LastUsed()) >= usedAtRefreshPeriod {
+			refreshed := *record
+			refreshed.UsedAt = now
+			if err := t.store.Put(key, &refreshed); err != nil {
+				log.WithError(err).Error("Could not save state of image")
+			}
+			records[key] = &refreshed
+		}
+	}
+	if t.namespace != "" {
+		return
+	}
+	for _, p := range cleaning {
+		prefix := p.ManagedPrefix()
+		// repositories maps each repository to the keys of its unused images that carry a managed tag
+		repositories := make(map[string][]string)
+		for key, record := range records {
+			if record.Digest == "" || record.TaggedAt.IsZero() || record.Policy != p.Key() ||
+				!record.HasTagWithPrefix(prefix) || recordInUse(key, record, inUse) {
+				continue
+			}
+			repository := record.Registry + "/" + record.Repository
+			repositories[repository] = append(repositories[repository], key)
+		}
+		for _, keys := range repositories {
+			// The most recently tagged images come first
+			sort.Slice(keys, func(i, j int) bool {
+				if !records[keys[i]].TaggedAt.Equal(records[keys[j]].TaggedAt) {
+					return records[keys[i]].TaggedAt.After(records[keys[j]].TaggedAt)
+				}
+				return keys[i] < keys[j]
+			})
+			for i, key := range keys {
+				record := records[key]
+				rotated := p.Spec.Rotation != nil && i >= p.Spec.Rotation.KeepLast
+				expired := p.Spec.Cleanup != nil && now.Sub(record.LastUsed()) > p.Spec.Cleanup.UntagAfter.Duration
+				if rotated || expired {
+					records[key] = t.untagRecord(ctx, key, record, prefix)
+				}
+			}
+		}
+	}
+}
+
+// recordInUse reports whether the recorded image is used by a Pod, either by digest or by one of its tags
+func recordInUse(key string, record *state.Record, inUse map[string]bool) bool {
+	if inUse[key] {
+		return true
+	}
+	for _, tag := range record.Tags {
+		if inUse[state.Key(record.Registry, record.Repository, "", tag)] {
+			return true
+		}
+	}
+	return false
+}
+
+// untagRecord removes the tags starting with prefix from the recorded image and returns its updated record.
+// The last tag of the image is kept, and the image is then no longer managed by the tagger
+func (t *tagger) untagRecord(ctx context.Context, key string, record *state.Record, prefix string) *state.Record {
+	recordLog := log.WithFields(log.Fields{
+		"registry":   record.Registry,
+		"repository": record.Repository,
+		"digest":     record.Digest,
+	})
+	updated := *record
+	updated.Tags = nil
+	kept := false
+	for _, tag := range record.Tags {
+		if !strings.HasPrefix(tag, prefix) {
+			updated.Tags = append(updated.Tags, tag)
+			continue
+		}
+		err := t.imageRegistry().UntagImage(ctx, record.Registry, record.Repository, record.Digest, tag)
+		switch {
+		case err == nil:
+			recordLog.WithField("removedTag", tag).Info("Removed tag from image no longer in use")
+		case errors.Is(err, registry.ErrImageNotFound), errors.Is(err, registry.ErrRepositoryNotFound),
+			registry.ErrorCode(err) == ecr.ImageFailureCodeImageTagDoesNotMatchDigest:
+			recordLog.WithField("removedTag", tag).Debug("Image no longer has tag")
+		case errors.Is(err, registry.ErrLastTag):
+			recordLog.WithField("keptTag", tag).Info("Kept last tag of image no longer in use, ECR would delete the image")
+			updated.Tags = append(updated.Tags, tag)
+			kept = true
+		default:
+			recordLog.WithError(err).WithField("code", registry.ErrorCode(err)).Errorf("Could not remove tag '%s' from image", tag)
+			updated.Tags = append(updated.Tags, tag)
+		}
+	}
+	if !updated.HasTagWithPrefix(prefix) {
+		metrics.ImagesUntagged.Inc()
+	}
+	if kept || !updated.HasTagWithPrefix(prefix) {
+		updated.TaggedAt = time.Time{}
+		updated.Policy = ""
+	}
+	if err := t.store.Put(key, &updated); err != nil {
+		recordLog.WithError(err).Error("Could not save state of image")
+	}
+	return &updated
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecrimage"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/policy"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+type mockUntaggingECRClient struct {
+	ecriface.ECRAPI
+	// lastTags maps the digests of images to their only tag
+	lastTags map[string]string
+	untagged []string
+}
+
+func (m *mockUntaggingECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	digest := aws.StringValue(input.ImageIds[0].ImageDigest)
+	tags := []string{"latest", "deployed"}
+	if tag, ok := m.lastTags[digest]; ok {
+		tags = []string{tag}
+	}
+	return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{ImageTags: aws.StringSlice(tags)}}}, nil
+}
+
+func (m *mockUntaggingECRClient) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	for _, imageID := range input.ImageIds {
+		m.untagged = append(m.untagged, aws.StringValue(imageID.ImageDigest)+":"+aws.StringValue(imageID.ImageTag))
+	}
+	return &ecr.BatchDeleteImageOutput{}, nil
+}
+
+func key(digest string) string {
+	return state.Key("123456789012", "app", digest, "")
+}
+
+func TestCleanUpImages(t *testing.T) {
+	now := time.Now()
+	var tests = []struct {
+		description string
+		spec        policy.Spec
+		policy      string
+		namespace   string
+		expected    []string
+	}{
+		{"rotation", policy.Spec{TagPrefix: "deployed", Rotation: &policy.Rotation{KeepLast: 1}}, "default/policy", "", []string{"sha256:3:deployed3"}},
+		{"cleanup", policy.Spec{TagPrefix: "deployed", Cleanup: &policy.Cleanup{UntagAfter: metav1.Duration{Duration: 24 * time.Hour}}}, "default/policy", "", []string{"sha256:3:deployed3"}},
+		{"no rules", policy.Spec{TagPrefix: "deployed"}, "default/policy", "", nil},
+		{"other prefix", policy.Spec{TagPrefix: "production", Rotation: &policy.Rotation{KeepLast: 1}}, "default/policy", "", nil},
+		{"tagged for another policy", policy.Spec{TagPrefix: "deployed", Rotation: &policy.Rotation{KeepLast: 1}}, "default/other", "", nil},
+		{"single namespace", policy.Spec{TagPrefix: "deployed", Rotation: &policy.Rotation{KeepLast: 1}}, "default/policy", "default", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			record := func(digest string, tags []string, taggedAt, checkedAt time.Time) *state.Record {
+				return &state.Record{Registry: "123456789012", Repository: "app", Digest: digest, Tags: tags, TaggedAt: taggedAt, CheckedAt: checkedAt, Policy: test.policy}
+			}
+			store := state.NewMemoryStore()
+			// In use
+			_ = store.Put(key("sha256:1"), record("sha256:1", []string{"deployed1"}, now.Add(-time.Hour), now.Add(-72*time.Hour)))
+			// Unused, most recently tagged and used
+			_ = store.Put(key("sha256:2"), record("sha256:2", []string{"latest", "deployed2"}, now.Add(-2*time.Hour), now.Add(-time.Hour)))
+			// Unused, tagged and used a long time ago
+			_ = store.Put(key("sha256:3"), record("sha256:3", []string{"v3", "deployed3"}, now.Add(-72*time.Hour), now.Add(-48*time.Hour)))
+			// Not tagged by the tagger
+			_ = store.Put(key("sha256:4"), record("sha256:4", []string{"deployed4"}, time.Time{}, now.Add(-48*time.Hour)))
+			// Digest unknown
+			_ = store.Put(state.Key("123456789012", "app", "", "v5"), record("", []string{"v5", "deployed5"}, now.Add(-72*time.Hour), now.Add(-48*time.Hour)))
+			mockClient := &mockUntaggingECRClient{}
+			podTagger := &tagger{
+				ecrClient: &registry.Client{ECRAPI: mockClient},
+				store:     store,
+				namespace: test.namespace,
+			}
+			inUse := map[string]bool{key("sha256:1"): true}
+
+			podTagger.cleanUpImages(context.Background(), []*policy.Policy{definePolicy(test.spec)}, inUse, now)
+
+			if diff := cmp.Diff(mockClient.untagged, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", mockClient.untagged, diff)
+			}
+			if len(test.expected) == 0 {
+				return
+			}
+			untagged, _ := store.Get(key("sha256:3"))
+			if diff := cmp.Diff(untagged.Tags, []string{"v3"}); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", untagged.Tags, diff)
+			}
+			if !untagged.TaggedAt.IsZero() {
+				t.Errorf("Expected tagging time to be reset, but got '%v' instead", untagged.TaggedAt)
+			}
+			inUseRecord, _ := store.Get(key("sha256:1"))
+			if !inUseRecord.LastUsed().Equal(now) {
+				t.Errorf("Expected image in use to be last used at '%v', but got '%v' instead", now, inUseRecord.LastUsed())
+			}
+		})
+	}
+}
+
+func TestCleanUpImagesLastTag(t *testing.T) {
+	now := time.Now()
+	store := state.NewMemoryStore()
+	_ = store.Put(key("sha256:1"), &state.Record{
+		Registry:   "123456789012",
+		Repository: "app",
+		Digest:     "sha256:1",
+		Tags:       []string{"deployed1"},
+		TaggedAt:   now.Add(-72 * time.Hour),
+		CheckedAt:  now.Add(-48 * time.Hour),
+		Policy:     "default/policy",
+	})
+	mockClient := &mockUntaggingECRClient{lastTags: map[string]string{"sha256:1": "deployed1"}}
+	podTagger := &tagger{
+		ecrClient: &registry.Client{ECRAPI: mockClient},
+		store:     store,
+	}
+	spec := policy.Spec{TagPrefix: "deployed", Cleanup: &policy.Cleanup{UntagAfter: metav1.Duration{Duration: 24 * time.Hour}}}
+
+	podTagger.cleanUpImages(context.Background(), []*policy.Policy{definePolicy(spec)}, map[string]bool{}, now)
+
+	if len(mockClient.untagged) != 0 {
+		t.Errorf("Expected the last tag of the image to be kept, but got %v removed instead", mockClient.untagged)
+	}
+	kept, _ := store.Get(key("sha256:1"))
+	if diff := cmp.Diff(kept.Tags, []string{"deployed1"}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", kept.Tags, diff)
+	}
+	if !kept.TaggedAt.IsZero() || kept.Policy != "" {
+		t.Errorf("Expected image to no longer be managed, but got record %+v", kept)
+	}
+}
+
+// newFakeDynamicClient returns a fake dynamic client serving the given objects and listing the tagger's custom resources
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{
+		policy.TaggingPolicyResource:        "TaggingPolicyList",
+		policy.ClusterTaggingPolicyResource: "ClusterTaggingPolicyList",
+		ecrimage.Resource:                   "EcrImageList",
+	}
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+}
+
+func definePolicy(spec policy.Spec) *policy.Policy {
+	return policy.Compile(&policy.TaggingPolicy{
+		TypeMeta:   metav1.TypeMeta{APIVersion: policy.Group + "/" + policy.Version, Kind: "TaggingPolicy"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "policy", Generation: 1},
+		Spec:       spec,
+	})
+}
+
+func TestReconcilePolicies(t *testing.T) {
+	ctx := context.Background()
+	selected := definePolicy(policy.Spec{TagPrefix: "team", Selector: &metav1.LabelSelector{
+		MatchLabels: map[string]string{"team": "a"},
+	}})
+	object, err := selected.ToUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamicClient := newFakeDynamicClient(object)
+	podTagger := &tagger{
+		store:         state.NewMemoryStore(),
+		dynamicClient: dynamicClient,
+		policies:      policy.NewSet(),
+	}
+	podTagger.putPolicy(object)
+
+	var pods []interface{}
+	for _, image := range []string{"app:latest", "app:v1", "app:v1", "other:latest"} {
+		pod := definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/"+image)
+		pod.Labels = map[string]string{"team": "a"}
+		pods = append(pods, pod)
+	}
+	pods = append(pods, definePod("default", "unselected", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/unselected:latest"))
+	podTagger.reconcilePolicies(ctx, pods)
+
+	updated, err := dynamicClient.Resource(policy.TaggingPolicyResource).Namespace("default").Get(ctx, "policy", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	taggingPolicy, err := policy.FromUnstructured(updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taggingPolicy.Status.CoveredImages != 3 {
+		t.Errorf("Expected policy to cover 3 images, but got %d instead", taggingPolicy.Status.CoveredImages)
+	}
+	conditions := taggingPolicy.Status.Conditions
+	if len(conditions) != 1 || conditions[0].Type != policy.ConditionReady || conditions[0].Status != corev1.ConditionTrue {
+		t.Errorf("Expected policy to be ready, but got conditions '%v' instead", conditions)
+	}
+}
+
+func TestWatchPolicies(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	object, err := definePolicy(policy.Spec{Tag: "production"}).ToUnstructured()
+	if err != nil {
+		t.Fatal(err)
+	}
+	podTagger := &tagger{
+		namespace:     "default",
+		dynamicClient: newFakeDynamicClient(object),
+	}
+	if !cache.WaitForCacheSync(ctx.Done(), podTagger.watchPolicies(ctx)...) {
+		t.Fatal("Timed out waiting for caches to sync")
+	}
+	tag, tagPrefix, err := podTagger.podTag(definePod("default", "pod", "app:latest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != "production" || tagPrefix != "production" {
+		t.Errorf("Expected tag and prefix 'production', but got '%s' and '%s' instead", tag, tagPrefix)
+	}
+	if key := podTagger.podPolicy(definePod("default", "pod", "app:latest")); key != "default/policy" {
+		t.Errorf("Expected policy 'default/policy', but got '%s' instead", key)
+	}
+}
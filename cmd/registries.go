@@ -0,0 +1,116 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+)
+
+var (
+	ociRegistries        []string
+	ociRegistryConfig    string
+	ociRegistryPlainHTTP bool
+	ecrPublic            bool
+)
+
+func init() {
+	rootCmd.Flags().StringSliceVar(&ociRegistries, "oci-registry", nil, "Host of a registry implementing the OCI Distribution API whose images are tagged too, e.g. harbor.example.com. Can be given multiple times")
+	rootCmd.Flags().StringVar(&ociRegistryConfig, "oci-registry-config", "", "Path of a Docker config.json file holding the credentials of the OCI registries")
+	rootCmd.Flags().BoolVar(&ociRegistryPlainHTTP, "oci-registry-plain-http", false, "Talk to the OCI registries over HTTP instead of HTTPS")
+	rootCmd.Flags().BoolVar(&ecrPublic, "ecr-public", false, "Tag images from the account's ECR Public registries (public.ecr.aws) too")
+}
+
+// newRegistries returns the registries whose images are tagged: ECR, ECR Public if enabled by the --ecr-public flag
+// and the OCI registries given by the --oci-registry flag. It returns nil if only ECR is used
+func newRegistries(ecrClient *registry.Client) (registry.Registry, error) {
+	if !ecrPublic && len(ociRegistries) == 0 {
+		return nil, nil
+	}
+	credentials, err := readRegistryCredentials(ociRegistryConfig)
+	if err != nil {
+		return nil, err
+	}
+	registries := registry.Registries{ecrClient}
+	defaults := registry.DefaultOptions()
+	if ecrPublic {
+		options := defaults
+		options.MaxRetries = maxRetries
+		publicClient, err := registry.NewPublicClient(options)
+		if err != nil {
+			return nil, err
+		}
+		registries = append(registries, publicClient)
+	}
+	for _, host := range ociRegistries {
+		options := registry.OCIOptions{
+			PlainHTTP:      ociRegistryPlainHTTP,
+			MaxRetries:     maxRetries,
+			RetryBaseDelay: defaults.RetryBaseDelay,
+			RetryMaxDelay:  defaults.RetryMaxDelay,
+		}
+		if credential, ok := credentials[host]; ok {
+			options.Username, options.Password = credential[0], credential[1]
+		}
+		registries = append(registries, registry.NewOCIClient(host, options))
+	}
+	return registries, nil
+}
+
+// readRegistryCredentials returns the username and password of each registry found in the given Docker config.json file
+func readRegistryCredentials(path string) (map[string][2]string, error) {
+	credentials := make(map[string][2]string)
+	if path == "" {
+		return credentials, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("Could not parse registry config '%s': %v", path, err)
+	}
+	for host, auth := range config.Auths {
+		username, password := auth.Username, auth.Password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode credentials of registry '%s': %v", host, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("Invalid credentials of registry '%s'", host)
+			}
+			username, password = parts[0], parts[1]
+		}
+		// Hosts can be given as URLs, e.g. https://harbor.example.com
+		host = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(host, "https://"), "http://"), "/")
+		credentials[host] = [2]string{username, password}
+	}
+	return credentials, nil
+}
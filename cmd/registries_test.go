@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadRegistryCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"auths": {
+	"https://harbor.example.com/": {"auth": "cm9ib3Q6czNjcjN0OndpdGg6Y29sb25z"},
+	"registry.example.com:5000": {"username": "user", "password": "secret"}
+}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := readRegistryCredentials(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][2]string{
+		"harbor.example.com":        {"robot", "s3cr3t:with:colons"},
+		"registry.example.com:5000": {"user", "secret"},
+	}
+	if diff := cmp.Diff(credentials, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", credentials, diff)
+	}
+	if _, err := readRegistryCredentials(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	reportNamespace string
+	reportTagPrefix string
+	reportOutput    string
+)
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Lists the ECR images used by Pods in cluster and whether they are protected",
+	Long: `A command that lists all images from ECR that are used by Pods in the kubernetes cluster
+together with their tags, whether one of them starts with the given tag prefix and the workloads that use them.
+It does not modify anything.`,
+	// The output format is checked before the images are looked up on ECR
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateReportOutput(reportOutput)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		ecrClient, err := registry.NewClient(registry.DefaultOptions())
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientset, err := newClientset()
+		if err != nil {
+			log.Fatal(err)
+		}
+		images, err := buildReport(context.Background(), clientset, ecrClient, reportNamespace, reportTagPrefix)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeReport(os.Stdout, images, reportOutput); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+	reportCmd.Flags().StringVar(&reportNamespace, "namespace", corev1.NamespaceAll, "namespace from which images will be listed. Defaults to all namespaces")
+	reportCmd.Flags().StringVar(&reportTagPrefix, "tag-prefix", "deployed", "Prefix of the tags that protect images")
+	reportCmd.Flags().StringVarP(&reportOutput, "output", "o", "table", "Output format, one of 'table', 'json' or 'csv'")
+}
+
+// validateReportOutput returns an error if the given output format of the report is unknown
+func validateReportOutput(format string) error {
+	switch format {
+	case "table", "json", "csv":
+		return nil
+	}
+	return fmt.Errorf("Unknown output format '%s'", format)
+}
+
+// reportImage is an ECR image used by Pods in the cluster
+type reportImage struct {
+	Registry   string   `json:"registry"`
+	Repository string   `json:"repository"`
+	Digest     string   `json:"digest"`
+	Tags       []string `json:"tags"`
+	// Managed reports whether one of the image's tags starts with the tag prefix
+	Managed bool `json:"managed"`
+	// Missing reports whether the image or its repository is missing from ECR,
+	// in which case the Pods using it will fail to start once rescheduled
+	Missing bool `json:"missing"`
+	// Workloads are the workloads whose Pods use the image
+	Workloads []string `json:"workloads"`
+	// Error is set if the image could not be looked up on ECR
+	Error string `json:"error,omitempty"`
+	// Upstream is the image cached by the image if its repository was created by a pull through cache rule
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// buildReport looks up on ECR all images used by Pods in the given namespace
+func buildReport(ctx context.Context, clientset kubernetes.Interface, ecrClient *registry.Client, namespace, tagPrefix string) ([]*reportImage, error) {
+	images, err := listUsedImages(ctx, clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+	report := make([]*reportImage, 0, len(images))
+	for _, image := range images {
+		entry := lookUpReportImage(ctx, ecrClient, image.image, tagPrefix)
+		entry.Workloads = image.workloads
+		report = append(report, entry)
+	}
+	return report, nil
+}
+
+// usedImage is an ECR image used by Pods in the cluster
+type usedImage struct {
+	// image is identified by its digest when one of the Pods using it started, by its tag otherwise
+	image *ecr.Image
+	// workloads are the workloads whose Pods use the image
+	workloads []string
+}
+
+// listUsedImages returns the ECR images used by Pods in the given namespace, sorted by name
+func listUsedImages(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]*usedImage, error) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	podList := make([]*corev1.Pod, 0, len(pods.Items))
+	for i := range pods.Items {
+		podList = append(podList, &pods.Items[i])
+	}
+	return groupUsedImages(podList, func(pod *corev1.Pod) string {
+		return podWorkload(clientset, pod)
+	}), nil
+}
+
+// groupUsedImages returns the ECR images used by the given Pods, sorted by name.
+// workload returns the workload of each Pod
+func groupUsedImages(pods []*corev1.Pod, workload func(pod *corev1.Pod) string) []*usedImage {
+	images := make(map[string]*usedImage)
+	var keys []string
+	for _, pod := range pods {
+		workload := workload(pod)
+		digests := imageDigests(pod)
+		containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			image, err := registry.ParseImageName(imageRewrites.Rewrite(container.Image))
+			if err != nil {
+				continue
+			}
+			if digest := digests[container.Name]; digest != "" {
+				image.ImageId.ImageDigest = aws.String(digest)
+			}
+			key := registry.FormatImageName(image)
+			if image.ImageId.ImageDigest != nil {
+				key = *image.RegistryId + "/" + *image.RepositoryName + "@" + *image.ImageId.ImageDigest
+			}
+			entry, ok := images[key]
+			if !ok {
+				entry = &usedImage{image: image}
+				images[key] = entry
+				keys = append(keys, key)
+			}
+			if !containsString(entry.workloads, workload) {
+				entry.workloads = append(entry.workloads, workload)
+			}
+		}
+	}
+	sort.Strings(keys)
+	used := make([]*usedImage, 0, len(keys))
+	for _, key := range keys {
+		sort.Strings(images[key].workloads)
+		used = append(used, images[key])
+	}
+	return used
+}
+
+func lookUpReportImage(ctx context.Context, ecrClient *registry.Client, image *ecr.Image, tagPrefix string) *reportImage {
+	entry := &reportImage{
+		Registry:   aws.StringValue(image.RegistryId),
+		Repository: aws.StringValue(image.RepositoryName),
+		Digest:     aws.StringValue(image.ImageId.ImageDigest),
+	}
+	if upstream, ok := ecrClient.Upstream(ctx, image); ok {
+		entry.Upstream = upstream
+	}
+	detail, err := ecrClient.DescribeImage(ctx, image)
+	if err != nil {
+		entry.Error = errorCode(err)
+		entry.Missing = errors.Is(err, registry.ErrImageNotFound) || errors.Is(err, registry.ErrRepositoryNotFound)
+		return entry
+	}
+	entry.Digest = aws.StringValue(detail.ImageDigest)
+	entry.Tags = aws.StringValueSlice(detail.ImageTags)
+	sort.Strings(entry.Tags)
+	for _, tag := range entry.Tags {
+		if strings.HasPrefix(tag, tagPrefix) {
+			entry.Managed = true
+		}
+	}
+	return entry
+}
+
+// podWorkload returns the name of the workload managing the given Pod, or of the Pod itself
+func podWorkload(clientset kubernetes.Interface, pod *corev1.Pod) string {
+	owner, err := podOwner(clientset, pod)
+	if err != nil || owner == nil {
+		return fmt.Sprintf("Pod %s/%s", pod.Namespace, pod.Name)
+	}
+	ref := owner.(*corev1.ObjectReference)
+	return fmt.Sprintf("%s %s/%s", ref.Kind, ref.Namespace, ref.Name)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// writeReport writes the given images in the given format
+func writeReport(w io.Writer, images []*reportImage, format string) error {
+	switch format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "REGISTRY\tREPOSITORY\tDIGEST\tTAGS\tMANAGED\tMISSING\tUPSTREAM\tWORKLOADS")
+		for _, image := range images {
+			tags := strings.Join(image.Tags, ",")
+			if image.Error != "" {
+				tags = "<" + image.Error + ">"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%t\t%s\t%s\n",
+				image.Registry, image.Repository, image.Digest, tags, image.Managed, image.Missing, image.Upstream, strings.Join(image.Workloads, ","))
+		}
+		return tw.Flush()
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(images)
+	case "csv":
+		writer := csv.NewWriter(w)
+		_ = writer.Write([]string{"registry", "repository", "digest", "tags", "managed", "missing", "workloads", "error", "upstream"})
+		for _, image := range images {
+			_ = writer.Write([]string{
+				image.Registry,
+				image.Repository,
+				image.Digest,
+				strings.Join(image.Tags, ";"),
+				strconv.FormatBool(image.Managed),
+				strconv.FormatBool(image.Missing),
+				strings.Join(image.Workloads, ";"),
+				image.Error,
+				image.Upstream,
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+	default:
+		return fmt.Errorf("Unknown output format '%s'", format)
+	}
+}
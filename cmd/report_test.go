@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// mockReportECRClient describes images whose tag is "latest" as tagged and all others as missing
+type mockReportECRClient struct {
+	ecriface.ECRAPI
+}
+
+func (m *mockReportECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	var output ecr.DescribeImagesOutput
+	for _, imageID := range input.ImageIds {
+		if aws.StringValue(imageID.ImageTag) == "missing" {
+			continue
+		}
+		output.ImageDetails = append(output.ImageDetails, &ecr.ImageDetail{
+			ImageDigest: aws.String("sha256:1234"),
+			ImageTags:   aws.StringSlice([]string{"latest", "deployed1599999999"}),
+		})
+	}
+	return &output, nil
+}
+
+func (m *mockReportECRClient) DescribePullThroughCacheRulesWithContext(ctx aws.Context, input *ecr.DescribePullThroughCacheRulesInput, opts ...request.Option) (*ecr.DescribePullThroughCacheRulesOutput, error) {
+	return &ecr.DescribePullThroughCacheRulesOutput{
+		PullThroughCacheRules: []*ecr.PullThroughCacheRule{
+			{EcrRepositoryPrefix: aws.String("quay"), UpstreamRegistryUrl: aws.String("quay.io")},
+		},
+	}, nil
+}
+
+func TestReport(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		definePod("default", "web", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest"),
+		definePod("other", "worker", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest"),
+		definePod("default", "job", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:missing"),
+		definePod("default", "nginx", "nginx:latest"),
+		definePod("default", "cached", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/quay/prometheus/node-exporter:latest"),
+	)
+	ecrClient := &registry.Client{ECRAPI: &mockReportECRClient{}}
+
+	images, err := buildReport(context.Background(), clientset, ecrClient, corev1.NamespaceAll, "deployed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*reportImage{
+		{
+			Registry:   "123456789012",
+			Repository: "quay/prometheus/node-exporter",
+			Digest:     "sha256:1234",
+			Tags:       []string{"deployed1599999999", "latest"},
+			Managed:    true,
+			Workloads:  []string{"Pod default/cached"},
+			Upstream:   "quay.io/prometheus/node-exporter:latest",
+		},
+		{
+			Registry:   "123456789012",
+			Repository: "test-image",
+			Digest:     "sha256:1234",
+			Tags:       []string{"deployed1599999999", "latest"},
+			Managed:    true,
+			Workloads:  []string{"Pod default/web", "Pod other/worker"},
+		},
+		{
+			Registry:   "123456789012",
+			Repository: "test-image",
+			Missing:    true,
+			Workloads:  []string{"Pod default/job"},
+			Error:      "ImageNotFoundException",
+		},
+	}
+	if diff := cmp.Diff(images, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", images, diff)
+	}
+
+	var tests = []struct {
+		description string
+		format      string
+		expected    string
+	}{
+		{"csv", "csv", `registry,repository,digest,tags,managed,missing,workloads,error,upstream
+123456789012,quay/prometheus/node-exporter,sha256:1234,deployed1599999999;latest,true,false,Pod default/cached,,quay.io/prometheus/node-exporter:latest
+123456789012,test-image,sha256:1234,deployed1599999999;latest,true,false,Pod default/web;Pod other/worker,,
+123456789012,test-image,,,false,true,Pod default/job,ImageNotFoundException,
+`},
+		{"table", "table", `REGISTRY      REPOSITORY                     DIGEST       TAGS                       MANAGED  MISSING  UPSTREAM                                 WORKLOADS
+123456789012  quay/prometheus/node-exporter  sha256:1234  deployed1599999999,latest  true     false    quay.io/prometheus/node-exporter:latest  Pod default/cached
+123456789012  test-image                     sha256:1234  deployed1599999999,latest  true     false                                             Pod default/web,Pod other/worker
+123456789012  test-image                                  <ImageNotFoundException>   false    true                                              Pod default/job
+`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := writeReport(&buffer, images, test.format); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(buffer.String(), test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+			}
+		})
+	}
+	if err := writeReport(&bytes.Buffer{}, images, "xml"); err == nil {
+		t.Error("Expected an error for an unknown output format")
+	}
+	if err := validateReportOutput("xml"); err == nil {
+		t.Error("Expected an error for an unknown output format")
+	}
+	if err := validateReportOutput("csv"); err != nil {
+		t.Errorf("Expected output format 'csv' to be valid, but got '%v' instead", err)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	imageRewriteRules []string
+	// imageRewrites translate the images of Pod specs to the images from ECR that back them
+	imageRewrites registry.RewriteRules
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringArrayVar(&imageRewriteRules, "image-rewrite", nil, "Rule rewriting the images of Pods to the images from ECR that back them, of the form PREFIX=REPLACEMENT or regex:PATTERN=REPLACEMENT. Can be given multiple times, the first matching rule applies")
+	cobra.OnInitialize(initImageRewrites)
+}
+
+func initImageRewrites() {
+	rules, err := registry.ParseRewriteRules(imageRewriteRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imageRewrites = rules
+}
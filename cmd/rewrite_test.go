@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"testing"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestGroupUsedImagesRewrite(t *testing.T) {
+	rules, err := registry.ParseRewriteRules([]string{"docker.io/=123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageRewrites = rules
+	defer func() { imageRewrites = nil }()
+
+	pods := []*corev1.Pod{
+		definePod("default", "web", "nginx:1.19"),
+		definePod("default", "app", "gcr.io/project/app:v1"),
+	}
+	images := groupUsedImages(pods, func(pod *corev1.Pod) string { return pod.Name })
+	if len(images) != 1 {
+		t.Fatalf("Expected 1 image, but got %d instead", len(images))
+	}
+	expected := "123456789012/docker-hub/library/nginx:1.19"
+	if actual := registry.FormatImageName(images[0].image); actual != expected {
+		t.Errorf("Expected image '%s', but got '%s' instead", expected, actual)
+	}
+}
+
+func TestImageRewriteFlag(t *testing.T) {
+	flag := rootCmd.PersistentFlags().Lookup("image-rewrite")
+	defer func() { imageRewriteRules = nil }()
+	// Commas are part of regular expressions, they do not separate rules
+	rule := `regex:^docker\.io/([a-z]{1,3})/(.+)$=mirror/${1}/${2}`
+	if err := flag.Value.Set(rule); err != nil {
+		t.Fatal(err)
+	}
+	if len(imageRewriteRules) != 1 || imageRewriteRules[0] != rule {
+		t.Errorf("Expected rules '%v', but got '%v' instead", []string{rule}, imageRewriteRules)
+	}
+}
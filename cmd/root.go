@@ -18,28 +18,47 @@ package cmd
 import (
 	"context"
 	"fmt"
-	"log"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 
 	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
-	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/health"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/client-go/informers"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	namespace string
-	tag       string
-	tagPrefix string
+	namespace  string
+	tag        string
+	tagPrefix  string
+	maxRetries int
+	rateLimits map[string]string
+	cacheTTL   time.Duration
+	cacheSize  int
+	workers    int
+
+	repositoryTags        map[string]string
+	repositoryLastUsedTag string
+
+	shutdownTimeout time.Duration
+
+	stateStore     string
+	stateNamespace string
+	stateConfigMap string
+	stateFile      string
+	stateTTL       time.Duration
+	stateRetention time.Duration
+
+	kubeconfig string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -58,29 +77,115 @@ that are used by Pods in the kubernetes cluster.`,
 			_ = cmd.Help()
 			os.Exit(1)
 		}
-		ecrClient, err := registry.NewClient()
+		ecrClient, err := newECRClient()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		config, err := rest.InClusterConfig()
+		clientset, err := newClientset()
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		clientset, err := kubernetes.NewForConfig(config)
+		registries, err := newRegistries(ecrClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+		scanPolicy, err := newScanPolicy()
 		if err != nil {
 			log.Fatal(err)
 		}
+		var dynamicClient dynamic.Interface
+		if taggingPolicies || imageResources {
+			dynamicClient, err = newDynamicClient()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go cancelOnSignal(cancel)
+
+		checker := health.NewChecker(readinessECRWindow, livenessStallTimeout, ecrClient.LastSuccess, ecrClient.Ping)
+		run := func(ctx context.Context) {
+			checker.SetStandby(false)
+			store, err := newStateStore(clientset)
+			if err != nil {
+				log.Fatal(err)
+			}
+			recorder, err := newEventRecorder(clientset, eventTarget)
+			if err != nil {
+				log.Fatal(err)
+			}
+			t := &tagger{
+				clientset: clientset,
+				ecrClient: ecrClient,
+				store:     store,
+				health:    checker,
+				tag:       tag,
+				tagPrefix: tagPrefix,
+				namespace: namespace,
+				workers:   workers,
+
+				recorder:    recorder,
+				eventTarget: eventTarget,
 
-		ctx := context.Background()
-		err = findAndTagImages(ctx, clientset, ecrClient, tag, tagPrefix, namespace)
+				annotateOwners: annotateOwners,
+
+				registries: registries,
+				scanPolicy: scanPolicy,
+
+				dynamicClient: dynamicClient,
+
+				taggingPolicies:       taggingPolicies,
+				policyReconcilePeriod: policyReconcilePeriod,
+
+				imageResources:      imageResources,
+				imageResourcePeriod: imageResourcePeriod,
+
+				recordTTL:       stateTTL,
+				recordRetention: stateRetention,
+				shutdownTimeout: shutdownTimeout,
+			}
+			err = t.findAndTagImages(ctx)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		serveHTTP(checker)
+
+		if !leaderElect {
+			run(ctx)
+			return
+		}
+		checker.SetStandby(true)
+		identity, err := os.Hostname()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = runWithLeaderElection(ctx, clientset, identity, run)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if ctx.Err() == nil {
+			log.Fatal("Leadership lost")
+		}
 	},
 }
 
+// cancelOnSignal calls cancel when the process receives SIGTERM or SIGINT.
+// The process exits immediately if it receives a second signal
+func cancelOnSignal(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	received := <-signals
+	log.Infof("Received signal '%s', shutting down", received)
+	cancel()
+	<-signals
+	log.Fatal("Received a second signal, exiting immediately")
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -90,112 +195,101 @@ func Execute() {
 }
 
 func init() {
-	cobra.OnInitialize()
+	cobra.OnInitialize(initLogging)
+	rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "", "Path of the kubeconfig file. Defaults to the in-cluster configuration, or to the default kubeconfig outside of a cluster")
 	rootCmd.Flags().StringVar(&namespace, "namespace", corev1.NamespaceAll, "namespace from which images will be listed. Defaults to all namespaces")
 	rootCmd.Flags().StringVar(&tagPrefix, "tag-prefix", "deployed", "Tag prefix that will be used to form the image tag. Defaults to 'deployed'")
 	rootCmd.Flags().StringVar(&tag, "tag", "", "Image tag. If left empty, tag-prefix will be used to create a tag instead")
+	rootCmd.Flags().StringToStringVar(&rateLimits, "rate-limit", nil, "Rate limits of ECR API operations in calls per second given as OPERATION=RATE[:BURST], e.g. PutImage=5:10. Defaults to DescribeImages=20, BatchGetImage=20, PutImage=10, DescribeRepositories=5 and TagResource=5")
+	rootCmd.Flags().IntVar(&maxRetries, "max-retries", registry.DefaultOptions().MaxRetries, "Maximum number of times a throttled or failed ECR API call is retried")
+	rootCmd.Flags().DurationVar(&cacheTTL, "cache-ttl", registry.DefaultOptions().CacheTTL, "Duration for which image tags and manifests fetched from ECR are cached. Set to 0 to disable caching")
+	rootCmd.Flags().IntVar(&cacheSize, "cache-size", registry.DefaultOptions().CacheSize, "Maximum number of images whose tags and manifests are cached")
+	rootCmd.Flags().StringToStringVar(&repositoryTags, "repository-tag", nil, "AWS resource tag added to the ECR repositories of images in use given as KEY=VALUE, e.g. in-use-by-cluster=prod-eu. Can be given multiple times")
+	rootCmd.Flags().StringVar(&repositoryLastUsedTag, "repository-last-used-tag", "", "Key of the AWS resource tag set to the date on which the images of an ECR repository were last seen in use, e.g. last-used")
+	rootCmd.Flags().IntVar(&workers, "workers", 1, "Number of Pods that are processed concurrently")
+	rootCmd.Flags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long Pods being processed are waited for when shutting down")
+	rootCmd.Flags().StringVar(&stateStore, "state-store", "memory", "Where the images that were already tagged are recorded. One of 'memory', 'configmap' or 'file'")
+	rootCmd.Flags().StringVar(&stateNamespace, "state-namespace", "kube-system", "Namespace of the ConfigMap used by the 'configmap' state store")
+	rootCmd.Flags().StringVar(&stateConfigMap, "state-configmap", "kube-ecr-tagger-state", "Name of the ConfigMap used by the 'configmap' state store")
+	rootCmd.Flags().StringVar(&stateFile, "state-file", "kube-ecr-tagger-state.json", "Path of the file used by the 'file' state store")
+	rootCmd.Flags().DurationVar(&stateTTL, "state-ttl", 24*time.Hour, "How long the recorded tags of an image are trusted before they are looked up on ECR again. Set to 0 to always trust them")
+	rootCmd.Flags().DurationVar(&stateRetention, "state-retention", 30*24*time.Hour, "How long the records of images no longer used by Pods are kept in the state store")
 }
 
-func findAndTagImages(ctx context.Context, clientset kubernetes.Interface, ecrClient *registry.Client, tag, tagPrefix, namespace string) error {
-	// create the shared informer and resync every 5s
-	defaultResyncPeriod := 5 * time.Second
-	factory := informers.NewSharedInformerFactoryWithOptions(clientset, defaultResyncPeriod, informers.WithNamespace(namespace))
-	informer := factory.Core().V1().Pods().Informer()
-	defer runtime.HandleCrash()
-
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			if tag == "" {
-				tag := tagPrefix + strconv.FormatInt(time.Now().Unix(), 10)
-				tagPodImages(ecrClient, tag, tagPrefix, obj)
-			} else {
-				tagPodImages(ecrClient, tag, tag, obj)
-			}
-		},
-		UpdateFunc: func(new interface{}, old interface{}) {
-			if tag == "" {
-				tag := tagPrefix + strconv.FormatInt(time.Now().Unix(), 10)
-				tagPodImages(ecrClient, tag, tagPrefix, new)
-			} else {
-				tagPodImages(ecrClient, tag, tag, new)
-			}
-		},
-	})
-	go informer.Run(ctx.Done())
-	if !cache.WaitForNamedCacheSync("kube-ecr-tagger", ctx.Done(), informer.HasSynced) {
-		err := fmt.Errorf("Timed out waiting for caches to sync")
-		runtime.HandleError(err)
-		return err
+// newECRClient returns an ECR client configured by the retry, rate limit and cache flags
+func newECRClient() (*registry.Client, error) {
+	options, err := ecrOptions()
+	if err != nil {
+		return nil, err
 	}
-	<-ctx.Done()
-
-	return nil
+	return registry.NewClient(options)
 }
 
-func tagPodImages(ecrClient *registry.Client, tag, tagPrefix string, obj interface{}) {
-	pod, ok := obj.(*corev1.Pod)
-	if !ok {
-		return
+// ecrOptions returns the options of ECR clients given by the retry, rate limit and cache flags
+func ecrOptions() (registry.Options, error) {
+	options := registry.DefaultOptions()
+	options.MaxRetries = maxRetries
+	options.CacheTTL = cacheTTL
+	options.CacheSize = cacheSize
+	options.RepositoryTags = repositoryTags
+	options.RepositoryLastUsedTag = repositoryLastUsedTag
+	limits, err := registry.ParseRateLimits(rateLimits)
+	if err != nil {
+		return options, err
 	}
-	log.Print("Getting images from Pod's containers")
-	var ecrImages []*ecr.Image
-	// Get from init containers all images that are from ECR
-	for _, container := range pod.Spec.InitContainers {
-		image, err := registry.ParseImageName(container.Image)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		ecrImages = append(ecrImages, image)
+	for operation, limit := range limits {
+		options.RateLimits[operation] = limit
 	}
-	// Get from containers all images that are from ECR
-	// and whose current Tag does not start with tagPrefix
-	for _, container := range pod.Spec.Containers {
-		image, err := registry.ParseImageName(container.Image)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		if strings.HasPrefix(*image.ImageId.ImageTag, tagPrefix) {
-			log.Printf("Image '%s' current Tag already starts with '%s'", container.Image, tagPrefix)
-			continue
-		}
-		ecrImages = append(ecrImages, image)
+	return options, nil
+}
+
+// newClientset returns a clientset for the cluster given by the kubeconfig flag
+func newClientset() (kubernetes.Interface, error) {
+	config, err := newRESTConfig()
+	if err != nil {
+		return nil, err
 	}
-	if len(ecrImages) == 0 {
-		log.Print("No ECR images are used in this Pod")
-		return
+	return kubernetes.NewForConfig(config)
+}
+
+// newDynamicClient returns a dynamic client for the cluster given by the kubeconfig flag
+func newDynamicClient() (dynamic.Interface, error) {
+	config, err := newRESTConfig()
+	if err != nil {
+		return nil, err
 	}
-	// Skip all images that have a least one Tag that starts with tagPrefix
-	var imagesToTag []*ecr.Image
-SkipOuterLoop:
-	for _, image := range ecrImages {
-		imageTags, err := ecrClient.GetImageTags(image)
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		for _, tag := range imageTags {
-			if strings.HasPrefix(*tag, tagPrefix) {
-				log.Printf("Image '%s' already has a Tag that starts with '%s'", image, tagPrefix)
-				continue SkipOuterLoop
-			}
-		}
-		imagesToTag = append(imagesToTag, image)
+	return dynamic.NewForConfig(config)
+}
+
+// newRESTConfig returns the configuration of the cluster given by the kubeconfig flag.
+// If the flag is empty, the cluster the command runs in is used, or the default kubeconfig outside of a cluster
+func newRESTConfig() (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
 	}
-	// Get the images' manifests from ECR
-	// The manifests are needed in order to add a new Tag to existing images
-	log.Print("Getting images' manifests from ECR")
-	imagesToTag, err := ecrClient.GetImagesInformation(imagesToTag)
-	if err != nil {
-		log.Print(err)
-		return
+	if kubeconfig != "" || err == rest.ErrNotInCluster {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		loadingRules.ExplicitPath = kubeconfig
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{}).ClientConfig()
 	}
-	// Add the given tag to all images
-	log.Printf("Tagging images' on ECR with tag '%s'", tag)
-	err = ecrClient.TagImages(imagesToTag, tag)
 	if err != nil {
-		log.Print(err)
-		return
+		return nil, err
+	}
+	return config, nil
+}
+
+// newStateStore instantiates the state store selected with the --state-store flag
+func newStateStore(clientset kubernetes.Interface) (state.Store, error) {
+	switch stateStore {
+	case "memory":
+		return state.NewMemoryStore(), nil
+	case "configmap":
+		return state.NewConfigMapStore(clientset, stateNamespace, stateConfigMap)
+	case "file":
+		return state.NewFileStore(stateFile)
+	default:
+		return nil, fmt.Errorf("Unknown state store '%s'", stateStore)
 	}
 }
@@ -8,20 +8,28 @@ import (
 	"time"
 
 	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
 type mockECRClient struct {
 	ecriface.ECRAPI
 }
 
-func (m *mockECRClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+func (m *mockECRClient) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
 	var output ecr.BatchGetImageOutput
 	for _, imageID := range input.ImageIds {
 		output.Images = append(output.Images, &ecr.Image{
@@ -60,7 +68,7 @@ func (m *mockECRClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.Batch
 	return &output, nil
 }
 
-func (m *mockECRClient) PutImage(input *ecr.PutImageInput) (*ecr.PutImageOutput, error) {
+func (m *mockECRClient) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
 	output := ecr.PutImageOutput{
 		Image: &ecr.Image{
 			ImageId: &ecr.ImageIdentifier{
@@ -150,7 +158,15 @@ func TestTaggingPodImages(t *testing.T) {
 				},
 			}
 			go func(ctx context.Context) {
-				err := findAndTagImages(ctx, client, ecrClient, test.tag, "", test.namespace)
+				podTagger := &tagger{
+					clientset: client,
+					ecrClient: ecrClient,
+					store:     state.NewMemoryStore(),
+					tag:       test.tag,
+					namespace: test.namespace,
+					workers:   1,
+				}
+				err := podTagger.findAndTagImages(ctx)
 				if err != nil {
 					t.Error(err)
 				}
@@ -159,20 +175,20 @@ func TestTaggingPodImages(t *testing.T) {
 			time.Sleep(2 * time.Second)
 
 			pod := definePod(test.namespace, test.name, test.image)
-			_, err := client.CoreV1().Pods(test.namespace).Create(pod)
+			_, err := client.CoreV1().Pods(test.namespace).Create(ctx, pod, metav1.CreateOptions{})
 			if err != nil {
 				t.Errorf("error creating pod: %v", err)
 			}
 			// add label to pod
 			pod.ObjectMeta.Labels = make(map[string]string)
 			pod.ObjectMeta.Labels["test"] = "test"
-			_, err = client.CoreV1().Pods(test.namespace).Update(pod)
+			_, err = client.CoreV1().Pods(test.namespace).Update(ctx, pod, metav1.UpdateOptions{})
 			if err != nil {
 				t.Errorf("error updating pod: %v", err)
 			}
 
 			pod = definePodWithInitContainer(test.namespace, test.name+"-init", test.image, test.image)
-			_, err = client.CoreV1().Pods(test.namespace).Create(pod)
+			_, err = client.CoreV1().Pods(test.namespace).Create(ctx, pod, metav1.CreateOptions{})
 			if err != nil {
 				t.Errorf("error creating pod with init container: %v", err)
 			}
@@ -180,7 +196,7 @@ func TestTaggingPodImages(t *testing.T) {
 			// add label to pod
 			pod.ObjectMeta.Labels = make(map[string]string)
 			pod.ObjectMeta.Labels["test"] = "test"
-			_, err = client.CoreV1().Pods(test.namespace).Update(pod)
+			_, err = client.CoreV1().Pods(test.namespace).Update(ctx, pod, metav1.UpdateOptions{})
 			if err != nil {
 				t.Errorf("error updating pod with init container: %v", err)
 			}
@@ -234,7 +250,15 @@ func TestPrefixTaggingPodImages(t *testing.T) {
 				},
 			}
 			go func(ctx context.Context) {
-				err := findAndTagImages(ctx, client, ecrClient, "", test.tagPrefix, test.namespace)
+				podTagger := &tagger{
+					clientset: client,
+					ecrClient: ecrClient,
+					store:     state.NewMemoryStore(),
+					tagPrefix: test.tagPrefix,
+					namespace: test.namespace,
+					workers:   1,
+				}
+				err := podTagger.findAndTagImages(ctx)
 				if err != nil {
 					t.Error(err)
 				}
@@ -243,20 +267,20 @@ func TestPrefixTaggingPodImages(t *testing.T) {
 			time.Sleep(2 * time.Second)
 
 			pod := definePod(test.namespace, test.name, test.image)
-			_, err := client.CoreV1().Pods(test.namespace).Create(pod)
+			_, err := client.CoreV1().Pods(test.namespace).Create(ctx, pod, metav1.CreateOptions{})
 			if err != nil {
 				t.Errorf("error creating pod: %v", err)
 			}
 			// add label to pod
 			pod.ObjectMeta.Labels = make(map[string]string)
 			pod.ObjectMeta.Labels["test"] = "test"
-			_, err = client.CoreV1().Pods(test.namespace).Update(pod)
+			_, err = client.CoreV1().Pods(test.namespace).Update(ctx, pod, metav1.UpdateOptions{})
 			if err != nil {
 				t.Errorf("error updating pod: %v", err)
 			}
 
 			pod = definePodWithInitContainer(test.namespace, test.name+"-init", test.image, test.image)
-			_, err = client.CoreV1().Pods(test.namespace).Create(pod)
+			_, err = client.CoreV1().Pods(test.namespace).Create(ctx, pod, metav1.CreateOptions{})
 			if err != nil {
 				t.Errorf("error creating pod with init container: %v", err)
 			}
@@ -264,7 +288,7 @@ func TestPrefixTaggingPodImages(t *testing.T) {
 			// add label to pod
 			pod.ObjectMeta.Labels = make(map[string]string)
 			pod.ObjectMeta.Labels["test"] = "test"
-			_, err = client.CoreV1().Pods(test.namespace).Update(pod)
+			_, err = client.CoreV1().Pods(test.namespace).Update(ctx, pod, metav1.UpdateOptions{})
 			if err != nil {
 				t.Errorf("error updating pod with init container: %v", err)
 			}
@@ -273,3 +297,150 @@ func TestPrefixTaggingPodImages(t *testing.T) {
 		})
 	}
 }
+
+type flushRecordingStore struct {
+	*state.MemoryStore
+	flushed bool
+}
+
+func (s *flushRecordingStore) Flush() error {
+	s.flushed = true
+	return nil
+}
+
+// blockingECRClient is a describingECRClient whose DescribeImages calls block until they are released
+type blockingECRClient struct {
+	describingECRClient
+	describing chan struct{}
+	release    chan struct{}
+}
+
+func (m *blockingECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	close(m.describing)
+	<-m.release
+	return m.describingECRClient.DescribeImagesWithContext(ctx, input)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	mockSession := session.Must(session.NewSession(&aws.Config{
+		DisableSSL: aws.Bool(true),
+		Endpoint:   aws.String(server.URL),
+		Region:     aws.String("eu-central-1"),
+	}))
+
+	var tests = []struct {
+		description string
+		pods        []runtime.Object
+	}{
+		{"no pods", nil},
+		{"pod being processed", []runtime.Object{definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			store := &flushRecordingStore{MemoryStore: state.NewMemoryStore()}
+			ecrClient := &blockingECRClient{
+				describingECRClient: describingECRClient{mockECRClient{ecr.New(mockSession)}},
+				describing:          make(chan struct{}),
+				release:             make(chan struct{}),
+			}
+			podTagger := &tagger{
+				clientset:       fake.NewSimpleClientset(test.pods...),
+				ecrClient:       &registry.Client{ECRAPI: ecrClient},
+				store:           store,
+				tagPrefix:       "deployed",
+				namespace:       "default",
+				workers:         2,
+				shutdownTimeout: 3 * time.Second,
+			}
+			errs := make(chan error)
+			go func() {
+				errs <- podTagger.findAndTagImages(ctx)
+			}()
+
+			if len(test.pods) > 0 {
+				select {
+				case <-ecrClient.describing:
+				case <-time.After(5 * time.Second):
+					t.Fatal("Expected the Pod's image to be looked up")
+				}
+				// The Pod is still being processed when the tagger shuts down
+				cancel()
+				time.Sleep(500 * time.Millisecond)
+				close(ecrClient.release)
+			} else {
+				time.Sleep(time.Second)
+				cancel()
+			}
+			select {
+			case err := <-errs:
+				if err != nil {
+					t.Error(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected tagger to shut down")
+			}
+			if !store.flushed {
+				t.Error("Expected state store to be flushed on shutdown")
+			}
+			if len(test.pods) == 0 {
+				return
+			}
+			record, ok := store.Get(state.Key("123456789012", "test-image", "", "latest"))
+			if !ok {
+				t.Fatal("Expected the tag of the Pod being processed to be recorded")
+			}
+			if _, ok := record.TagWithPrefix("deployed"); !ok {
+				t.Errorf("Expected the image to be tagged with a tag that starts with 'deployed', but got %v instead", record.Tags)
+			}
+		})
+	}
+}
+
+// deniedECRClient is a mockECRClient on which looking up images is denied
+type deniedECRClient struct {
+	mockECRClient
+}
+
+func (m *deniedECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "denied", nil)
+}
+
+func TestLastSuccessfulSync(t *testing.T) {
+	var tests = []struct {
+		description string
+		ecrClient   ecriface.ECRAPI
+		synced      bool
+	}{
+		{"tagged", &describingECRClient{}, true},
+		{"lookup failed", &deniedECRClient{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			metrics.LastSuccessfulSync.Set(0)
+			podTagger := &tagger{
+				clientset: fake.NewSimpleClientset(),
+				ecrClient: &registry.Client{ECRAPI: test.ecrClient},
+				store:     state.NewMemoryStore(),
+				tag:       "production",
+			}
+			queue := workqueue.New()
+			defer queue.ShutDown()
+			queue.Add("default/pod")
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			if err := indexer.Add(definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest")); err != nil {
+				t.Fatal(err)
+			}
+			podTagger.processNextPod(context.Background(), queue, indexer)
+			if synced := testutil.ToFloat64(metrics.LastSuccessfulSync) > 0; synced != test.synced {
+				t.Errorf("Expected the last successful sync to be set: %t, but got %t instead", test.synced, synced)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	scanThresholds    map[string]string
+	scanRequire       bool
+	scanQuarantineTag string
+)
+
+func init() {
+	// Both the tagger and the admission webhook tag images
+	for _, flags := range []*pflag.FlagSet{rootCmd.Flags(), webhookCmd.Flags()} {
+		flags.StringToStringVar(&scanThresholds, "scan-threshold", nil, "Maximum number of scan findings of a severity an image may have to be tagged, given as SEVERITY=COUNT, e.g. CRITICAL=0. Can be given multiple times. Scan findings are not checked if it is not given")
+		flags.BoolVar(&scanRequire, "scan-require", false, "Only tag images whose image scan is complete")
+		flags.StringVar(&scanQuarantineTag, "scan-quarantine-tag", "", "Tag added instead of the protection tag to images whose scan findings exceed the thresholds. If left empty, such images are not tagged")
+	}
+}
+
+// scanPolicy is the policy checking the scan findings of images before they are tagged
+type scanPolicy struct {
+	registry.ScanPolicy
+	// quarantineTag is added to the images violating the policy, if set
+	quarantineTag string
+}
+
+// newScanPolicy returns the scan policy configured by the --scan-* flags, or nil if no threshold is given
+func newScanPolicy() (*scanPolicy, error) {
+	if len(scanThresholds) == 0 {
+		if scanRequire || scanQuarantineTag != "" {
+			return nil, fmt.Errorf("--scan-require and --scan-quarantine-tag require at least one --scan-threshold")
+		}
+		return nil, nil
+	}
+	thresholds, err := registry.ParseScanThresholds(scanThresholds)
+	if err != nil {
+		return nil, err
+	}
+	// A quarantine tag starting with the prefix of the protection tags would protect the images it quarantines
+	for _, protection := range []string{tag, tagPrefix} {
+		if scanQuarantineTag != "" && protection != "" && strings.HasPrefix(scanQuarantineTag, protection) {
+			return nil, fmt.Errorf("Quarantine tag '%s' cannot start with '%s'", scanQuarantineTag, protection)
+		}
+	}
+	policy := &scanPolicy{
+		ScanPolicy:    registry.ScanPolicy{Thresholds: thresholds, RequireScan: scanRequire},
+		quarantineTag: scanQuarantineTag,
+	}
+	return policy, nil
+}
+
+// checkScanFindings checks the scan findings of the given ECR images of a Pod against the scan policy.
+// It returns the images that may be tagged, the images violating the policy that are to be quarantined
+// and whether the findings of all images could be checked, and adds the keys of the images violating the policy that are not quarantined to blocked.
+// Images of other registries, which cannot be scanned by ECR, may always be tagged
+func (t *tagger) checkScanFindings(ctx context.Context, pod *corev1.Pod, podLog *log.Entry, images []*ecr.Image, podImages map[string]podImage, blocked map[string]bool) (allowed, quarantined []*ecr.Image, checked bool) {
+	if t.scanPolicy == nil {
+		return images, nil, true
+	}
+	checked = true
+	for _, image := range images {
+		if !t.ecrClient.Owns(*image.RegistryId) {
+			allowed = append(allowed, image)
+			continue
+		}
+		podImage := podImages[registry.FormatImageName(image)]
+		scan, err := t.ecrClient.GetScanFindings(ctx, image)
+		if aborted(err) {
+			checked = false
+			continue
+		}
+		if err != nil {
+			checked = false
+			podImage.log.WithError(err).WithField("code", registry.ErrorCode(err)).Error("Could not get image scan findings")
+			metrics.ImagesSkipped.WithLabelValues(metrics.SkippedLookupFailed).Inc()
+			t.recordEvent(pod, corev1.EventTypeWarning, eventReasonImageTagFailed,
+				"Could not get scan findings of image %s of container %s: %s", podImage.reference(), podImage.container, errorCode(err))
+			continue
+		}
+		violation, ok := t.scanPolicy.Violation(scan)
+		if !ok {
+			allowed = append(allowed, image)
+			continue
+		}
+		metrics.ImagesSkipped.WithLabelValues(metrics.SkippedScanFindings).Inc()
+		if t.scanPolicy.quarantineTag != "" && containsString(podImage.tags, t.scanPolicy.quarantineTag) {
+			podImage.log.Debugf("Image was already quarantined with tag '%s'", t.scanPolicy.quarantineTag)
+			continue
+		}
+		if t.scanPolicy.quarantineTag != "" {
+			quarantined = append(quarantined, image)
+		} else {
+			blocked[podImage.key] = true
+		}
+		// Blocked images are checked every time the Pod is processed, they are only reported once
+		if t.blocked.has(pod.Namespace+"/"+pod.Name, podImage.key) {
+			podImage.log.WithField("violation", violation).Debug("Image scan findings still exceed the thresholds")
+			continue
+		}
+		podImage.log.WithField("violation", violation).Warn("Image scan findings exceed the thresholds")
+		t.recordEvent(pod, corev1.EventTypeWarning, eventReasonScanBlocked,
+			"Image %s of container %s was not tagged: %s", podImage.reference(), podImage.container, violation)
+	}
+	podLog.Debugf("%d of %d images passed the scan findings check", len(allowed), len(images))
+	return allowed, quarantined, checked
+}
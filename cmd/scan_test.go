@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// scanningECRClient is a mockECRClient on which images tagged "vulnerable" have critical findings
+type scanningECRClient struct {
+	mockECRClient
+	tags []string
+}
+
+func (m *scanningECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	var output ecr.DescribeImagesOutput
+	for _, imageID := range input.ImageIds {
+		output.ImageDetails = append(output.ImageDetails, &ecr.ImageDetail{
+			ImageTags: aws.StringSlice(append([]string{aws.StringValue(imageID.ImageTag)}, m.tags...)),
+		})
+	}
+	return &output, nil
+}
+
+func (m *scanningECRClient) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	m.tags = append(m.tags, aws.StringValue(input.ImageTag))
+	return m.mockECRClient.PutImageWithContext(ctx, input)
+}
+
+func (m *scanningECRClient) DescribeImageScanFindingsWithContext(ctx aws.Context, input *ecr.DescribeImageScanFindingsInput, opts ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error) {
+	counts := map[string]*int64{ecr.FindingSeverityHigh: aws.Int64(3)}
+	if aws.StringValue(input.ImageId.ImageTag) == "vulnerable" {
+		counts[ecr.FindingSeverityCritical] = aws.Int64(2)
+	}
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageId:           input.ImageId,
+		ImageScanStatus:   &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+		ImageScanFindings: &ecr.ImageScanFindings{FindingSeverityCounts: counts},
+	}, nil
+}
+
+func TestScanFindings(t *testing.T) {
+	policy := registry.ScanPolicy{Thresholds: map[string]int64{ecr.FindingSeverityCritical: 0}}
+
+	var tests = []struct {
+		description   string
+		image         string
+		quarantineTag string
+		expectedTags  []string
+		expectedEvent string
+	}{
+		{"clean image", "clean", "", []string{"production"}, "Normal ImageTagged"},
+		{"vulnerable image", "vulnerable", "", nil, "Warning ImageScanBlocked Image test-image:vulnerable of container app was not tagged: 2 CRITICAL findings exceed the threshold of 0"},
+		{"quarantined image", "vulnerable", "quarantine", []string{"quarantine"}, "Warning ImageScanBlocked"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ecrClient := &scanningECRClient{}
+			recorder := record.NewFakeRecorder(10)
+			podTagger := &tagger{
+				clientset:   fake.NewSimpleClientset(),
+				ecrClient:   &registry.Client{ECRAPI: ecrClient},
+				store:       state.NewMemoryStore(),
+				recorder:    recorder,
+				eventTarget: eventTargetPod,
+				scanPolicy:  &scanPolicy{ScanPolicy: policy, quarantineTag: test.quarantineTag},
+			}
+
+			pod := definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:"+test.image)
+			pod.Spec.Containers[0].Name = "app"
+			podTagger.tagPodImages(context.Background(), "production", "production", pod)
+			// Quarantined images are not tagged again
+			podTagger.tagPodImages(context.Background(), "production", "production", pod)
+
+			if strings.Join(ecrClient.tags, ",") != strings.Join(test.expectedTags, ",") {
+				t.Errorf("Expected tags '%v', but got '%v' instead", test.expectedTags, ecrClient.tags)
+			}
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, test.expectedEvent) {
+					t.Errorf("Expected event to start with '%s', but got '%s' instead", test.expectedEvent, event)
+				}
+			default:
+				t.Error("Expected an event to be recorded")
+			}
+			// Images blocked when the Pod was last processed are not reported again
+			for len(recorder.Events) > 0 {
+				if event := <-recorder.Events; strings.Contains(event, eventReasonScanBlocked) {
+					t.Errorf("Expected a single %s event, but got '%s' again", eventReasonScanBlocked, event)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/health"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	httpAddress          string
+	readinessECRWindow   time.Duration
+	livenessStallTimeout time.Duration
+)
+
+func init() {
+	rootCmd.Flags().StringVar(&httpAddress, "http-address", ":8080", "Address on which the HTTP server exposing /metrics, /healthz and /readyz listens. Set to an empty string to disable it")
+	rootCmd.Flags().DurationVar(&readinessECRWindow, "readiness-ecr-window", 5*time.Minute, "How recent the last successful ECR API call must be for /readyz to succeed without calling ECR")
+	rootCmd.Flags().DurationVar(&livenessStallTimeout, "liveness-stall-timeout", 5*time.Minute, "How long a worker can spend on a single Pod before /healthz fails")
+}
+
+// newServeMux returns the handler of the HTTP server
+func newServeMux(checker *health.Checker) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", checker.LivenessHandler())
+	mux.Handle("/readyz", checker.ReadinessHandler())
+	return mux
+}
+
+// serveHTTP starts the HTTP server in the background, unless it is disabled
+func serveHTTP(checker *health.Checker) {
+	if httpAddress == "" {
+		return
+	}
+	server := &http.Server{
+		Addr:    httpAddress,
+		Handler: newServeMux(checker),
+	}
+	go func() {
+		log.Infof("Serving HTTP on '%s'", httpAddress)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
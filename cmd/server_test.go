@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	metrics.ImagesDiscovered.Inc()
+	metrics.ImagesSkipped.WithLabelValues(metrics.SkippedNotECR).Inc()
+	metrics.APICallDuration.WithLabelValues("PutImage").Observe(0.1)
+
+	server := httptest.NewServer(newServeMux(nil))
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"kube_ecr_tagger_images_discovered_total",
+		`kube_ecr_tagger_images_skipped_total{reason="not-ecr"}`,
+		`kube_ecr_tagger_ecr_api_call_duration_seconds_bucket{operation="PutImage"`,
+		"kube_ecr_tagger_queue_depth",
+		"kube_ecr_tagger_last_successful_sync_timestamp_seconds",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("Expected metrics to contain '%s'", name)
+		}
+	}
+}
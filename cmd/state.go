@@ -0,0 +1,65 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// recordPrunePeriod is how often the records of images that are no longer in use are pruned from the state store
+const recordPrunePeriod = time.Hour
+
+// pruneRecords removes from the state store the records of the images that are not used by the given Pods
+// and were last used longer than the retention period ago. With tagging policies, the records of images that
+// still carry a tag added by the tagger are kept for the cleanup rules of the policies
+func (t *tagger) pruneRecords(ctx context.Context, pods []interface{}, now time.Time) {
+	inUse := make(map[string]bool)
+	for _, obj := range pods {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+		keys, tagKeys := t.podImageKeys(ctx, pod)
+		for _, key := range append(keys, tagKeys...) {
+			inUse[key] = true
+		}
+	}
+	// Images whose names could not be parsed because the context is done would be taken for unused
+	if ctx.Err() != nil {
+		return
+	}
+	pruned := 0
+	for key, record := range t.store.List() {
+		if recordInUse(key, record, inUse) || now.Sub(record.LastUsed()) <= t.recordRetention {
+			continue
+		}
+		if t.taggingPolicies && !record.TaggedAt.IsZero() {
+			continue
+		}
+		if err := t.store.Delete(key); err != nil {
+			log.WithError(err).WithField("key", key).Error("Could not prune state of image")
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Infof("Pruned the state of %d images that are no longer in use", pruned)
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecordTTL(t *testing.T) {
+	var tests = []struct {
+		description string
+		checkedAt   time.Time
+		expected    int
+	}{
+		{"fresh record", time.Now(), 0},
+		{"expired record", time.Now().Add(-2 * time.Hour), 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			store := state.NewMemoryStore()
+			_ = store.Put(state.Key("123456789012", "test-image", "", "latest"), &state.Record{
+				Registry:   "123456789012",
+				Repository: "test-image",
+				Tags:       []string{"latest", "production1599999999"},
+				CheckedAt:  test.checkedAt,
+			})
+			// The image no longer exists on ECR, which is only noticed once its record is verified again
+			podTagger := &tagger{
+				clientset:   fake.NewSimpleClientset(),
+				ecrClient:   &registry.Client{ECRAPI: &missingECRClient{}},
+				store:       store,
+				recorder:    recorder,
+				eventTarget: eventTargetPod,
+				recordTTL:   time.Hour,
+			}
+			pod := definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest")
+
+			podTagger.tagPodImages(context.Background(), "production", "production", pod)
+
+			if len(recorder.Events) != test.expected {
+				t.Errorf("Expected %d events to be recorded, but got %d instead", test.expected, len(recorder.Events))
+			}
+		})
+	}
+}
+
+func TestPruneRecords(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	old := now.Add(-48 * time.Hour)
+	var tests = []struct {
+		description     string
+		repository      string
+		lastUsed        time.Time
+		tagged          bool
+		taggingPolicies bool
+		expected        bool
+	}{
+		{"in use", "in-use", old, false, false, true},
+		{"recently used", "unused", now.Add(-time.Hour), false, false, true},
+		{"unused", "unused", old, false, false, false},
+		{"unused but tagged without policies", "unused", old, true, false, false},
+		{"unused but tagged with policies", "unused", old, true, true, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			store := state.NewMemoryStore()
+			key := state.Key("123456789012", test.repository, "", "latest")
+			record := &state.Record{
+				Registry:   "123456789012",
+				Repository: test.repository,
+				Tags:       []string{"latest"},
+				CheckedAt:  test.lastUsed,
+			}
+			if test.tagged {
+				record.TaggedAt = test.lastUsed
+			}
+			_ = store.Put(key, record)
+			podTagger := &tagger{
+				store:           store,
+				taggingPolicies: test.taggingPolicies,
+				recordRetention: 24 * time.Hour,
+			}
+			pod := definePod("default", "pod", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/in-use:latest")
+
+			podTagger.pruneRecords(context.Background(), []interface{}{pod}, now)
+
+			if _, ok := store.Get(key); ok != test.expected {
+				t.Errorf("Expected record to be kept to be %t, but got %t instead", test.expected, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/health"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/policy"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// tagger tags the ECR images used by Pods
+type tagger struct {
+	clientset kubernetes.Interface
+	ecrClient *registry.Client
+	store     state.Store
+	health    *health.Checker
+	tag       string
+	tagPrefix string
+	namespace string
+	workers   int
+
+	// registries tag the images of ECR and of other registries. Only ECR is used when it is nil
+	registries registry.Registry
+
+	// recorder records Events about tagged images on eventTarget, Events are not recorded when it is nil
+	recorder    record.EventRecorder
+	eventTarget string
+	// annotateOwners enables annotating the workloads managing Pods with the tags that protect their images
+	annotateOwners bool
+	// annotated caches the tags annotation of workloads, by UID of the controller of their Pods
+	annotatedMu sync.Mutex
+	annotated   map[types.UID]*annotatedWorkload
+
+	dynamicClient dynamic.Interface
+
+	taggingPolicies       bool
+	policies              *policy.Set
+	policyReconcilePeriod time.Duration
+
+	imageResources      bool
+	imageResourcePeriod time.Duration
+	// missing tracks the images used by Pods that are missing from ECR
+	missing missingImages
+	// blocked tracks the images used by Pods whose scan findings exceed the thresholds of the scan policy
+	blocked trackedImages
+	// scanPolicy keeps images whose scan findings exceed its thresholds from being tagged, all images are tagged if it is nil
+	scanPolicy *scanPolicy
+	// recordTTL is how long the records of tagged images are trusted, they are trusted forever if it is zero
+	recordTTL time.Duration
+	// recordRetention is how long the records of images that are no longer in use are kept, forever if it is zero
+	recordRetention time.Duration
+	// shutdownTimeout is how long in-flight Pods are waited for once the context is done
+	shutdownTimeout time.Duration
+}
+
+// findAndTagImages watches Pods and tags their images until the given context is done.
+// It then waits for the Pods being processed and flushes the state store
+func (t *tagger) findAndTagImages(ctx context.Context) error {
+	// create the shared informer and resync every 5s
+	defaultResyncPeriod := 5 * time.Second
+	factory := informers.NewSharedInformerFactoryWithOptions(t.clientset, defaultResyncPeriod, informers.WithNamespace(t.namespace))
+	informer := factory.Core().V1().Pods().Informer()
+	// Pods are processed by workers in the order in which their events arrive
+	queue := workqueue.NewNamed("kube-ecr-tagger")
+	defer queue.ShutDown()
+	defer runtime.HandleCrash()
+
+	enqueue := func(obj interface{}) {
+		key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			runtime.HandleError(err)
+			return
+		}
+		queue.Add(key)
+		metrics.QueueDepth.Set(float64(queue.Len()))
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(new interface{}, old interface{}) {
+			enqueue(new)
+		},
+		// Deleted Pods are processed to forget their missing images
+		DeleteFunc: enqueue,
+	})
+	go informer.Run(ctx.Done())
+	synced := []cache.InformerSynced{informer.HasSynced}
+	if t.taggingPolicies {
+		synced = append(synced, t.watchPolicies(ctx)...)
+	}
+	if !cache.WaitForNamedCacheSync("kube-ecr-tagger", ctx.Done(), synced...) {
+		err := fmt.Errorf("Timed out waiting for caches to sync")
+		runtime.HandleError(err)
+		return err
+	}
+	t.health.SetSynced(true)
+	defer t.health.SetSynced(false)
+	if t.taggingPolicies {
+		go wait.Until(func() {
+			t.reconcilePolicies(ctx, informer.GetIndexer().List())
+		}, t.policyReconcilePeriod, ctx.Done())
+	}
+	if t.imageResources {
+		go wait.Until(func() {
+			t.syncImageResources(ctx, informer.GetIndexer().List())
+		}, t.imageResourcePeriod, ctx.Done())
+	}
+	if t.recordRetention > 0 {
+		go wait.Until(func() {
+			t.pruneRecords(ctx, informer.GetIndexer().List(), time.Now())
+		}, recordPrunePeriod, ctx.Done())
+	}
+	// The workers' calls are not aborted on shutdown until the shutdown timeout expires,
+	// so that the Pods they are processing can still be tagged
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
+	var workers sync.WaitGroup
+	for i := 0; i < t.workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			wait.Until(func() {
+				for t.processNextPod(workCtx, queue, informer.GetIndexer()) {
+				}
+			}, time.Second, ctx.Done())
+		}()
+	}
+	<-ctx.Done()
+
+	// Stop accepting new Pods and give the workers some time to finish the ones they are processing.
+	// Their calls are aborted once the timeout expires
+	log.Info("Shutting down, waiting for in-flight Pods to be processed")
+	queue.ShutDown()
+	drained := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(t.shutdownTimeout):
+		log.Warnf("Timed out after %s waiting for in-flight Pods to be processed", t.shutdownTimeout)
+		cancelWork()
+	}
+	return t.store.Flush()
+}
+
+// processNextPod tags the images of the next Pod in the queue.
+// It returns false once the queue is shut down
+func (t *tagger) processNextPod(ctx context.Context, queue workqueue.Interface, indexer cache.Indexer) bool {
+	key, quit := queue.Get()
+	if quit {
+		return false
+	}
+	defer queue.Done(key)
+	if queue.ShuttingDown() {
+		// The tagger is shutting down, Pods left in the queue are dropped
+		return false
+	}
+	defer t.health.StartWork()()
+	metrics.QueueDepth.Set(float64(queue.Len()))
+
+	obj, exists, err := indexer.GetByKey(key.(string))
+	if err != nil {
+		runtime.HandleError(err)
+		return true
+	}
+	if !exists {
+		// The Pod was deleted in the meantime
+		t.missing.set(key.(string), nil)
+		t.blocked.set(key.(string), nil)
+		return true
+	}
+	tag, tagPrefix, err := t.podTag(obj)
+	if err != nil {
+		log.WithError(err).WithField("pod", key).Error("Could not determine tag of Pod's images")
+		return true
+	}
+	if t.tagPodImages(ctx, tag, tagPrefix, obj) {
+		metrics.LastSuccessfulSync.SetToCurrentTime()
+	}
+	return true
+}
+
+// imageRegistry returns the registry used to tag images
+func (t *tagger) imageRegistry() registry.Registry {
+	if t.registries != nil {
+		return t.registries
+	}
+	return t.ecrClient
+}
+
+// nextTag returns the tag to add to images and the prefix of the tags that make adding it unnecessary
+func (t *tagger) nextTag() (tag, tagPrefix string) {
+	if t.tag == "" {
+		return t.tagPrefix + strconv.FormatInt(time.Now().Unix(), 10), t.tagPrefix
+	}
+	return t.tag, t.tag
+}
+
+// podImage is an image from ECR used by one of a Pod's containers
+type podImage struct {
+	container string
+	image     *ecr.Image
+	digest    string
+	// key is the key under which the image's record is kept in the state store
+	key string
+	// tags are the tags of the image on ECR, once they were looked up
+	tags []string
+	log  *log.Entry
+}
+
+// tagPodImages tags the images from ECR used by the given Pod.
+// It reports whether all of them could be looked up and tagged, images missing from ECR are not failures
+func (t *tagger) tagPodImages(ctx context.Context, tag, tagPrefix string, obj interface{}) bool {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return true
+	}
+	podLog := log.WithFields(log.Fields{"namespace": pod.Namespace, "pod": pod.Name})
+	podKey := pod.Namespace + "/" + pod.Name
+	// protections maps the name of each container to the tag that protects its image
+	protections := make(map[string]string)
+	// missing holds the keys of the images that are missing from ECR
+	missing := make(map[string]bool)
+	// blocked holds the keys of the images whose scan findings exceed the thresholds
+	blocked := make(map[string]bool)
+	defer func() {
+		t.missing.set(podKey, missing)
+		t.blocked.set(podKey, blocked)
+		if err := t.annotateOwner(pod, protections); err != nil {
+			podLog.WithError(err).Warn("Could not annotate owner of Pod")
+		}
+	}()
+	podLog.Debug("Getting images from Pod's containers")
+	digests := imageDigests(pod)
+	// repositories holds the repositories of the Pod's images, which are tagged once per Pod
+	repositories := make(map[string]bool)
+	var ecrImages []podImage
+	// Get from init containers all images that are from ECR
+	for _, container := range pod.Spec.InitContainers {
+		image, err := t.imageRegistry().ParseImageName(ctx, imageRewrites.Rewrite(container.Image))
+		if err != nil {
+			podLog.WithField("container", container.Name).Debug(err)
+			metrics.ImagesSkipped.WithLabelValues(metrics.SkippedNotECR).Inc()
+			continue
+		}
+		metrics.ImagesDiscovered.Inc()
+		t.tagRepository(ctx, podLog, image, repositories)
+		ecrImages = append(ecrImages, newPodImage(podLog, container.Name, image, digests[container.Name]))
+	}
+	// Get from containers all images that are from ECR
+	// and whose current Tag does not start with tagPrefix
+	for _, container := range pod.Spec.Containers {
+		image, err := t.imageRegistry().ParseImageName(ctx, imageRewrites.Rewrite(container.Image))
+		if err != nil {
+			podLog.WithField("container", container.Name).Debug(err)
+			metrics.ImagesSkipped.WithLabelValues(metrics.SkippedNotECR).Inc()
+			continue
+		}
+		metrics.ImagesDiscovered.Inc()
+		t.tagRepository(ctx, podLog, image, repositories)
+		podImage := newPodImage(podLog, container.Name, image, digests[container.Name])
+		if strings.HasPrefix(*image.ImageId.ImageTag, tagPrefix) {
+			podImage.log.Debugf("Image current Tag already starts with '%s'", tagPrefix)
+			metrics.ImagesSkipped.WithLabelValues(metrics.SkippedCurrentTag).Inc()
+			protections[container.Name] = *image.ImageId.ImageTag
+			continue
+		}
+		ecrImages = append(ecrImages, podImage)
+	}
+	if len(ecrImages) == 0 {
+		podLog.Debug("No ECR images are used in this Pod")
+		return true
+	}
+	succeeded := true
+	// Skip all images that have a least one Tag that starts with tagPrefix
+	var imagesToTag []*ecr.Image
+	podImages := make(map[string]podImage)
+SkipOuterLoop:
+	for _, podImage := range ecrImages {
+		image := podImage.image
+		// Expired records are verified by looking up the image's tags on ECR again
+		if record, ok := t.store.Get(podImage.key); ok && (t.recordTTL == 0 || time.Since(record.CheckedAt) < t.recordTTL) {
+			if recordedTag, ok := record.TagWithPrefix(tagPrefix); ok {
+				podImage.log.Debugf("Image was already tagged with a Tag that starts with '%s'", tagPrefix)
+				metrics.ImagesSkipped.WithLabelValues(metrics.SkippedRecorded).Inc()
+				protections[podImage.container] = recordedTag
+				continue
+			}
+		}
+		imageTags, err := t.imageRegistry().GetImageTags(ctx, image)
+		if err != nil {
+			if aborted(err) {
+				succeeded = false
+				continue
+			}
+			errLog := podImage.log.WithError(err).WithField("code", registry.ErrorCode(err))
+			switch {
+			case errors.Is(err, registry.ErrImageNotFound), errors.Is(err, registry.ErrRepositoryNotFound):
+				errLog.Warn("Image does not exist on ECR")
+				metrics.ImagesSkipped.WithLabelValues(metrics.SkippedImageNotFound).Inc()
+				// The Event is only recorded when the image goes missing, not every time the Pod is processed
+				if !t.missing.has(podKey, podImage.key) {
+					t.recordEvent(pod, corev1.EventTypeWarning, eventReasonImageMissing,
+						"Image %s of container %s is missing from ECR: %s, the Pod will fail to start when rescheduled",
+						podImage.reference(), podImage.container, errorCode(err))
+				}
+				missing[podImage.key] = true
+				// The record of an image deleted from ECR after it was tagged no longer holds
+				if _, ok := t.store.Get(podImage.key); ok {
+					if err := t.store.Delete(podImage.key); err != nil {
+						errLog.WithError(err).Error("Could not remove state of missing image")
+					}
+				}
+				continue
+			case errors.Is(err, registry.ErrAccessDenied):
+				errLog.Error("Access denied while getting image tags")
+				metrics.ImagesSkipped.WithLabelValues(metrics.SkippedLookupFailed).Inc()
+			default:
+				errLog.Error("Could not get image tags")
+				metrics.ImagesSkipped.WithLabelValues(metrics.SkippedLookupFailed).Inc()
+			}
+			t.recordEvent(pod, corev1.EventTypeWarning, eventReasonImageTagFailed,
+				"Could not look up image %s of container %s: %s", podImage.reference(), podImage.container, errorCode(err))
+			succeeded = false
+			continue
+		}
+		for _, tag := range imageTags {
+			if strings.HasPrefix(*tag, tagPrefix) {
+				podImage.log.Debugf("Image already has a Tag that starts with '%s'", tagPrefix)
+				t.saveRecord(podImage, aws.StringValueSlice(imageTags), time.Time{}, "")
+				metrics.ImagesSkipped.WithLabelValues(metrics.SkippedHasTag).Inc()
+				protections[podImage.container] = *tag
+				continue SkipOuterLoop
+			}
+		}
+		podImage.tags = aws.StringValueSlice(imageTags)
+		imagesToTag = append(imagesToTag, image)
+		podImages[registry.FormatImageName(image)] = podImage
+	}
+	imagesToTag, imagesToQuarantine, checked := t.checkScanFindings(ctx, pod, podLog, imagesToTag, podImages, blocked)
+	succeeded = checked && succeeded
+	succeeded = t.tagImages(ctx, pod, podLog, imagesToTag, tag, podImages, protections) && succeeded
+	if len(imagesToQuarantine) > 0 {
+		succeeded = t.tagImages(ctx, pod, podLog, imagesToQuarantine, t.scanPolicy.quarantineTag, podImages, nil) && succeeded
+	}
+	return succeeded
+}
+
+// tagImages adds the given tag to the given images of a Pod. The tag protects the images unless protections is nil,
+// in which case it is the quarantine tag of images whose scan findings exceed the thresholds.
+// It reports whether all images could be tagged
+func (t *tagger) tagImages(ctx context.Context, pod *corev1.Pod, podLog *log.Entry, imagesToTag []*ecr.Image, tag string, podImages map[string]podImage, protections map[string]string) bool {
+	// Get the images' manifests from ECR
+	// The manifests are needed in order to add a new Tag to existing images
+	podLog.Debug("Getting images' manifests from ECR")
+	imagesInformation, err := t.imageRegistry().GetImagesInformation(ctx, imagesToTag)
+	if aborted(err) {
+		return false
+	}
+	if err != nil {
+		podLog.WithError(err).Error("Could not get images' manifests")
+		metrics.ImagesSkipped.WithLabelValues(metrics.SkippedManifestFailed).Add(float64(len(imagesToTag)))
+		return false
+	}
+	metrics.ImagesSkipped.WithLabelValues(metrics.SkippedManifestFailed).Add(float64(len(imagesToTag) - len(imagesInformation)))
+	succeeded := len(imagesInformation) == len(imagesToTag)
+	// Add the given tag to all images
+	podLog.Debugf("Tagging images' on ECR with tag '%s'", tag)
+	for _, result := range t.imageRegistry().TagImages(ctx, imagesInformation, tag) {
+		podImage, ok := podImages[registry.FormatImageName(result.Image)]
+		if !ok {
+			continue
+		}
+		podImage.image = result.Image
+		if result.Image.ImageId.ImageDigest != nil {
+			podImage.digest = *result.Image.ImageId.ImageDigest
+			podImage.log = podImage.log.WithField("digest", podImage.digest)
+		}
+		resultLog := podImage.log.WithField("newTag", result.Tag)
+		switch result.Status {
+		case registry.TagStatusTagged:
+			if protections == nil {
+				resultLog.Warn("Quarantined image")
+				metrics.ImagesQuarantined.Inc()
+				t.recordEvent(pod, corev1.EventTypeWarning, eventReasonQuarantined,
+					"Added quarantine tag %s to image %s of container %s", result.Tag, podImage.reference(), podImage.container)
+				break
+			}
+			resultLog.Info("Tagged image")
+			metrics.ImagesTagged.Inc()
+			t.recordEvent(pod, corev1.EventTypeNormal, eventReasonImageTagged,
+				"Added tag %s to image %s of container %s", result.Tag, podImage.reference(), podImage.container)
+		case registry.TagStatusAlreadyTagged:
+			resultLog.Debug("Image already has tag")
+			metrics.ImagesSkipped.WithLabelValues(metrics.SkippedAlreadyTagged).Inc()
+		case registry.TagStatusFailed:
+			succeeded = false
+			if aborted(result.Err) {
+				continue
+			}
+			resultLog.WithError(result.Err).WithField("code", registry.ErrorCode(result.Err)).Error("Could not tag image")
+			metrics.ImagesFailed.WithLabelValues(errorCode(result.Err)).Inc()
+			t.recordEvent(pod, corev1.EventTypeWarning, eventReasonImageTagFailed,
+				"Could not tag image %s of container %s: %s", podImage.reference(), podImage.container, errorCode(result.Err))
+			continue
+		}
+		if protections == nil {
+			// Quarantine tags are not managed by the tagger, they are recorded as if they had been found on the image
+			t.saveRecord(podImage, []string{result.Tag}, time.Time{}, "")
+			continue
+		}
+		protections[podImage.container] = result.Tag
+		t.saveRecord(podImage, []string{result.Tag}, time.Now(), t.podPolicy(pod))
+	}
+	return succeeded
+}
+
+// tagRepository adds the configured resource tags to the ECR repository of the given image in use,
+// unless the repository is one of the given ones, to which it is added
+func (t *tagger) tagRepository(ctx context.Context, podLog *log.Entry, image *ecr.Image, repositories map[string]bool) {
+	if t.ecrClient == nil || !t.ecrClient.RepositoryTagsEnabled() || !t.ecrClient.Owns(*image.RegistryId) {
+		return
+	}
+	repository := *image.RegistryId + "/" + *image.RepositoryName
+	if repositories[repository] {
+		return
+	}
+	repositories[repository] = true
+	if err := t.ecrClient.TagRepository(ctx, *image.RegistryId, *image.RepositoryName, time.Now()); err != nil {
+		podLog.WithError(err).WithFields(log.Fields{"registry": *image.RegistryId, "repository": *image.RepositoryName}).Warn("Could not tag repository")
+	}
+}
+
+// aborted reports whether err is due to the tagger shutting down, in which case it is neither logged nor reported
+func aborted(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+func newPodImage(podLog *log.Entry, container string, image *ecr.Image, digest string) podImage {
+	fields := log.Fields{
+		"container":  container,
+		"registry":   *image.RegistryId,
+		"repository": *image.RepositoryName,
+		"tag":        *image.ImageId.ImageTag,
+	}
+	if digest != "" {
+		fields["digest"] = digest
+	}
+	return podImage{
+		container: container,
+		image:     image,
+		digest:    digest,
+		key:       state.Key(*image.RegistryId, *image.RepositoryName, digest, *image.ImageId.ImageTag),
+		log:       podLog.WithFields(fields),
+	}
+}
+
+// reference returns the repository and digest of the image, or its tag if the digest is unknown
+func (p podImage) reference() string {
+	if p.digest != "" {
+		return aws.StringValue(p.image.RepositoryName) + "@" + p.digest
+	}
+	return aws.StringValue(p.image.RepositoryName) + ":" + aws.StringValue(p.image.ImageId.ImageTag)
+}
+
+// imageDigests returns the digests of the images run by the Pod's containers, indexed by container name.
+// Containers that did not start yet are left out
+func imageDigests(pod *corev1.Pod) map[string]string {
+	digests := make(map[string]string)
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			// The image ID has the form [docker-pullable://]REPOSITORY@DIGEST
+			if i := strings.LastIndex(status.ImageID, "@"); i >= 0 {
+				digests[status.Name] = status.ImageID[i+1:]
+			}
+		}
+	}
+	return digests
+}
+
+// errorCode returns the AWS error code of the given error to be used as metric label
+func errorCode(err error) string {
+	if code := registry.ErrorCode(err); code != "" {
+		return code
+	}
+	return "Unknown"
+}
+
+// saveRecord adds the given tags to the image's record in the state store.
+// If taggedAt is set, the tags were added by the tagger for the Pod selected by the policy with the given key
+func (t *tagger) saveRecord(podImage podImage, tags []string, taggedAt time.Time, policyKey string) {
+	if podImage.key == "" {
+		return
+	}
+	record := &state.Record{
+		Registry:   aws.StringValue(podImage.image.RegistryId),
+		Repository: aws.StringValue(podImage.image.RepositoryName),
+		Digest:     aws.StringValue(podImage.image.ImageId.ImageDigest),
+		CheckedAt:  time.Now(),
+	}
+	if previous, ok := t.store.Get(podImage.key); ok {
+		record.Tags = append(record.Tags, previous.Tags...)
+		record.TaggedAt = previous.TaggedAt
+		record.Policy = previous.Policy
+	}
+	for _, tag := range tags {
+		if !record.HasTag(tag) {
+			record.Tags = append(record.Tags, tag)
+		}
+	}
+	if !taggedAt.IsZero() {
+		record.TaggedAt = taggedAt
+		record.Policy = policyKey
+	}
+	if err := t.store.Put(podImage.key, record); err != nil {
+		podImage.log.WithError(err).Error("Could not save state of image")
+	}
+}
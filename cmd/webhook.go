@@ -0,0 +1,384 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	webhookAddress  string
+	tlsCertFile     string
+	tlsKeyFile      string
+	rewriteToDigest bool
+	webhookTimeout  time.Duration
+
+	missingImageAction string
+	failurePolicy      string
+)
+
+// Actions taken by the validating webhook on objects using images that do not exist on ECR
+const (
+	missingImageDeny = "deny"
+	missingImageWarn = "warn"
+)
+
+// Answers of the validating webhook when images could not be looked up on ECR
+const (
+	failurePolicyOpen   = "open"
+	failurePolicyClosed = "closed"
+)
+
+// missingImagesAnnotation is the audit annotation listing the images of an admitted object that do not exist on ECR
+const missingImagesAnnotation = "kube-ecr-tagger.io/missing-images"
+
+// webhookCmd represents the webhook command
+var webhookCmd = &cobra.Command{
+	Use:   "webhook",
+	Short: "Runs admission webhooks that tag and validate images from ECR before Pods are created",
+	Long: `A command that serves a mutating admission webhook on /mutate. It adds a given tag or a tag that starts
+with a given prefix to the images from ECR used by admitted Pods and workloads before they are created,
+and can rewrite their tag references to digests.
+It also serves a validating admission webhook on /validate that denies or warns about Pods and workloads
+using images that do not exist on ECR.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		if tag == "" && tagPrefix == "" {
+			log.Fatal("tag and tagPrefix cannot be both empty strings")
+		}
+		if missingImageAction != missingImageDeny && missingImageAction != missingImageWarn {
+			log.Fatalf("Unknown missing image action '%s'", missingImageAction)
+		}
+		if failurePolicy != failurePolicyOpen && failurePolicy != failurePolicyClosed {
+			log.Fatalf("Unknown failure policy '%s'", failurePolicy)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		options, err := ecrOptions()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Reviews must be answered within the timeout of the webhook configurations, ECR calls are not retried
+		options.MaxRetries = 0
+		ecrClient, err := registry.NewClient(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientset, err := newClientset()
+		if err != nil {
+			log.Fatal(err)
+		}
+		scanPolicy, err := newScanPolicy()
+		if err != nil {
+			log.Fatal(err)
+		}
+		webhook := &admissionWebhook{
+			tagger: &tagger{
+				clientset:  clientset,
+				ecrClient:  ecrClient,
+				store:      state.NewMemoryStore(),
+				tag:        tag,
+				tagPrefix:  tagPrefix,
+				scanPolicy: scanPolicy,
+			},
+			rewriteToDigest: rewriteToDigest,
+			timeout:         webhookTimeout,
+
+			missingImageAction: missingImageAction,
+			failurePolicy:      failurePolicy,
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go cancelOnSignal(cancel)
+
+		serveHTTP(nil)
+		server := &http.Server{
+			Addr:    webhookAddress,
+			Handler: webhook.serveMux(),
+		}
+		go func() {
+			<-ctx.Done()
+			_ = server.Shutdown(context.Background())
+		}()
+		log.Infof("Serving admission webhook on '%s'", webhookAddress)
+		if err := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(webhookCmd)
+	webhookCmd.Flags().StringVar(&tagPrefix, "tag-prefix", "deployed", "Tag prefix that will be used to form the image tag. Defaults to 'deployed'")
+	webhookCmd.Flags().StringVar(&tag, "tag", "", "Image tag. If left empty, tag-prefix will be used to create a tag instead")
+	webhookCmd.Flags().StringVar(&webhookAddress, "webhook-address", ":8443", "Address on which the admission webhook listens")
+	webhookCmd.Flags().StringVar(&tlsCertFile, "tls-cert-file", "/etc/kube-ecr-tagger/tls/tls.crt", "Path of the TLS certificate of the admission webhook")
+	webhookCmd.Flags().StringVar(&tlsKeyFile, "tls-key-file", "/etc/kube-ecr-tagger/tls/tls.key", "Path of the TLS private key of the admission webhook")
+	webhookCmd.Flags().BoolVar(&rewriteToDigest, "rewrite-to-digest", false, "Rewrite the tag references of images from ECR to digest references")
+	webhookCmd.Flags().DurationVar(&webhookTimeout, "webhook-timeout", 5*time.Second, "How long the ECR calls made for an admission review may take. Must be shorter than the timeoutSeconds of the webhook configurations")
+	webhookCmd.Flags().StringVar(&missingImageAction, "missing-image-action", missingImageDeny, "What the validating webhook does with objects using images that do not exist on ECR, one of 'deny' or 'warn'")
+	webhookCmd.Flags().StringVar(&failurePolicy, "failure-policy", failurePolicyOpen, "Whether the validating webhook admits ('open') or denies ('closed') objects whose images could not be looked up on ECR")
+}
+
+// admissionWebhook answers the admission reviews of Pods and workloads
+type admissionWebhook struct {
+	tagger *tagger
+	// rewriteToDigest enables rewriting the tag references of images from ECR to digest references
+	rewriteToDigest bool
+	// timeout bounds the ECR calls made for a single review, they are not bounded if it is zero
+	timeout time.Duration
+	// missingImageAction is what is done with objects using images that do not exist on ECR
+	missingImageAction string
+	// failurePolicy is whether objects whose images could not be looked up on ECR are admitted
+	failurePolicy string
+}
+
+func (w *admissionWebhook) serveMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/mutate", admissionHandler(w.timeout, w.mutate))
+	mux.Handle("/validate", admissionHandler(w.timeout, w.validate))
+	return mux
+}
+
+// admissionHandler returns an HTTP handler decoding admission reviews and answering them with the given function,
+// which is given a context that is done once the timeout has passed, if it is not zero
+func admissionHandler(timeout time.Duration, review func(context.Context, *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var admissionReview admissionv1.AdmissionReview
+		if err := json.NewDecoder(r.Body).Decode(&admissionReview); err != nil || admissionReview.Request == nil {
+			http.Error(rw, "Could not decode admission review", http.StatusBadRequest)
+			return
+		}
+		ctx := r.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		response := review(ctx, admissionReview.Request)
+		response.UID = admissionReview.Request.UID
+		admissionReview.Response = response
+		admissionReview.Request = nil
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(&admissionReview); err != nil {
+			log.WithError(err).Error("Could not encode admission review")
+		}
+	})
+}
+
+// mutate tags the images from ECR of the admitted object.
+// Objects are always allowed, images that could not be tagged before the deadline are picked up by the tagger later
+func (w *admissionWebhook) mutate(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	spec, specPath, err := podSpecOf(request)
+	if err != nil {
+		log.WithError(err).Warn("Could not decode admitted object")
+		return response
+	}
+	if spec == nil {
+		return response
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: request.Namespace, Name: request.Name},
+		Spec:       *spec,
+	}
+	// Images are not tagged for dry-run requests, which must not have side effects
+	if request.DryRun == nil || !*request.DryRun {
+		tag, tagPrefix := w.tagger.nextTag()
+		w.tagger.tagPodImages(ctx, tag, tagPrefix, pod)
+	}
+	// References are only rewritten when objects are created, rewriting them on updates would undo
+	// the changes of the tools that manage the objects every time they apply them
+	if !w.rewriteToDigest || request.Operation != admissionv1.Create {
+		return response
+	}
+	patch := digestPatch(ctx, w.tagger.ecrClient, spec, specPath)
+	if len(patch) == 0 {
+		return response
+	}
+	response.Patch, err = json.Marshal(patch)
+	if err != nil {
+		log.WithError(err).Error("Could not encode patch")
+		response.Patch = nil
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.PatchType = &patchType
+	return response
+}
+
+// validate checks that the images from ECR of the admitted object exist
+func (w *admissionWebhook) validate(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	spec, _, err := podSpecOf(request)
+	if err != nil {
+		log.WithError(err).Warn("Could not decode admitted object")
+		return response
+	}
+	if spec == nil {
+		return response
+	}
+	objectLog := log.WithFields(log.Fields{"namespace": request.Namespace, "name": request.Name, "kind": request.Kind.Kind})
+	var missing, failed []string
+	for _, container := range append(append([]corev1.Container{}, spec.InitContainers...), spec.Containers...) {
+		image, err := registry.ParseImageName(imageRewrites.Rewrite(container.Image))
+		if err != nil {
+			continue
+		}
+		_, err = w.tagger.ecrClient.DescribeImage(ctx, image)
+		switch {
+		case err == nil:
+		case errors.Is(err, registry.ErrImageNotFound), errors.Is(err, registry.ErrRepositoryNotFound):
+			missing = append(missing, container.Image)
+		default:
+			objectLog.WithError(err).WithField("image", container.Image).Warn("Could not look up image")
+			failed = append(failed, container.Image)
+		}
+	}
+
+	if len(missing) > 0 {
+		message := fmt.Sprintf("Images do not exist on ECR: %s", strings.Join(missing, ", "))
+		if w.missingImageAction == missingImageDeny {
+			return deny(message)
+		}
+		objectLog.Warn(message)
+		response.AuditAnnotations = map[string]string{missingImagesAnnotation: strings.Join(missing, ",")}
+	}
+	if len(failed) > 0 && w.failurePolicy == failurePolicyClosed {
+		return deny(fmt.Sprintf("Images could not be looked up on ECR: %s", strings.Join(failed, ", ")))
+	}
+	return response
+}
+
+func deny(message string) *admissionv1.AdmissionResponse {
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonForbidden,
+			Code:    http.StatusForbidden,
+			Message: message,
+		},
+	}
+}
+
+// podSpecOf returns the Pod spec of the admitted object and its JSON pointer in the object,
+// or a nil spec if the object is neither a Pod nor a workload
+func podSpecOf(request *admissionv1.AdmissionRequest) (*corev1.PodSpec, string, error) {
+	raw := request.Object.Raw
+	switch request.Kind.Kind {
+	case "Pod":
+		var pod corev1.Pod
+		err := json.Unmarshal(raw, &pod)
+		return &pod.Spec, "/spec", err
+	case "Deployment":
+		var deployment appsv1.Deployment
+		err := json.Unmarshal(raw, &deployment)
+		return &deployment.Spec.Template.Spec, "/spec/template/spec", err
+	case "StatefulSet":
+		var statefulSet appsv1.StatefulSet
+		err := json.Unmarshal(raw, &statefulSet)
+		return &statefulSet.Spec.Template.Spec, "/spec/template/spec", err
+	case "DaemonSet":
+		var daemonSet appsv1.DaemonSet
+		err := json.Unmarshal(raw, &daemonSet)
+		return &daemonSet.Spec.Template.Spec, "/spec/template/spec", err
+	case "ReplicaSet":
+		var replicaSet appsv1.ReplicaSet
+		err := json.Unmarshal(raw, &replicaSet)
+		return &replicaSet.Spec.Template.Spec, "/spec/template/spec", err
+	case "Job":
+		var job batchv1.Job
+		err := json.Unmarshal(raw, &job)
+		return &job.Spec.Template.Spec, "/spec/template/spec", err
+	case "CronJob":
+		var cronJob batchv1.CronJob
+		err := json.Unmarshal(raw, &cronJob)
+		return &cronJob.Spec.JobTemplate.Spec.Template.Spec, "/spec/jobTemplate/spec/template/spec", err
+	}
+	return nil, "", nil
+}
+
+// patchOperation is a JSON patch operation
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// digestPatch returns the JSON patch replacing the tag references of the images from ECR
+// of the given Pod spec with digest references
+func digestPatch(ctx context.Context, ecrClient *registry.Client, spec *corev1.PodSpec, specPath string) []patchOperation {
+	var patch []patchOperation
+	fields := []struct {
+		name       string
+		containers []corev1.Container
+	}{
+		{"initContainers", spec.InitContainers},
+		{"containers", spec.Containers},
+	}
+	for _, field := range fields {
+		for i, container := range field.containers {
+			if strings.Contains(container.Image, "@") {
+				continue
+			}
+			reference := imageRewrites.Rewrite(container.Image)
+			image, err := registry.ParseImageName(reference)
+			if err != nil {
+				continue
+			}
+			detail, err := ecrClient.DescribeImage(ctx, image)
+			if err != nil {
+				log.WithError(err).WithField("image", container.Image).Warn("Could not get digest of image")
+				continue
+			}
+			if detail.ImageDigest == nil {
+				continue
+			}
+			patch = append(patch, patchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("%s/%s/%d/image", specPath, field.name, i),
+				Value: repositoryOf(reference) + "@" + *detail.ImageDigest,
+			})
+		}
+	}
+	return patch
+}
+
+// repositoryOf returns the given image reference without its tag.
+// Only a colon after the last slash separates a tag, others separate the port of the registry
+func repositoryOf(reference string) string {
+	if i := strings.LastIndex(reference, ":"); i > strings.LastIndex(reference, "/") {
+		return reference[:i]
+	}
+	return reference
+}
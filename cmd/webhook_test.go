@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	registry "github.com/AnesBenmerzoug/kube-ecr-tagger/internal/ecr"
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/state"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/google/go-cmp/cmp"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// mockWebhookECRClient finds, fetches and tags images
+type mockWebhookECRClient struct {
+	*mockECRClient
+}
+
+func (m *mockWebhookECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return (&mockReportECRClient{}).DescribeImagesWithContext(ctx, input)
+}
+
+func reviewAdmission(t *testing.T, handler http.Handler, path string, object interface{}, kind string) *admissionv1.AdmissionResponse {
+	return reviewAdmissionOperation(t, handler, path, admissionv1.Create, object, kind)
+}
+
+func reviewAdmissionOperation(t *testing.T, handler http.Handler, path string, operation admissionv1.Operation, object interface{}, kind string) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review := admissionv1.AdmissionReview{
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "1234",
+			Kind:      metav1.GroupVersionKind{Kind: kind},
+			Namespace: "default",
+			Name:      "app",
+			Operation: operation,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d instead", http.StatusOK, recorder.Code)
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+		t.Fatal(err)
+	}
+	if review.Response == nil || review.Response.UID != "1234" {
+		t.Fatalf("Expected a response to the review, but got %+v instead", review.Response)
+	}
+	return review.Response
+}
+
+func TestMutatingWebhook(t *testing.T) {
+	store := state.NewMemoryStore()
+	webhook := &admissionWebhook{
+		tagger: &tagger{
+			clientset: fake.NewSimpleClientset(),
+			ecrClient: &registry.Client{ECRAPI: &mockWebhookECRClient{&mockECRClient{}}},
+			store:     store,
+			tag:       "production",
+		},
+		rewriteToDigest: true,
+	}
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "nginx", Image: "nginx:latest"},
+						{Name: "app", Image: "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest"},
+					},
+				},
+			},
+		},
+	}
+
+	response := reviewAdmission(t, webhook.serveMux(), "/mutate", deployment, "Deployment")
+	if !response.Allowed {
+		t.Error("Expected the Deployment to be allowed")
+	}
+	var patch []patchOperation
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	expected := []patchOperation{{
+		Op:    "replace",
+		Path:  "/spec/template/spec/containers/1/image",
+		Value: "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image@sha256:1234",
+	}}
+	if diff := cmp.Diff(patch, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", patch, diff)
+	}
+	record, ok := store.Get(state.Key("123456789012", "test-image", "", "latest"))
+	if !ok || !record.HasTag("production") {
+		t.Errorf("Expected image to be tagged, but got record %+v", record)
+	}
+}
+
+func TestMutatingWebhookUpdate(t *testing.T) {
+	store := state.NewMemoryStore()
+	webhook := &admissionWebhook{
+		tagger: &tagger{
+			clientset: fake.NewSimpleClientset(),
+			ecrClient: &registry.Client{ECRAPI: &mockWebhookECRClient{&mockECRClient{}}},
+			store:     store,
+			tag:       "production",
+		},
+		rewriteToDigest: true,
+	}
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest"},
+					},
+				},
+			},
+		},
+	}
+
+	response := reviewAdmissionOperation(t, webhook.serveMux(), "/mutate", admissionv1.Update, deployment, "Deployment")
+	if !response.Allowed {
+		t.Error("Expected the Deployment to be allowed")
+	}
+	if response.Patch != nil || response.PatchType != nil {
+		t.Errorf("Expected no patch for an update, but got '%s' instead", response.Patch)
+	}
+	record, ok := store.Get(state.Key("123456789012", "test-image", "", "latest"))
+	if !ok || !record.HasTag("production") {
+		t.Errorf("Expected image to be tagged, but got record %+v", record)
+	}
+}
+
+func TestMutatingWebhookRewrite(t *testing.T) {
+	rules, err := registry.ParseRewriteRules([]string{"docker.io/=123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageRewrites = rules
+	defer func() { imageRewrites = nil }()
+	webhook := &admissionWebhook{
+		tagger: &tagger{
+			clientset: fake.NewSimpleClientset(),
+			ecrClient: &registry.Client{ECRAPI: &mockWebhookECRClient{&mockECRClient{}}},
+			store:     state.NewMemoryStore(),
+			tag:       "production",
+		},
+		rewriteToDigest: true,
+	}
+	pod := definePod("default", "app", "nginx")
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "registry", Image: "registry.example.com:5000/app"})
+
+	response := reviewAdmission(t, webhook.serveMux(), "/mutate", pod, "Pod")
+	if !response.Allowed {
+		t.Error("Expected the Pod to be allowed")
+	}
+	var patch []patchOperation
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	expected := []patchOperation{{
+		Op:    "replace",
+		Path:  "/spec/containers/0/image",
+		Value: "123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/library/nginx@sha256:1234",
+	}}
+	if diff := cmp.Diff(patch, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", patch, diff)
+	}
+}
+
+func TestMutatingWebhookDeadline(t *testing.T) {
+	// The budget of DescribeImages only allows looking up the first image before the deadline
+	ecrClient, err := registry.NewClient(registry.Options{
+		RateLimits: map[string]registry.RateLimit{"DescribeImages": {Rate: 0.001, Burst: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecrClient.ECRAPI = &mockWebhookECRClient{&mockECRClient{}}
+	webhook := &admissionWebhook{
+		tagger: &tagger{
+			clientset: fake.NewSimpleClientset(),
+			ecrClient: ecrClient,
+			store:     state.NewMemoryStore(),
+			tag:       "production",
+		},
+		timeout: 100 * time.Millisecond,
+	}
+	pod := definePod("default", "app", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest")
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "other", Image: "123456789012.dkr.ecr.eu-central-1.amazonaws.com/other-image:latest"})
+
+	start := time.Now()
+	response := reviewAdmission(t, webhook.serveMux(), "/mutate", pod, "Pod")
+	if !response.Allowed {
+		t.Error("Expected the Pod to be allowed")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the review to be answered before the deadline, but it took %s", elapsed)
+	}
+}
+
+func TestRepositoryOf(t *testing.T) {
+	var tests = []struct {
+		reference string
+		expected  string
+	}{
+		{"123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:latest", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image"},
+		{"registry.example.com:5000/app:v1", "registry.example.com:5000/app"},
+		{"registry.example.com:5000/app", "registry.example.com:5000/app"},
+		{"nginx", "nginx"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.reference, func(t *testing.T) {
+			if actual := repositoryOf(test.reference); actual != test.expected {
+				t.Errorf("Expected repository '%s', but got '%s' instead", test.expected, actual)
+			}
+		})
+	}
+}
+
+// mockValidatingECRClient fails to describe images tagged "denied" and describes the others like mockReportECRClient
+type mockValidatingECRClient struct {
+	mockReportECRClient
+}
+
+func (m *mockValidatingECRClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	for _, imageID := range input.ImageIds {
+		if aws.StringValue(imageID.ImageTag) == "denied" {
+			return nil, awserr.New("AccessDeniedException", "User is not authorized to perform ecr:DescribeImages", nil)
+		}
+	}
+	return m.mockReportECRClient.DescribeImagesWithContext(ctx, input)
+}
+
+func TestValidatingWebhook(t *testing.T) {
+	var tests = []struct {
+		description        string
+		tag                string
+		missingImageAction string
+		failurePolicy      string
+		expected           bool
+		expectedAnnotation string
+	}{
+		{"existing image", "latest", missingImageDeny, failurePolicyClosed, true, ""},
+		{"missing image", "missing", missingImageDeny, failurePolicyOpen, false, ""},
+		{"missing image with warning", "missing", missingImageWarn, failurePolicyOpen, true, "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:missing"},
+		{"lookup failure with fail-open", "denied", missingImageDeny, failurePolicyOpen, true, ""},
+		{"lookup failure with fail-closed", "denied", missingImageDeny, failurePolicyClosed, false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			webhook := &admissionWebhook{
+				tagger: &tagger{
+					ecrClient: &registry.Client{ECRAPI: &mockValidatingECRClient{}},
+				},
+				missingImageAction: test.missingImageAction,
+				failurePolicy:      test.failurePolicy,
+			}
+			pod := definePod("default", "app", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/test-image:"+test.tag)
+
+			response := reviewAdmission(t, webhook.serveMux(), "/validate", pod, "Pod")
+			if response.Allowed != test.expected {
+				t.Errorf("Expected allowed to be %t, but got %t instead: %+v", test.expected, response.Allowed, response.Result)
+			}
+			if annotation := response.AuditAnnotations[missingImagesAnnotation]; annotation != test.expectedAnnotation {
+				t.Errorf("Expected annotation '%s', but got '%s' instead", test.expectedAnnotation, annotation)
+			}
+		})
+	}
+}
@@ -3,14 +3,14 @@ module github.com/AnesBenmerzoug/kube-ecr-tagger
 go 1.13
 
 require (
-	github.com/aws/aws-sdk-go v1.33.11
-	github.com/google/go-cmp v0.5.1
+	github.com/aws/aws-sdk-go v1.44.0
+	github.com/google/go-cmp v0.5.5
+	github.com/prometheus/client_golang v1.7.1
+	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/cobra v1.0.0
-	golang.org/x/crypto v0.0.0-20191219195013-becbf705a915 // indirect
-	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6 // indirect
-	golang.org/x/time v0.0.0-20191024005414-555d28b269f0 // indirect
-	k8s.io/api v0.18.6
-	k8s.io/apimachinery v0.18.6
-	k8s.io/client-go v0.16.5
-	k8s.io/utils v0.0.0-20191218082557-f07c713de883 // indirect
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	k8s.io/api v0.21.14
+	k8s.io/apimachinery v0.21.14
+	k8s.io/client-go v0.21.14
 )
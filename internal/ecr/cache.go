@@ -0,0 +1,250 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// imageKey identifies an image on ECR by its digest
+type imageKey struct {
+	registry   string
+	repository string
+	digest     string
+}
+
+// tagKey identifies an image on ECR by one of its tags
+type tagKey struct {
+	registry   string
+	repository string
+	tag        string
+}
+
+type cacheEntry struct {
+	key     imageKey
+	expires time.Time
+	// tags are the image tags returned by DescribeImages, nil if they were not looked up yet
+	tags []*string
+	// image is the image returned by BatchGetImage, nil if it was not looked up yet
+	image *ecr.Image
+	// scan is the completed scan returned by DescribeImageScanFindings, nil if it was not looked up yet
+	scan *ScanResult
+	// indexed holds the tags under which the entry is indexed
+	indexed []tagKey
+}
+
+// imageCache is a size bounded, least recently used cache of image tags and manifests
+// whose entries expire after a fixed time to live.
+// Entries are keyed by digest, tags are resolved to digests with a secondary index
+type imageCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	lru     *list.List
+	entries map[imageKey]*list.Element
+	digests map[tagKey]string
+	now     func() time.Time
+}
+
+// newImageCache returns a cache holding at most size entries for the given duration,
+// or nil if either of them is not positive
+func newImageCache(ttl time.Duration, size int) *imageCache {
+	if ttl <= 0 || size <= 0 {
+		return nil
+	}
+	return &imageCache{
+		ttl:     ttl,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[imageKey]*list.Element),
+		digests: make(map[tagKey]string),
+		now:     time.Now,
+	}
+}
+
+// lookup returns the entry of the image with the given tag, if it exists and did not expire.
+// It must be called with the lock held
+func (c *imageCache) lookup(key tagKey) *cacheEntry {
+	digest, ok := c.digests[key]
+	if !ok {
+		return nil
+	}
+	element, ok := c.entries[imageKey{key.registry, key.repository, digest}]
+	if !ok {
+		delete(c.digests, key)
+		return nil
+	}
+	entry := element.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+// store returns the entry of the image with the given digest, creating it if needed,
+// and indexes it under the given tags. It must be called with the lock held
+func (c *imageCache) store(key imageKey, tags ...string) *cacheEntry {
+	var entry *cacheEntry
+	if element, ok := c.entries[key]; ok && !c.now().After(element.Value.(*cacheEntry).expires) {
+		c.lru.MoveToFront(element)
+		entry = element.Value.(*cacheEntry)
+	} else {
+		if ok {
+			c.remove(element)
+		}
+		entry = &cacheEntry{key: key, expires: c.now().Add(c.ttl)}
+		c.entries[key] = c.lru.PushFront(entry)
+		for c.lru.Len() > c.size {
+			c.remove(c.lru.Back())
+		}
+	}
+IndexLoop:
+	for _, tag := range tags {
+		indexKey := tagKey{key.registry, key.repository, tag}
+		c.digests[indexKey] = key.digest
+		for _, indexed := range entry.indexed {
+			if indexed == indexKey {
+				continue IndexLoop
+			}
+		}
+		entry.indexed = append(entry.indexed, indexKey)
+	}
+	return entry
+}
+
+// remove deletes an entry from the cache. It must be called with the lock held
+func (c *imageCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	for _, indexKey := range entry.indexed {
+		if c.digests[indexKey] == entry.key.digest {
+			delete(c.digests, indexKey)
+		}
+	}
+}
+
+// getTags returns the cached tags of the given image
+func (c *imageCache) getTags(image *ecr.Image) ([]*string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.lookup(tagKeyOf(image))
+	if entry == nil || entry.tags == nil {
+		return nil, false
+	}
+	return entry.tags, true
+}
+
+// putTags caches the tags of the image described by the given details
+func (c *imageCache) putTags(image *ecr.Image, details *ecr.ImageDetail) {
+	if c == nil || details.ImageDigest == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := imageKey{aws.StringValue(image.RegistryId), aws.StringValue(image.RepositoryName), *details.ImageDigest}
+	tags := append([]string{aws.StringValue(image.ImageId.ImageTag)}, aws.StringValueSlice(details.ImageTags)...)
+	entry := c.store(key, tags...)
+	entry.tags = details.ImageTags
+	if entry.tags == nil {
+		entry.tags = []*string{}
+	}
+}
+
+// getImage returns the cached information of the given image
+func (c *imageCache) getImage(image *ecr.Image) (*ecr.Image, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.lookup(tagKeyOf(image))
+	if entry == nil || entry.image == nil {
+		return nil, false
+	}
+	return entry.image, true
+}
+
+// putImage caches the information of the given image as returned by BatchGetImage
+func (c *imageCache) putImage(image *ecr.Image) {
+	if c == nil || image.ImageId == nil || image.ImageId.ImageDigest == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := imageKey{aws.StringValue(image.RegistryId), aws.StringValue(image.RepositoryName), *image.ImageId.ImageDigest}
+	var tags []string
+	if image.ImageId.ImageTag != nil {
+		tags = append(tags, *image.ImageId.ImageTag)
+	}
+	c.store(key, tags...).image = image
+}
+
+// invalidate removes the given image from the cache.
+// It is called after the image's tags are changed by the Client
+func (c *imageCache) invalidate(image *ecr.Image) {
+	if c == nil || image.ImageId == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	digest := aws.StringValue(image.ImageId.ImageDigest)
+	if digest == "" {
+		digest = c.digests[tagKeyOf(image)]
+	}
+	key := imageKey{aws.StringValue(image.RegistryId), aws.StringValue(image.RepositoryName), digest}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// getScan returns the cached scan result of the given image
+func (c *imageCache) getScan(image *ecr.Image) (*ScanResult, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.lookup(tagKeyOf(image))
+	if entry == nil || entry.scan == nil {
+		return nil, false
+	}
+	return entry.scan, true
+}
+
+// putScan caches the completed scan result of the image with the given digest
+func (c *imageCache) putScan(image *ecr.Image, digest string, scan *ScanResult) {
+	if c == nil || digest == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := imageKey{aws.StringValue(image.RegistryId), aws.StringValue(image.RepositoryName), digest}
+	c.store(key, aws.StringValue(image.ImageId.ImageTag)).scan = scan
+}
+
+func tagKeyOf(image *ecr.Image) tagKey {
+	return tagKey{aws.StringValue(image.RegistryId), aws.StringValue(image.RepositoryName), aws.StringValue(image.ImageId.ImageTag)}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/mock"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+type mockCountingClient struct {
+	ecriface.ECRAPI
+	describeCalls int
+	getCalls      int
+}
+
+func (m *mockCountingClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	m.describeCalls++
+	return &ecr.DescribeImagesOutput{
+		ImageDetails: []*ecr.ImageDetail{
+			{
+				ImageDigest: aws.String("sha256:1234"),
+				ImageTags:   []*string{input.ImageIds[0].ImageTag},
+			},
+		},
+	}, nil
+}
+
+func (m *mockCountingClient) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	m.getCalls++
+	return &ecr.BatchGetImageOutput{
+		Images: []*ecr.Image{
+			{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: input.ImageIds[0].ImageTag, ImageDigest: aws.String("sha256:1234")},
+				ImageManifest:  aws.String("{}"),
+				RepositoryName: input.RepositoryName,
+				RegistryId:     input.RegistryId,
+			},
+		},
+	}, nil
+}
+
+func (m *mockCountingClient) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	return &ecr.PutImageOutput{}, nil
+}
+
+func testImage(tag string) *ecr.Image {
+	return &ecr.Image{
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(tag)},
+		RepositoryName: aws.String("test"),
+		RegistryId:     aws.String("530519006690"),
+	}
+}
+
+func TestCachingImageLookups(t *testing.T) {
+	mockClient := &mockCountingClient{ECRAPI: ecr.New(mock.Session)}
+	client := &Client{
+		ECRAPI: mockClient,
+		cache:  newImageCache(time.Minute, 10),
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.GetImageTags(context.Background(), testImage("latest")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.GetImagesInformation(context.Background(), []*ecr.Image{testImage("latest")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mockClient.describeCalls != 1 || mockClient.getCalls != 1 {
+		t.Errorf("Expected 1 call to each API, but got %d DescribeImages and %d BatchGetImage calls", mockClient.describeCalls, mockClient.getCalls)
+	}
+
+	images, _ := client.GetImagesInformation(context.Background(), []*ecr.Image{testImage("latest")})
+	client.TagImages(context.Background(), images, "deployed")
+	if _, err := client.GetImageTags(context.Background(), testImage("latest")); err != nil {
+		t.Fatal(err)
+	}
+	if mockClient.describeCalls != 2 {
+		t.Errorf("Expected the cache to be invalidated after tagging, but got %d DescribeImages calls", mockClient.describeCalls)
+	}
+}
+
+func TestImageCacheExpiryAndSize(t *testing.T) {
+	cache := newImageCache(time.Minute, 2)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for i, tag := range []string{"a", "b", "c"} {
+		image := testImage(tag)
+		cache.putTags(image, &ecr.ImageDetail{ImageDigest: aws.String("sha256:" + tag), ImageTags: []*string{aws.String(tag)}})
+		if i == 0 {
+			if _, ok := cache.getTags(image); !ok {
+				t.Errorf("Expected tags of image '%s' to be cached", tag)
+			}
+		}
+	}
+	if _, ok := cache.getTags(testImage("a")); ok {
+		t.Error("Expected least recently used image to be evicted")
+	}
+	if len(cache.digests) != 2 {
+		t.Errorf("Expected tag index to hold 2 entries, but got %d", len(cache.digests))
+	}
+	if _, ok := cache.getTags(testImage("c")); !ok {
+		t.Error("Expected tags of image 'c' to be cached")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.getTags(testImage("c")); ok {
+		t.Error("Expected cached tags to expire")
+	}
+
+	if newImageCache(0, 10) != nil || newImageCache(time.Minute, 0) != nil {
+		t.Error("Expected cache to be disabled")
+	}
+}
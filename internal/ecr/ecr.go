@@ -16,27 +16,83 @@ limitations under the License.
 package registry
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"regexp"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 var ecrRegex = regexp.MustCompile(`^(?P<registry>\d+)\.dkr\.ecr.\w+-\w+-\d\.amazonaws\.com/(?P<repository>.+):(?P<tag>.+)$`)
 
+// Options configures a Client
+type Options struct {
+	// MaxRetries is the maximum number of times a throttled or transient ECR API call is retried
+	MaxRetries int
+	// RetryBaseDelay is the delay before the first retry, it doubles with every subsequent retry
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay caps the delay between two retries
+	RetryMaxDelay time.Duration
+	// RateLimits maps ECR API operation names to their budget.
+	// The budgets are shared by all goroutines using the Client
+	RateLimits map[string]RateLimit
+	// CacheTTL is the duration for which image tags and manifests are cached, caching is disabled if it is zero
+	CacheTTL time.Duration
+	// CacheSize is the maximum number of images that are cached, caching is disabled if it is zero
+	CacheSize int
+	// RepositoryTags are the AWS resource tags added to the repositories of images in use by TagRepository
+	RepositoryTags map[string]string
+	// RepositoryLastUsedTag is the key of the AWS resource tag set to the date on which
+	// the images of a repository were last seen in use by TagRepository
+	RepositoryLastUsedTag string
+}
+
+// DefaultOptions returns the options used when none are explicitly configured
+func DefaultOptions() Options {
+	return Options{
+		MaxRetries:     5,
+		RetryBaseDelay: 100 * time.Millisecond,
+		RetryMaxDelay:  10 * time.Second,
+		RateLimits: map[string]RateLimit{
+			"DescribeImages": {Rate: 20, Burst: 20},
+			"BatchGetImage":  {Rate: 20, Burst: 20},
+			"PutImage":       {Rate: 10, Burst: 10},
+			// Repositories are described and tagged at most once a day each, their quotas are low
+			"DescribeRepositories": {Rate: 5, Burst: 5},
+			"TagResource":          {Rate: 5, Burst: 5},
+		},
+		CacheTTL:  10 * time.Minute,
+		CacheSize: 1000,
+	}
+}
+
 // Client wraps an ECR API
 type Client struct {
 	ecriface.ECRAPI
+	options  Options
+	limiters map[string]*rate.Limiter
+	cache    *imageCache
+	// pullThrough caches the pull through cache rules of each registry
+	pullThrough pullThroughCache
+	// repositories caches the ARN and the resource tags of each repository tagged by TagRepository
+	repositories repositoryCache
+
+	mu          sync.Mutex
+	lastSuccess time.Time
 }
 
 // NewClient instantiates a new Client struct
-func NewClient() (*Client, error) {
-	config := aws.NewConfig()
+func NewClient(options Options) (*Client, error) {
+	// Retries are handled by the Client itself
+	config := aws.NewConfig().WithMaxRetries(0)
 
 	currentSession, err := session.NewSession(config)
 	if err != nil {
@@ -44,14 +100,61 @@ func NewClient() (*Client, error) {
 	}
 
 	client := &Client{
-		ecr.New(currentSession),
+		ECRAPI:   ecr.New(currentSession),
+		options:  options,
+		limiters: newLimiters(options.RateLimits),
+		cache:    newImageCache(options.CacheTTL, options.CacheSize),
 	}
 
 	return client, nil
 }
 
+// LastSuccess returns the time at which an ECR API call last succeeded
+func (c *Client) LastSuccess() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastSuccess
+}
+
+func (c *Client) recordSuccess() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastSuccess = time.Now()
+}
+
+// Ping checks whether ECR can be reached with the Client's credentials.
+// It makes a single call that is bounded by the context, so that it answers probes quickly
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, "GetAuthorizationToken", func() error {
+		_, err := c.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
+		return err
+	})
+}
+
+// TagStatus describes the outcome of tagging a single image
+type TagStatus string
+
+// Possible outcomes of tagging an image
+const (
+	TagStatusTagged        TagStatus = "tagged"
+	TagStatusAlreadyTagged TagStatus = "already-tagged"
+	TagStatusFailed        TagStatus = "failed"
+)
+
+// TagResult holds the outcome of tagging a single image
+type TagResult struct {
+	Image  *ecr.Image
+	Tag    string
+	Status TagStatus
+	// Err is set when Status is TagStatusFailed
+	Err error
+}
+
 // GetImageTags queries ECR to get all Tags for the given image
-func (c *Client) GetImageTags(image *ecr.Image) ([]*string, error) {
+func (c *Client) GetImageTags(ctx context.Context, image *ecr.Image) ([]*string, error) {
+	if imageTags, ok := c.cache.getTags(image); ok {
+		return imageTags, nil
+	}
 	var imageTags []*string
 	describeInput := &ecr.DescribeImagesInput{
 		ImageIds: []*ecr.ImageIdentifier{
@@ -62,25 +165,61 @@ func (c *Client) GetImageTags(image *ecr.Image) ([]*string, error) {
 		RepositoryName: image.RepositoryName,
 		RegistryId:     image.RegistryId,
 	}
-	result, err := c.DescribeImages(describeInput)
+	var result *ecr.DescribeImagesOutput
+	err := c.retry(ctx, "DescribeImages", func() (err error) {
+		result, err = c.DescribeImagesWithContext(ctx, describeInput)
+		return err
+	})
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			log.Print(aerr.Error())
-			return nil, err
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
 	for _, imageDetail := range result.ImageDetails {
+		c.cache.putTags(image, imageDetail)
 		imageTags = append(imageTags, imageDetail.ImageTags...)
 	}
 	return imageTags, nil
 }
 
-// GetImagesInformation queries ECR to get information for the given images
-func (c *Client) GetImagesInformation(images []*ecr.Image) ([]*ecr.Image, error) {
+// DescribeImage queries ECR to get the details of the given image.
+// The image is identified by its digest if it is set, by its tag otherwise
+func (c *Client) DescribeImage(ctx context.Context, image *ecr.Image) (*ecr.ImageDetail, error) {
+	imageID := &ecr.ImageIdentifier{ImageTag: image.ImageId.ImageTag}
+	if image.ImageId.ImageDigest != nil {
+		imageID = &ecr.ImageIdentifier{ImageDigest: image.ImageId.ImageDigest}
+	}
+	describeInput := &ecr.DescribeImagesInput{
+		ImageIds:       []*ecr.ImageIdentifier{imageID},
+		RepositoryName: image.RepositoryName,
+		RegistryId:     image.RegistryId,
+	}
+	var result *ecr.DescribeImagesOutput
+	err := c.retry(ctx, "DescribeImages", func() (err error) {
+		result, err = c.DescribeImagesWithContext(ctx, describeInput)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(result.ImageDetails) == 0 {
+		return nil, &Error{
+			Op:   "DescribeImages",
+			Code: ecr.ErrCodeImageNotFoundException,
+			Kind: ErrImageNotFound,
+			Err:  fmt.Errorf("Image '%s' was not found", FormatImageName(image)),
+		}
+	}
+	return result.ImageDetails[0], nil
+}
+
+// GetImagesInformation queries ECR to get information for the given images.
+// Images that could not be found or accessed are logged and left out of the result
+func (c *Client) GetImagesInformation(ctx context.Context, images []*ecr.Image) ([]*ecr.Image, error) {
 	var imageInformation []*ecr.Image
 	for _, image := range images {
+		if cached, ok := c.cache.getImage(image); ok {
+			imageInformation = append(imageInformation, cached)
+			continue
+		}
 		getInput := &ecr.BatchGetImageInput{
 			ImageIds: []*ecr.ImageIdentifier{
 				{
@@ -90,25 +229,39 @@ func (c *Client) GetImagesInformation(images []*ecr.Image) ([]*ecr.Image, error)
 			RepositoryName: image.RepositoryName,
 			RegistryId:     image.RegistryId,
 		}
-		result, err := c.BatchGetImage(getInput)
+		var result *ecr.BatchGetImageOutput
+		err := c.retry(ctx, "BatchGetImage", func() (err error) {
+			result, err = c.BatchGetImageWithContext(ctx, getInput)
+			return err
+		})
 		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				log.Print(aerr.Error())
+			var ecrErr *Error
+			if errors.As(err, &ecrErr) {
+				log.WithError(err).WithField("image", FormatImageName(image)).Warn("Could not get information for image")
 				continue
-			} else {
-				return nil, err
 			}
+			return nil, err
+		}
+		for _, failure := range result.Failures {
+			log.WithError(classifyFailure("BatchGetImage", failure)).WithField("image", FormatImageName(image)).Warn("Could not get information for image")
+		}
+		for _, information := range result.Images {
+			c.cache.putImage(information)
 		}
 		imageInformation = append(imageInformation, result.Images...)
 	}
 	return imageInformation, nil
 }
 
-// TagImages adds the given tag to a list of images on ECR
-func (c *Client) TagImages(imagesToTag []*ecr.Image, tag string) error {
+// TagImages adds the given tag to a list of images on ECR and returns the outcome for each image
+func (c *Client) TagImages(ctx context.Context, imagesToTag []*ecr.Image, tag string) []TagResult {
+	results := make([]TagResult, 0, len(imagesToTag))
 	for _, image := range imagesToTag {
+		result := TagResult{Image: image, Tag: tag}
 		if *image.ImageId.ImageTag == tag {
-			log.Printf("Image '%s' already has tag '%s'", image.ImageId.String(), *image.ImageId.ImageTag)
+			log.WithFields(log.Fields{"image": FormatImageName(image), "newTag": tag}).Debug("Image already has tag")
+			result.Status = TagStatusAlreadyTagged
+			results = append(results, result)
 			continue
 		}
 		putInput := &ecr.PutImageInput{
@@ -117,19 +270,73 @@ func (c *Client) TagImages(imagesToTag []*ecr.Image, tag string) error {
 			RepositoryName: image.RepositoryName,
 			RegistryId:     image.RegistryId,
 		}
-		_, err := c.PutImage(putInput)
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				log.Print(aerr.Error())
-				continue
-			} else {
-				return err
-			}
+		err := c.retry(ctx, "PutImage", func() error {
+			_, err := c.PutImageWithContext(ctx, putInput)
+			return err
+		})
+		// The image's tags changed or are not what we expected
+		c.cache.invalidate(image)
+		switch {
+		case err == nil:
+			result.Status = TagStatusTagged
+		case ErrorCode(err) == ecr.ErrCodeImageAlreadyExistsException:
+			// The image already carries the tag
+			result.Status = TagStatusAlreadyTagged
+		default:
+			result.Status = TagStatusFailed
+			result.Err = err
 		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// UntagImage removes the given tag from an image of the repository with BatchDeleteImage.
+// ECR deletes images whose last tag is removed, so the last tag of an image is never removed.
+// If the digest is not empty, the tag is only removed if it still points to the image with that digest.
+func (c *Client) UntagImage(ctx context.Context, registryID, repository, digest, tag string) error {
+	image := &ecr.Image{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repository),
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(tag)},
+	}
+	if digest != "" {
+		image.ImageId.ImageDigest = aws.String(digest)
+	}
+	detail, err := c.DescribeImage(ctx, image)
+	if err != nil {
+		return err
+	}
+	if isLastTag(detail.ImageTags, tag) {
+		return ErrLastTag
+	}
+	input := &ecr.BatchDeleteImageInput{
+		RegistryId:     image.RegistryId,
+		RepositoryName: image.RepositoryName,
+		ImageIds:       []*ecr.ImageIdentifier{image.ImageId},
+	}
+	var output *ecr.BatchDeleteImageOutput
+	err = c.retry(ctx, "BatchDeleteImage", func() error {
+		var err error
+		output, err = c.BatchDeleteImageWithContext(ctx, input)
+		return err
+	})
+	// The image's tags changed or are not what we expected
+	c.cache.invalidate(image)
+	if err != nil {
+		return err
+	}
+	if len(output.Failures) > 0 {
+		return classifyFailure("BatchDeleteImage", output.Failures[0])
 	}
 	return nil
 }
 
+// isLastTag reports whether tag is the only one of the given tags of an image
+func isLastTag(imageTags []*string, tag string) bool {
+	return len(imageTags) == 1 && aws.StringValue(imageTags[0]) == tag
+}
+
 // ParseImageName parses a given ECR image name and extracts the registry ID, repository name and tag from it
 func ParseImageName(imageName string) (*ecr.Image, error) {
 	match := ecrRegex.FindStringSubmatch(imageName)
@@ -137,9 +344,14 @@ func ParseImageName(imageName string) (*ecr.Image, error) {
 		return nil, fmt.Errorf("Could not parse image name '%s'", imageName)
 	}
 	image := &ecr.Image{
-		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(match[2])},
-		RepositoryName: aws.String(match[1]),
-		RegistryId:     aws.String(match[0]),
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(match[3])},
+		RepositoryName: aws.String(match[2]),
+		RegistryId:     aws.String(match[1]),
 	}
 	return image, nil
 }
+
+// FormatImageName returns a human readable reference to the given image
+func FormatImageName(image *ecr.Image) string {
+	return fmt.Sprintf("%s/%s:%s", aws.StringValue(image.RegistryId), aws.StringValue(image.RepositoryName), aws.StringValue(image.ImageId.ImageTag))
+}
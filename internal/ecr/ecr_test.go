@@ -16,9 +16,12 @@ limitations under the License.
 package registry
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/awstesting/mock"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
@@ -30,7 +33,7 @@ type mockBatchGetImageClient struct {
 	response ecr.BatchGetImageOutput
 }
 
-func (m *mockBatchGetImageClient) BatchGetImage(input *ecr.BatchGetImageInput) (*ecr.BatchGetImageOutput, error) {
+func (m *mockBatchGetImageClient) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
 	return &m.response, nil
 }
 
@@ -127,12 +130,12 @@ func TestGettingImageInformation(t *testing.T) {
 		t.Run(test.description, func(t *testing.T) {
 			mockSession := mock.Session
 			client := &Client{
-				&mockBatchGetImageClient{
+				ECRAPI: &mockBatchGetImageClient{
 					ecr.New(mockSession),
 					test.response,
 				},
 			}
-			actual, err := client.GetImagesInformation(test.input)
+			actual, err := client.GetImagesInformation(context.Background(), test.input)
 			if test.expected == nil && actual != nil && err == nil {
 				t.Errorf("Expected no image, but got '%+v' instead", actual)
 				return
@@ -145,6 +148,118 @@ func TestGettingImageInformation(t *testing.T) {
 	}
 }
 
+type mockDescribeImagesClient struct {
+	ecriface.ECRAPI
+	input    *ecr.DescribeImagesInput
+	response ecr.DescribeImagesOutput
+}
+
+func (m *mockDescribeImagesClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	m.input = input
+	return &m.response, nil
+}
+
+func TestDescribeImage(t *testing.T) {
+	detail := &ecr.ImageDetail{
+		ImageDigest: aws.String("sha256:1234"),
+		ImageTags:   aws.StringSlice([]string{"latest", "deployed1599999999"}),
+	}
+	var tests = []struct {
+		description string
+		digest      *string
+		response    ecr.DescribeImagesOutput
+		expectedID  *ecr.ImageIdentifier
+		expectedErr error
+	}{
+		{"by tag", nil, ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{detail}}, &ecr.ImageIdentifier{ImageTag: aws.String("latest")}, nil},
+		{"by digest", aws.String("sha256:1234"), ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{detail}}, &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:1234")}, nil},
+		{"not found", nil, ecr.DescribeImagesOutput{}, &ecr.ImageIdentifier{ImageTag: aws.String("latest")}, ErrImageNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mockClient := &mockDescribeImagesClient{response: test.response}
+			client := &Client{ECRAPI: mockClient}
+			image := &ecr.Image{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("latest"), ImageDigest: test.digest},
+				RepositoryName: aws.String("test"),
+				RegistryId:     aws.String("530519006690"),
+			}
+			actual, err := client.DescribeImage(context.Background(), image)
+			if !errors.Is(err, test.expectedErr) {
+				t.Fatalf("Expected error '%v', but got '%v' instead", test.expectedErr, err)
+			}
+			if diff := cmp.Diff(mockClient.input.ImageIds, []*ecr.ImageIdentifier{test.expectedID}); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", mockClient.input.ImageIds, diff)
+			}
+			if err == nil && actual != detail {
+				t.Errorf("Expected image detail '%v', but got '%v' instead", detail, actual)
+			}
+		})
+	}
+}
+
+type mockBatchDeleteImageClient struct {
+	ecriface.ECRAPI
+	tags     []string
+	input    *ecr.BatchDeleteImageInput
+	response ecr.BatchDeleteImageOutput
+}
+
+func (m *mockBatchDeleteImageClient) DescribeImagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput, opts ...request.Option) (*ecr.DescribeImagesOutput, error) {
+	return &ecr.DescribeImagesOutput{
+		ImageDetails: []*ecr.ImageDetail{{ImageTags: aws.StringSlice(m.tags)}},
+	}, nil
+}
+
+func (m *mockBatchDeleteImageClient) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput, opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+	m.input = input
+	return &m.response, nil
+}
+
+func TestUntagImage(t *testing.T) {
+	var tests = []struct {
+		description  string
+		digest       string
+		response     ecr.BatchDeleteImageOutput
+		expectedID   *ecr.ImageIdentifier
+		expectedCode string
+	}{
+		{"by tag", "", ecr.BatchDeleteImageOutput{}, &ecr.ImageIdentifier{ImageTag: aws.String("deployed1")}, ""},
+		{"by digest and tag", "sha256:1234", ecr.BatchDeleteImageOutput{}, &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:1234"), ImageTag: aws.String("deployed1")}, ""},
+		{"tag moved", "sha256:1234", ecr.BatchDeleteImageOutput{Failures: []*ecr.ImageFailure{{
+			FailureCode:   aws.String(ecr.ImageFailureCodeImageTagDoesNotMatchDigest),
+			FailureReason: aws.String("Invalid image digest for tag"),
+		}}}, &ecr.ImageIdentifier{ImageDigest: aws.String("sha256:1234"), ImageTag: aws.String("deployed1")}, ecr.ImageFailureCodeImageTagDoesNotMatchDigest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mockClient := &mockBatchDeleteImageClient{tags: []string{"v1", "deployed1"}, response: test.response}
+			client := &Client{ECRAPI: mockClient}
+			err := client.UntagImage(context.Background(), "530519006690", "test", test.digest, "deployed1")
+			if code := ErrorCode(err); code != test.expectedCode {
+				t.Fatalf("Expected error code '%s', but got '%s' instead", test.expectedCode, code)
+			}
+			if diff := cmp.Diff(mockClient.input.ImageIds, []*ecr.ImageIdentifier{test.expectedID}); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", mockClient.input.ImageIds, diff)
+			}
+		})
+	}
+}
+
+func TestUntagImageLastTag(t *testing.T) {
+	mockClient := &mockBatchDeleteImageClient{tags: []string{"deployed1"}}
+	client := &Client{ECRAPI: mockClient}
+	err := client.UntagImage(context.Background(), "530519006690", "test", "sha256:1234", "deployed1")
+	if !errors.Is(err, ErrLastTag) {
+		t.Errorf("Expected last tag error, but got '%v' instead", err)
+	}
+	if mockClient.input != nil {
+		t.Errorf("Expected the image not to be deleted, but got '%v' instead", mockClient.input)
+	}
+}
+
 func TestParseImageName(t *testing.T) {
 	var tests = []struct {
 		description string
@@ -168,7 +283,10 @@ func TestParseImageName(t *testing.T) {
 				t.Errorf("Expected no image, but got '%+v' instead", image)
 				return
 			}
-
+			if diff := cmp.Diff(image, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+				return
+			}
 		})
 	}
 }
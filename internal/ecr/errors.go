@@ -0,0 +1,216 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/metrics"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+)
+
+// Errors used to classify the failures returned by the ECR API.
+// They can be matched against the errors returned by Client using errors.Is
+var (
+	ErrImageNotFound      = errors.New("image not found")
+	ErrRepositoryNotFound = errors.New("repository not found")
+	ErrThrottled          = errors.New("request throttled")
+	ErrAccessDenied       = errors.New("access denied")
+	ErrTagConflict        = errors.New("tag conflict")
+	ErrTransient          = errors.New("transient failure")
+
+	ErrLifecyclePolicyNotFound = errors.New("lifecycle policy not found")
+
+	// ErrLastTag is returned instead of removing the last tag of an image, which would delete the image
+	ErrLastTag = errors.New("last tag of image")
+)
+
+// Error is returned by Client methods when a call to the ECR API fails
+type Error struct {
+	// Op is the name of the ECR API operation that failed
+	Op string
+	// Code is the AWS error code, if any
+	Code string
+	// Kind is one of the sentinel errors defined in this package, the error of the context of a call that was cut short,
+	// or nil if the failure could not be classified
+	Kind error
+	// Err is the underlying error
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error's kind matches the given target
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// IsRetryable reports whether the given error is worth retrying
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrThrottled) || errors.Is(err, ErrTransient)
+}
+
+// ErrorCode returns the AWS error code of the given error, or an empty string if it has none
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// classifyError wraps errors returned by the ECR API in an Error whose Kind describes the failure
+func classifyError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	return &Error{
+		Op:   op,
+		Code: aerr.Code(),
+		Kind: errorKind(aerr),
+		Err:  err,
+	}
+}
+
+func errorKind(aerr awserr.Error) error {
+	switch aerr.Code() {
+	case ecr.ErrCodeImageNotFoundException:
+		return ErrImageNotFound
+	case ecr.ErrCodeRepositoryNotFoundException:
+		return ErrRepositoryNotFound
+	case ecr.ErrCodeImageTagAlreadyExistsException:
+		return ErrTagConflict
+	case ecr.ErrCodeLifecyclePolicyNotFoundException:
+		return ErrLifecyclePolicyNotFound
+	case "AccessDeniedException", "AccessDenied", "UnrecognizedClientException":
+		return ErrAccessDenied
+	case ecr.ErrCodeLimitExceededException:
+		return ErrThrottled
+	case request.CanceledErrorCode:
+		// The original error is the one of the call's context, e.g. context.Canceled
+		return aerr.OrigErr()
+	}
+	if request.IsErrorThrottle(aerr) {
+		return ErrThrottled
+	}
+	if request.IsErrorRetryable(aerr) {
+		return ErrTransient
+	}
+	return nil
+}
+
+// classifyFailure converts a failure reported in the body of a BatchGetImage response to an Error
+func classifyFailure(op string, failure *ecr.ImageFailure) error {
+	code := ""
+	if failure.FailureCode != nil {
+		code = *failure.FailureCode
+	}
+	reason := code
+	if failure.FailureReason != nil {
+		reason = *failure.FailureReason
+	}
+	var kind error
+	if code == ecr.ImageFailureCodeImageNotFound {
+		kind = ErrImageNotFound
+	}
+	return &Error{
+		Op:   op,
+		Code: code,
+		Kind: kind,
+		Err:  errors.New(reason),
+	}
+}
+
+// sleep waits for the given delay unless ctx is done first.
+// It is a variable so that tests can avoid waiting between retries
+var sleep = func(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retry calls fn, once the rate limit of op allows it, until it succeeds, returns an error that is not retryable,
+// the maximum number of retries is reached or ctx is done.
+// The delay between two attempts grows exponentially and is fully jittered
+func (c *Client) retry(ctx context.Context, op string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := c.call(ctx, op, fn)
+		if err == nil || !IsRetryable(err) || attempt >= c.options.MaxRetries {
+			return err
+		}
+		delay := backoff(attempt, c.options.RetryBaseDelay, c.options.RetryMaxDelay)
+		log.WithError(err).WithFields(log.Fields{"operation": op, "attempt": attempt + 1, "delay": delay}).Debug("Retrying ECR call")
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// call makes a single call to the ECR API once the rate limit of the operation allows it
+// and returns its classified error
+func (c *Client) call(ctx context.Context, op string, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := c.wait(ctx, op); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := classifyError(op, fn())
+	metrics.APICallDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err == nil {
+		c.recordSuccess()
+	}
+	return err
+}
+
+// backoff returns a random duration between 0 and min(maxDelay, baseDelay * 2^attempt)
+func backoff(attempt int, baseDelay, maxDelay time.Duration) time.Duration {
+	if baseDelay <= 0 {
+		return 0
+	}
+	delay := baseDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
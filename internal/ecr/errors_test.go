@@ -0,0 +1,195 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/awstesting/mock"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+type mockPutImageClient struct {
+	ecriface.ECRAPI
+	errors []error
+	calls  int
+}
+
+func (m *mockPutImageClient) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput, opts ...request.Option) (*ecr.PutImageOutput, error) {
+	m.calls++
+	if len(m.errors) > 0 {
+		err := m.errors[0]
+		m.errors = m.errors[1:]
+		return nil, err
+	}
+	return &ecr.PutImageOutput{}, nil
+}
+
+func TestClassifyError(t *testing.T) {
+	var tests = []struct {
+		description string
+		err         error
+		expected    error
+		retryable   bool
+	}{
+		{"image not found", awserr.New(ecr.ErrCodeImageNotFoundException, "", nil), ErrImageNotFound, false},
+		{"repository not found", awserr.New(ecr.ErrCodeRepositoryNotFoundException, "", nil), ErrRepositoryNotFound, false},
+		{"tag conflict", awserr.New(ecr.ErrCodeImageTagAlreadyExistsException, "", nil), ErrTagConflict, false},
+		{"access denied", awserr.New("AccessDeniedException", "", nil), ErrAccessDenied, false},
+		{"throttled", awserr.New("ThrottlingException", "", nil), ErrThrottled, true},
+		{"server error", awserr.New(ecr.ErrCodeServerException, "", errors.New("internal error")), ErrTransient, true},
+		{"canceled", awserr.New(request.CanceledErrorCode, "", context.Canceled), context.Canceled, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := classifyError("Test", test.err)
+			if !errors.Is(err, test.expected) {
+				t.Errorf("Expected error to be '%v', but got '%v' instead", test.expected, err)
+			}
+			if IsRetryable(err) != test.retryable {
+				t.Errorf("Expected retryable to be %t for '%v'", test.retryable, err)
+			}
+			if ErrorCode(err) != test.err.(awserr.Error).Code() {
+				t.Errorf("Expected error code '%s', but got '%s' instead", test.err.(awserr.Error).Code(), ErrorCode(err))
+			}
+		})
+	}
+}
+
+func TestTaggingImagesWithRetries(t *testing.T) {
+	defer func(original func(context.Context, time.Duration) error) { sleep = original }(sleep)
+	sleep = func(context.Context, time.Duration) error { return nil }
+
+	throttled := awserr.New("ThrottlingException", "", nil)
+	var tests = []struct {
+		description string
+		errors      []error
+		maxRetries  int
+		calls       int
+		status      TagStatus
+		expected    error
+	}{
+		{"success", nil, 3, 1, TagStatusTagged, nil},
+		{"success after retries", []error{throttled, throttled}, 3, 3, TagStatusTagged, nil},
+		{"retries exhausted", []error{throttled, throttled, throttled}, 2, 3, TagStatusFailed, ErrThrottled},
+		{"not retryable", []error{awserr.New("AccessDeniedException", "", nil)}, 3, 1, TagStatusFailed, ErrAccessDenied},
+		{"already exists", []error{awserr.New(ecr.ErrCodeImageAlreadyExistsException, "", nil)}, 3, 1, TagStatusAlreadyTagged, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			mockClient := &mockPutImageClient{
+				ECRAPI: ecr.New(mock.Session),
+				errors: test.errors,
+			}
+			client := &Client{
+				ECRAPI:  mockClient,
+				options: Options{MaxRetries: test.maxRetries, RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Second},
+			}
+			images := []*ecr.Image{
+				{
+					ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("latest")},
+					RepositoryName: aws.String("test"),
+					RegistryId:     aws.String("530519006690"),
+				},
+			}
+			results := client.TagImages(context.Background(), images, "deployed")
+			if len(results) != 1 {
+				t.Fatalf("Expected 1 result, but got %d instead", len(results))
+			}
+			if results[0].Status != test.status {
+				t.Errorf("Expected status '%s', but got '%s' instead", test.status, results[0].Status)
+			}
+			if test.expected != nil && !errors.Is(results[0].Err, test.expected) {
+				t.Errorf("Expected error to be '%v', but got '%v' instead", test.expected, results[0].Err)
+			}
+			if mockClient.calls != test.calls {
+				t.Errorf("Expected %d calls to PutImage, but got %d instead", test.calls, mockClient.calls)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWhenContextIsDone(t *testing.T) {
+	throttled := awserr.New("ThrottlingException", "", nil)
+	client := &Client{
+		options: Options{MaxRetries: 5, RetryBaseDelay: time.Hour, RetryMaxDelay: time.Hour},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	calls := 0
+	err := client.retry(ctx, "PutImage", func() error {
+		calls++
+		return throttled
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected error to be '%v', but got '%v' instead", context.DeadlineExceeded, err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected 1 call, but got %d instead", calls)
+	}
+	if err := client.retry(ctx, "PutImage", func() error {
+		t.Error("Expected no call once the context is done")
+		return nil
+	}); err == nil {
+		t.Error("Expected an error once the context is done")
+	}
+}
+
+// mockPingClient counts the calls to GetAuthorizationToken, which are throttled
+type mockPingClient struct {
+	ecriface.ECRAPI
+	calls int
+}
+
+func (m *mockPingClient) GetAuthorizationTokenWithContext(ctx aws.Context, input *ecr.GetAuthorizationTokenInput, options ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	m.calls++
+	return nil, awserr.New("ThrottlingException", "", nil)
+}
+
+func TestPingIsNotRetried(t *testing.T) {
+	mockClient := &mockPingClient{}
+	client := &Client{
+		ECRAPI:  mockClient,
+		options: Options{MaxRetries: 3, RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Millisecond},
+	}
+	if err := client.Ping(context.Background()); !errors.Is(err, ErrThrottled) {
+		t.Errorf("Expected error to be '%v', but got '%v' instead", ErrThrottled, err)
+	}
+	if mockClient.calls != 1 {
+		t.Errorf("Expected 1 call to GetAuthorizationToken, but got %d instead", mockClient.calls)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := backoff(attempt, 100*time.Millisecond, time.Second)
+		if delay < 0 || delay > time.Second {
+			t.Errorf("Expected delay between 0 and 1s for attempt %d, but got %s instead", attempt, delay)
+		}
+	}
+	if delay := backoff(3, 0, time.Second); delay != 0 {
+		t.Errorf("Expected no delay without a base delay, but got %s instead", delay)
+	}
+}
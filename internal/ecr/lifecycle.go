@@ -0,0 +1,81 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// GetLifecyclePolicy returns the text of the lifecycle policy of the given repository.
+// It returns an error matching ErrLifecyclePolicyNotFound if the repository has no lifecycle policy
+func (c *Client) GetLifecyclePolicy(ctx context.Context, registryID, repository string) (string, error) {
+	input := &ecr.GetLifecyclePolicyInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repository),
+	}
+	var result *ecr.GetLifecyclePolicyOutput
+	err := c.retry(ctx, "GetLifecyclePolicy", func() (err error) {
+		result, err = c.ECRAPI.GetLifecyclePolicyWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(result.LifecyclePolicyText), nil
+}
+
+// ListImages returns the details of all images of the given repository
+func (c *Client) ListImages(ctx context.Context, registryID, repository string) ([]*ecr.ImageDetail, error) {
+	input := &ecr.DescribeImagesInput{
+		RegistryId:     aws.String(registryID),
+		RepositoryName: aws.String(repository),
+	}
+	var images []*ecr.ImageDetail
+	for {
+		var result *ecr.DescribeImagesOutput
+		err := c.retry(ctx, "DescribeImages", func() (err error) {
+			result, err = c.DescribeImagesWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, result.ImageDetails...)
+		if result.NextToken == nil {
+			return images, nil
+		}
+		input.NextToken = result.NextToken
+	}
+}
+
+// PutLifecyclePolicy sets the lifecycle policy of the given repository.
+// The default registry of the account is used if registryID is empty
+func (c *Client) PutLifecyclePolicy(ctx context.Context, registryID, repository, text string) error {
+	input := &ecr.PutLifecyclePolicyInput{
+		LifecyclePolicyText: aws.String(text),
+		RepositoryName:      aws.String(repository),
+	}
+	if registryID != "" {
+		input.RegistryId = aws.String(registryID)
+	}
+	return c.retry(ctx, "PutLifecyclePolicy", func() error {
+		_, err := c.ECRAPI.PutLifecyclePolicyWithContext(ctx, input)
+		return err
+	})
+}
@@ -0,0 +1,494 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrUnsupported is returned when the registry does not implement an optional operation of the OCI Distribution API
+var ErrUnsupported = errors.New("operation not supported by registry")
+
+// manifestMediaTypes are the media types of the manifests that are accepted from OCI registries
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// OCIOptions configures an OCIClient
+type OCIOptions struct {
+	// Username and Password authenticate the client with the registry or its token service.
+	// The client is anonymous if Username is empty
+	Username string
+	Password string
+	// PlainHTTP makes the client talk to the registry over HTTP instead of HTTPS
+	PlainHTTP bool
+	// MaxRetries is the maximum number of times a throttled or transient request is retried
+	MaxRetries int
+	// RetryBaseDelay is the delay before the first retry, it doubles with every subsequent retry
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay caps the delay between two retries
+	RetryMaxDelay time.Duration
+	// HTTPClient sends the requests, a client whose requests time out after ociRequestTimeout is used if it is nil
+	HTTPClient *http.Client
+}
+
+// ociRequestTimeout bounds the requests sent by the default HTTP client of OCIClient, so that a registry that
+// stops answering does not block the tagger
+const ociRequestTimeout = 30 * time.Second
+
+// OCIClient is a Registry talking to a registry implementing the OCI Distribution API,
+// e.g. Harbor or the distribution registry
+type OCIClient struct {
+	host    string
+	options OCIOptions
+
+	mu sync.Mutex
+	// tokens maps scopes to the bearer tokens granted by the registry's token service
+	tokens map[string]string
+	// basicAuth is set when the registry asked for basic authentication
+	basicAuth   bool
+	lastSuccess time.Time
+}
+
+// NewOCIClient instantiates a new OCIClient for the registry with the given host, e.g. registry.example.com:5000
+func NewOCIClient(host string, options OCIOptions) *OCIClient {
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: ociRequestTimeout}
+	}
+	return &OCIClient{
+		host:    host,
+		options: options,
+		tokens:  make(map[string]string),
+	}
+}
+
+// Owns reports whether the given registry ID is the registry's host
+func (c *OCIClient) Owns(registryID string) bool {
+	return registryID == c.host
+}
+
+// ParseImageName parses the name of an image from the registry and extracts its repository name and tag
+func (c *OCIClient) ParseImageName(ctx context.Context, imageName string) (*ecr.Image, error) {
+	reference := strings.TrimPrefix(imageName, c.host+"/")
+	if reference == imageName {
+		return nil, fmt.Errorf("Image '%s' is not from registry '%s'", imageName, c.host)
+	}
+	i := strings.LastIndex(reference, ":")
+	if i <= 0 || i == len(reference)-1 || strings.ContainsAny(reference, "@") || strings.Contains(reference[i:], "/") {
+		return nil, fmt.Errorf("Could not parse image name '%s'", imageName)
+	}
+	return &ecr.Image{
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(reference[i+1:])},
+		RepositoryName: aws.String(reference[:i]),
+		RegistryId:     aws.String(c.host),
+	}, nil
+}
+
+// GetImageTags returns all tags of the repository that point to the given image.
+// The Distribution API cannot list the tags of an image, so the digest of every tag of the repository is looked up
+func (c *OCIClient) GetImageTags(ctx context.Context, image *ecr.Image) ([]*string, error) {
+	repository := *image.RepositoryName
+	digest := aws.StringValue(image.ImageId.ImageDigest)
+	if digest == "" {
+		var err error
+		digest, err = c.manifestDigest(ctx, repository, *image.ImageId.ImageTag)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tags, err := c.listTags(ctx, repository)
+	if err != nil {
+		return nil, err
+	}
+	var imageTags []*string
+	for _, tag := range tags {
+		tagDigest, err := c.manifestDigest(ctx, repository, tag)
+		if err != nil {
+			// The tag was removed in the meantime
+			continue
+		}
+		if tagDigest == digest {
+			imageTags = append(imageTags, aws.String(tag))
+		}
+	}
+	return imageTags, nil
+}
+
+// GetImagesInformation returns the given images with their manifests, media types and digests.
+// Images whose manifest could not be found are left out
+func (c *OCIClient) GetImagesInformation(ctx context.Context, images []*ecr.Image) ([]*ecr.Image, error) {
+	var imageInformation []*ecr.Image
+	for _, image := range images {
+		response, err := c.do(ctx, "GetManifest", http.MethodGet, *image.RepositoryName, "manifests/"+*image.ImageId.ImageTag, "pull", nil, "")
+		if err != nil {
+			var registryErr *Error
+			if errors.As(err, &registryErr) {
+				log.WithError(err).WithField("image", FormatImageName(image)).Warn("Could not get information for image")
+				continue
+			}
+			return nil, err
+		}
+		manifest, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		information := &ecr.Image{
+			ImageId: &ecr.ImageIdentifier{
+				ImageTag:    image.ImageId.ImageTag,
+				ImageDigest: image.ImageId.ImageDigest,
+			},
+			RepositoryName:         image.RepositoryName,
+			RegistryId:             image.RegistryId,
+			ImageManifest:          aws.String(string(manifest)),
+			ImageManifestMediaType: aws.String(response.Header.Get("Content-Type")),
+		}
+		if digest := response.Header.Get("Docker-Content-Digest"); digest != "" {
+			information.ImageId.ImageDigest = aws.String(digest)
+		}
+		imageInformation = append(imageInformation, information)
+	}
+	return imageInformation, nil
+}
+
+// TagImages adds the given tag to images returned by GetImagesInformation by putting their manifest under that tag
+func (c *OCIClient) TagImages(ctx context.Context, imagesToTag []*ecr.Image, tag string) []TagResult {
+	results := make([]TagResult, 0, len(imagesToTag))
+	for _, image := range imagesToTag {
+		result := TagResult{Image: image, Tag: tag}
+		if *image.ImageId.ImageTag == tag {
+			log.WithFields(log.Fields{"image": FormatImageName(image), "newTag": tag}).Debug("Image already has tag")
+			result.Status = TagStatusAlreadyTagged
+			results = append(results, result)
+			continue
+		}
+		mediaType := aws.StringValue(image.ImageManifestMediaType)
+		if mediaType == "" {
+			mediaType = manifestMediaTypes[0]
+		}
+		manifest := []byte(aws.StringValue(image.ImageManifest))
+		response, err := c.do(ctx, "PutManifest", http.MethodPut, *image.RepositoryName, "manifests/"+tag, "pull,push", manifest, mediaType)
+		if err != nil {
+			result.Status = TagStatusFailed
+			result.Err = err
+		} else {
+			response.Body.Close()
+			result.Status = TagStatusTagged
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// UntagImage removes a tag from an image. If the digest is not empty,
+// the tag is only removed if it still points to the image with that digest.
+// Deleting tags is an optional operation of the Distribution API, ErrUnsupported is returned by registries that
+// do not implement it
+func (c *OCIClient) UntagImage(ctx context.Context, registryID, repository, digest, tag string) error {
+	if digest != "" {
+		tagDigest, err := c.manifestDigest(ctx, repository, tag)
+		if err != nil {
+			return err
+		}
+		if tagDigest != digest {
+			return &Error{
+				Op:   "DeleteManifest",
+				Code: ecr.ImageFailureCodeImageTagDoesNotMatchDigest,
+				Err:  fmt.Errorf("Tag '%s' points to image '%s'", tag, tagDigest),
+			}
+		}
+	}
+	response, err := c.do(ctx, "DeleteManifest", http.MethodDelete, repository, "manifests/"+tag, "delete", nil, "")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// LastSuccess returns the time at which a request to the registry last succeeded
+func (c *OCIClient) LastSuccess() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastSuccess
+}
+
+// Ping checks that the registry can be reached and that the client is authorized to use it
+func (c *OCIClient) Ping(ctx context.Context) error {
+	response, err := c.do(ctx, "Ping", http.MethodGet, "", "", "", nil, "")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// manifestDigest returns the digest of the manifest with the given reference
+func (c *OCIClient) manifestDigest(ctx context.Context, repository, reference string) (string, error) {
+	response, err := c.do(ctx, "HeadManifest", http.MethodHead, repository, "manifests/"+reference, "pull", nil, "")
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	digest := response.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", &Error{Op: "HeadManifest", Err: fmt.Errorf("Registry did not return the digest of '%s:%s'", repository, reference)}
+	}
+	return digest, nil
+}
+
+// linkRegex matches the Link header pointing to the next page of a paginated response
+var linkRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// listTags returns all tags of the repository, following pagination links
+func (c *OCIClient) listTags(ctx context.Context, repository string) ([]string, error) {
+	var tags []string
+	path := "tags/list"
+	for path != "" {
+		response, err := c.do(ctx, "ListTags", http.MethodGet, repository, path, "pull", nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&page)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+		path = ""
+		if match := linkRegex.FindStringSubmatch(response.Header.Get("Link")); match != nil {
+			path, err = c.linkPath(repository, match[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tags, nil
+}
+
+// linkPath returns the path of a pagination link relative to the repository's endpoint.
+// The link is either relative to the host, e.g. /v2/repository/tags/list?last=tag&n=100,
+// or an absolute URL on the registry's host
+func (c *OCIClient) linkPath(repository, link string) (string, error) {
+	linkURL, err := url.Parse(link)
+	if err != nil {
+		return "", fmt.Errorf("Could not parse link '%s': %v", link, err)
+	}
+	if linkURL.Host != "" && linkURL.Host != c.host {
+		return "", fmt.Errorf("Link '%s' points to another host than '%s'", link, c.host)
+	}
+	prefix := "/v2/" + repository + "/"
+	if !strings.HasPrefix(linkURL.Path, prefix) {
+		return "", fmt.Errorf("Link '%s' points outside of repository '%s'", link, repository)
+	}
+	path := strings.TrimPrefix(linkURL.Path, prefix)
+	if linkURL.RawQuery != "" {
+		path += "?" + linkURL.RawQuery
+	}
+	return path, nil
+}
+
+// do sends a request to the given path of the repository's endpoint, or to the base endpoint if repository is empty.
+// If the registry asks for authentication, the client authenticates for the given actions on the repository
+// and sends the request again. Throttled and transient failures are retried.
+// The caller has to close the body of the returned response
+func (c *OCIClient) do(ctx context.Context, op, method, repository, path, actions string, body []byte, contentType string) (*http.Response, error) {
+	scheme := "https"
+	if c.options.PlainHTTP {
+		scheme = "http"
+	}
+	endpoint := fmt.Sprintf("%s://%s/v2/", scheme, c.host)
+	scope := ""
+	if repository != "" {
+		endpoint += repository + "/" + path
+		scope = fmt.Sprintf("repository:%s:%s", repository, actions)
+	}
+	authenticated := false
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if contentType != "" {
+			request.Header.Set("Content-Type", contentType)
+		}
+		c.authorize(request, scope)
+		response, err := c.options.HTTPClient.Do(request)
+		if err != nil {
+			err = &Error{Op: op, Kind: ErrTransient, Err: err}
+		} else if response.StatusCode == http.StatusUnauthorized && !authenticated {
+			challenge := response.Header.Get("WWW-Authenticate")
+			drain(response)
+			if err := c.authenticate(ctx, op, challenge, scope); err != nil {
+				return nil, err
+			}
+			authenticated = true
+			attempt--
+			continue
+		} else if response.StatusCode >= 400 {
+			err = responseError(op, response)
+			drain(response)
+		} else {
+			c.mu.Lock()
+			c.lastSuccess = time.Now()
+			c.mu.Unlock()
+			return response, nil
+		}
+		if !IsRetryable(err) || attempt >= c.options.MaxRetries {
+			return nil, err
+		}
+		delay := backoff(attempt, c.options.RetryBaseDelay, c.options.RetryMaxDelay)
+		log.WithError(err).WithFields(log.Fields{"operation": op, "attempt": attempt + 1, "delay": delay}).Debug("Retrying registry request")
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *OCIClient) authorize(request *http.Request, scope string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token, ok := c.tokens[scope]; ok {
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basicAuth {
+		request.SetBasicAuth(c.options.Username, c.options.Password)
+	}
+}
+
+// challengeParamRegex matches the parameters of a WWW-Authenticate header, e.g. realm="https://auth.example.com/token"
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate answers the given WWW-Authenticate challenge, either by using basic authentication for the next
+// requests, or by getting a bearer token for the scope from the registry's token service
+func (c *OCIClient) authenticate(ctx context.Context, op, challenge, scope string) error {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	accessDenied := &Error{Op: op, Code: "UNAUTHORIZED", Kind: ErrAccessDenied, Err: fmt.Errorf("Registry '%s' requires authentication", c.host)}
+	switch scheme {
+	case "basic":
+		if c.options.Username == "" {
+			return accessDenied
+		}
+		c.mu.Lock()
+		c.basicAuth = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+	default:
+		return accessDenied
+	}
+	params := make(map[string]string)
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if scope != "" {
+		query.Set("scope", scope)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.options.Username != "" {
+		request.SetBasicAuth(c.options.Username, c.options.Password)
+	}
+	response, err := c.options.HTTPClient.Do(request)
+	if err != nil {
+		return &Error{Op: op, Kind: ErrTransient, Err: err}
+	}
+	defer drain(response)
+	if response.StatusCode >= 400 {
+		return responseError(op, response)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[scope] = token.Token
+	return nil
+}
+
+// responseError converts an error response of the Distribution API to an Error
+func responseError(op string, response *http.Response) error {
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	code, message := "", response.Status
+	if err := json.NewDecoder(response.Body).Decode(&body); err == nil && len(body.Errors) > 0 {
+		code, message = body.Errors[0].Code, body.Errors[0].Message
+	}
+	var kind error
+	switch {
+	case code == "NAME_UNKNOWN":
+		kind = ErrRepositoryNotFound
+	case response.StatusCode == http.StatusNotFound:
+		kind = ErrImageNotFound
+	case response.StatusCode == http.StatusUnauthorized, response.StatusCode == http.StatusForbidden:
+		kind = ErrAccessDenied
+	case response.StatusCode == http.StatusTooManyRequests:
+		kind = ErrThrottled
+	case response.StatusCode == http.StatusMethodNotAllowed, code == "UNSUPPORTED":
+		kind = ErrUnsupported
+	case response.StatusCode >= 500:
+		kind = ErrTransient
+	}
+	if code == "" {
+		code = http.StatusText(response.StatusCode)
+	}
+	return &Error{Op: op, Code: code, Kind: kind, Err: errors.New(message)}
+}
+
+// drain reads the rest of the response's body so that the connection can be reused, and closes it
+func drain(response *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+}
@@ -0,0 +1,376 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testManifest = `{"schemaVersion": 2, "mediaType": "application/vnd.docker.distribution.manifest.v2+json"}`
+
+// fakeDistributionRegistry is a stand-in for the distribution registry with token authentication.
+// It only stores manifests, by repository and tag
+type fakeDistributionRegistry struct {
+	mu        sync.Mutex
+	manifests map[string]map[string]string
+	// deleteTags makes the registry accept deleting tags, like Harbor does
+	deleteTags bool
+	// absoluteLinks makes the registry return pagination links with the scheme and host
+	absoluteLinks bool
+	server        *httptest.Server
+}
+
+func newFakeDistributionRegistry(deleteTags bool) *fakeDistributionRegistry {
+	r := &fakeDistributionRegistry{manifests: make(map[string]map[string]string), deleteTags: deleteTags}
+	r.server = httptest.NewServer(r)
+	return r
+}
+
+func (r *fakeDistributionRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *fakeDistributionRegistry) writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": []map[string]string{{"code": code, "message": code}}})
+}
+
+func (r *fakeDistributionRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		if username, password, ok := req.BasicAuth(); !ok || username != "user" || password != "secret" {
+			r.writeError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "token-for-" + req.URL.Query().Get("scope")})
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	scope := ""
+	if i := strings.LastIndex(path, "/manifests/"); i >= 0 {
+		scope = "repository:" + path[:i] + ":"
+	} else if strings.HasSuffix(path, "/tags/list") {
+		scope = "repository:" + strings.TrimSuffix(path, "/tags/list") + ":"
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer token-for-"+scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry"`, r.server.URL))
+		r.writeError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return
+	}
+	switch {
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+	case strings.HasSuffix(path, "/tags/list"):
+		repository := strings.TrimSuffix(path, "/tags/list")
+		var tags []string
+		for tag := range r.manifests[repository] {
+			if tag > req.URL.Query().Get("last") {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+		// Return one tag per page to exercise pagination
+		if len(tags) > 1 {
+			link := fmt.Sprintf("/v2/%s/tags/list?last=%s&n=1", repository, tags[0])
+			if r.absoluteLinks {
+				link = "http://" + req.Host + link
+			}
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, link))
+			tags = tags[:1]
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": tags})
+	default:
+		i := strings.LastIndex(path, "/manifests/")
+		repository, reference := path[:i], path[i+len("/manifests/"):]
+		tags, ok := r.manifests[repository]
+		if !ok {
+			r.writeError(w, http.StatusNotFound, "NAME_UNKNOWN")
+			return
+		}
+		switch req.Method {
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(req.Body)
+			tags[reference] = string(body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		case http.MethodDelete:
+			if !r.deleteTags {
+				r.writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+				return
+			}
+			delete(tags, reference)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		manifest, ok := tags[reference]
+		if !ok {
+			r.writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write([]byte(manifest))
+		}
+	}
+}
+
+func TestOCIParseImageName(t *testing.T) {
+	client := NewOCIClient("registry.example.com:5000", OCIOptions{})
+	var tests = []struct {
+		description string
+		imageName   string
+		expected    *ecr.Image
+	}{
+		{"nested repository", "registry.example.com:5000/team/app:v1", &ecr.Image{
+			ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("v1")},
+			RepositoryName: aws.String("team/app"),
+			RegistryId:     aws.String("registry.example.com:5000"),
+		}},
+		{"other registry", "docker.io/library/nginx:latest", nil},
+		{"no tag", "registry.example.com:5000/team/app", nil},
+		{"digest", "registry.example.com:5000/team/app@sha256:1234", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, err := client.ParseImageName(context.Background(), test.imageName)
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("Expected an error, but got '%v' instead", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(actual, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", actual, diff)
+			}
+		})
+	}
+}
+
+func TestOCIClient(t *testing.T) {
+	registry := newFakeDistributionRegistry(true)
+	defer registry.server.Close()
+	registry.manifests["team/app"] = map[string]string{"v1": testManifest, "v2": `{"schemaVersion": 2}`}
+	client := NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "secret", PlainHTTP: true})
+
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	image, err := client.ParseImageName(context.Background(), registry.host()+"/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	information, err := client.GetImagesInformation(context.Background(), []*ecr.Image{image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(information) != 1 || aws.StringValue(information[0].ImageManifest) != testManifest {
+		t.Fatalf("Expected image manifest '%s', but got '%v' instead", testManifest, information)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testManifest)))
+	if actual := aws.StringValue(information[0].ImageId.ImageDigest); actual != digest {
+		t.Errorf("Expected digest '%s', but got '%s' instead", digest, actual)
+	}
+
+	results := client.TagImages(context.Background(), information, "deployed1")
+	if len(results) != 1 || results[0].Status != TagStatusTagged {
+		t.Fatalf("Expected image to be tagged, but got '%v' instead", results)
+	}
+	tags, err := client.GetImageTags(context.Background(), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(aws.StringValueSlice(tags), []string{"deployed1", "v1"}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", tags, diff)
+	}
+
+	err = client.UntagImage(context.Background(), registry.host(), "team/app", "sha256:1234", "deployed1")
+	if code := ErrorCode(err); code != ecr.ImageFailureCodeImageTagDoesNotMatchDigest {
+		t.Errorf("Expected error code '%s', but got '%v' instead", ecr.ImageFailureCodeImageTagDoesNotMatchDigest, err)
+	}
+	if err := client.UntagImage(context.Background(), registry.host(), "team/app", digest, "deployed1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := registry.manifests["team/app"]["deployed1"]; ok {
+		t.Error("Expected tag to be deleted")
+	}
+
+	// HEAD responses have no body telling missing repositories and manifests apart
+	missing, _ := client.ParseImageName(context.Background(), registry.host()+"/missing:v1")
+	if _, err := client.GetImageTags(context.Background(), missing); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Expected image not found error, but got '%v' instead", err)
+	}
+}
+
+func TestOCIClientAbsoluteLinks(t *testing.T) {
+	registry := newFakeDistributionRegistry(false)
+	defer registry.server.Close()
+	registry.absoluteLinks = true
+	registry.manifests["team/app"] = map[string]string{"v1": testManifest, "v2": testManifest, "v3": `{"schemaVersion": 2}`}
+	client := NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "secret", PlainHTTP: true})
+	if client.options.HTTPClient.Timeout != ociRequestTimeout {
+		t.Errorf("Expected requests to time out after %s, but got %s instead", ociRequestTimeout, client.options.HTTPClient.Timeout)
+	}
+
+	image, err := client.ParseImageName(context.Background(), registry.host()+"/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := client.GetImageTags(context.Background(), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(aws.StringValueSlice(tags), []string{"v1", "v2"}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", tags, diff)
+	}
+}
+
+func TestLinkPath(t *testing.T) {
+	var tests = []struct {
+		description string
+		link        string
+		expected    string
+		valid       bool
+	}{
+		{"relative", "/v2/team/app/tags/list?last=v1&n=1", "tags/list?last=v1&n=1", true},
+		{"absolute", "https://registry.example.com/v2/team/app/tags/list?last=v1&n=1", "tags/list?last=v1&n=1", true},
+		{"other host", "https://other.example.com/v2/team/app/tags/list?last=v1&n=1", "", false},
+		{"other repository", "/v2/team/other/tags/list?last=v1&n=1", "", false},
+	}
+
+	client := NewOCIClient("registry.example.com", OCIOptions{})
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path, err := client.linkPath("team/app", test.link)
+			if (err == nil) != test.valid {
+				t.Fatalf("Expected link to be valid to be %t, but got error '%v' instead", test.valid, err)
+			}
+			if path != test.expected {
+				t.Errorf("Expected path '%s', but got '%s' instead", test.expected, path)
+			}
+		})
+	}
+}
+
+func TestOCIClientErrors(t *testing.T) {
+	registry := newFakeDistributionRegistry(false)
+	defer registry.server.Close()
+	registry.manifests["team/app"] = map[string]string{"v1": testManifest}
+
+	client := NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "wrong", PlainHTTP: true})
+	if err := client.Ping(context.Background()); !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("Expected access denied error, but got '%v' instead", err)
+	}
+
+	client = NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "secret", PlainHTTP: true})
+	if err := client.UntagImage(context.Background(), registry.host(), "team/app", "", "v1"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected unsupported error, but got '%v' instead", err)
+	}
+}
+
+func TestRegistries(t *testing.T) {
+	registry := newFakeDistributionRegistry(true)
+	defer registry.server.Close()
+	registry.manifests["team/app"] = map[string]string{"v1": testManifest}
+	ecrClient := &Client{ECRAPI: &mockBatchDeleteImageClient{}}
+	registries := Registries{ecrClient, NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "secret", PlainHTTP: true})}
+
+	image, err := registries.ParseImageName(context.Background(), registry.host()+"/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(image.RegistryId) != registry.host() {
+		t.Errorf("Expected registry '%s', but got '%s' instead", registry.host(), aws.StringValue(image.RegistryId))
+	}
+	image, err = registries.ParseImageName(context.Background(), "530519006690.dkr.ecr.eu-central-1.amazonaws.com/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(image.RegistryId) != "530519006690" {
+		t.Errorf("Expected registry '530519006690', but got '%s' instead", aws.StringValue(image.RegistryId))
+	}
+	if _, err := registries.ParseImageName(context.Background(), "docker.io/library/nginx:latest"); err == nil {
+		t.Error("Expected an error for an image from an unknown registry")
+	}
+
+	if err := registries.UntagImage(context.Background(), "530519006690", "app", "", "deployed1"); err != nil {
+		t.Error(err)
+	}
+	if err := registries.UntagImage(context.Background(), registry.host(), "team/app", "", "v1"); err != nil {
+		t.Error(err)
+	}
+	if err := registries.UntagImage(context.Background(), "unknown.example.com", "app", "", "v1"); err == nil {
+		t.Error("Expected an error for an unknown registry")
+	}
+}
+
+// mockFailingBatchGetImageClient fails to get the manifests of any image
+type mockFailingBatchGetImageClient struct {
+	ecriface.ECRAPI
+}
+
+func (m *mockFailingBatchGetImageClient) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput, opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+	return nil, awserr.New("AccessDeniedException", "User is not authorized to perform ecr:BatchGetImage", nil)
+}
+
+func TestRegistriesGetImagesInformation(t *testing.T) {
+	registry := newFakeDistributionRegistry(false)
+	defer registry.server.Close()
+	registry.manifests["team/app"] = map[string]string{"v1": testManifest}
+	ecrClient := &Client{ECRAPI: &mockFailingBatchGetImageClient{}}
+	ociClient := NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "secret", PlainHTTP: true})
+	registries := Registries{ecrClient, ociClient}
+
+	ecrImage, err := registries.ParseImageName(context.Background(), "530519006690.dkr.ecr.eu-central-1.amazonaws.com/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ociImage, err := registries.ParseImageName(context.Background(), registry.host()+"/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifests of the OCI registry are returned although the ECR registry fails
+	information, err := registries.GetImagesInformation(context.Background(), []*ecr.Image{ecrImage, ociImage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(information) != 1 || aws.StringValue(information[0].RegistryId) != registry.host() {
+		t.Errorf("Expected the image of '%s' only, but got '%v' instead", registry.host(), information)
+	}
+}
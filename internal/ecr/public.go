@@ -0,0 +1,335 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/aws/aws-sdk-go/service/ecrpublic/ecrpubliciface"
+	log "github.com/sirupsen/logrus"
+)
+
+// publicRegistryHost is the host of ECR Public
+const publicRegistryHost = "public.ecr.aws"
+
+var publicRegex = regexp.MustCompile(`^public\.ecr\.aws/(?P<alias>[a-z0-9][a-z0-9._-]*)/(?P<repository>.+):(?P<tag>[^:/]+)$`)
+
+// PublicClient is a Registry for the repositories of the account's ECR Public registries.
+// Images from the public registries of other accounts cannot be tagged, their names are not parsed.
+// The registry ID of the images is public.ecr.aws/ALIAS, where ALIAS is the alias of their registry
+type PublicClient struct {
+	ecrpubliciface.ECRPublicAPI
+	// base limits, retries and records the calls to the ECR Public API
+	base *Client
+	// manifests gets the manifests of images, which the ECR Public API does not return
+	manifests *OCIClient
+
+	mu sync.Mutex
+	// registryIDs maps the aliases of the account's public registries to their registry IDs
+	registryIDs map[string]string
+	// listing is closed once the registries being listed are known, it is nil when they are not being listed
+	listing chan struct{}
+	// listErr is the error with which listing the registries last failed at failedAt
+	listErr  error
+	failedAt time.Time
+}
+
+// registriesRetryPeriod is how long the error with which listing the public registries failed is returned
+// before they are listed again
+const registriesRetryPeriod = time.Minute
+
+// NewPublicClient instantiates a new PublicClient
+func NewPublicClient(options Options) (*PublicClient, error) {
+	// Retries are handled by the Client itself. The ECR Public API is only available in us-east-1
+	config := aws.NewConfig().WithMaxRetries(0).WithRegion("us-east-1")
+
+	currentSession, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &PublicClient{
+		ECRPublicAPI: ecrpublic.New(currentSession),
+		base: &Client{
+			options:  options,
+			limiters: newLimiters(options.RateLimits),
+		},
+		manifests: NewOCIClient(publicRegistryHost, OCIOptions{
+			MaxRetries:     options.MaxRetries,
+			RetryBaseDelay: options.RetryBaseDelay,
+			RetryMaxDelay:  options.RetryMaxDelay,
+		}),
+	}
+
+	return client, nil
+}
+
+// Owns reports whether the given registry ID is the one of a public registry
+func (c *PublicClient) Owns(registryID string) bool {
+	return strings.HasPrefix(registryID, publicRegistryHost+"/")
+}
+
+// ParseImageName parses the name of an image from one of the account's public registries
+// and extracts the registry alias, repository name and tag from it
+func (c *PublicClient) ParseImageName(ctx context.Context, imageName string) (*ecr.Image, error) {
+	match := publicRegex.FindStringSubmatch(imageName)
+	if match == nil {
+		return nil, fmt.Errorf("Could not parse image name '%s'", imageName)
+	}
+	if _, err := c.registryID(ctx, match[1]); err != nil {
+		return nil, err
+	}
+	image := &ecr.Image{
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String(match[3])},
+		RepositoryName: aws.String(match[2]),
+		RegistryId:     aws.String(publicRegistryHost + "/" + match[1]),
+	}
+	return image, nil
+}
+
+// GetImageTags returns all tags of the given image
+func (c *PublicClient) GetImageTags(ctx context.Context, image *ecr.Image) ([]*string, error) {
+	registryID, err := c.registryID(ctx, strings.TrimPrefix(*image.RegistryId, publicRegistryHost+"/"))
+	if err != nil {
+		return nil, err
+	}
+	describeInput := &ecrpublic.DescribeImagesInput{
+		ImageIds:       []*ecrpublic.ImageIdentifier{{ImageTag: image.ImageId.ImageTag}},
+		RepositoryName: image.RepositoryName,
+		RegistryId:     aws.String(registryID),
+	}
+	var result *ecrpublic.DescribeImagesOutput
+	err = c.base.retry(ctx, "DescribeImages", func() (err error) {
+		result, err = c.DescribeImagesWithContext(ctx, describeInput)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var imageTags []*string
+	for _, imageDetail := range result.ImageDetails {
+		imageTags = append(imageTags, imageDetail.ImageTags...)
+	}
+	return imageTags, nil
+}
+
+// GetImagesInformation returns the given images with their manifests, which are fetched from public.ecr.aws
+func (c *PublicClient) GetImagesInformation(ctx context.Context, images []*ecr.Image) ([]*ecr.Image, error) {
+	var imageInformation []*ecr.Image
+	for _, image := range images {
+		// The repositories of public.ecr.aws are prefixed with the alias of their registry
+		alias := strings.TrimPrefix(*image.RegistryId, publicRegistryHost+"/")
+		publicImage := &ecr.Image{
+			ImageId:        image.ImageId,
+			RepositoryName: aws.String(alias + "/" + *image.RepositoryName),
+			RegistryId:     aws.String(publicRegistryHost),
+		}
+		information, err := c.manifests.GetImagesInformation(ctx, []*ecr.Image{publicImage})
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range information {
+			info.RepositoryName = image.RepositoryName
+			info.RegistryId = image.RegistryId
+		}
+		imageInformation = append(imageInformation, information...)
+	}
+	return imageInformation, nil
+}
+
+// TagImages adds the given tag to images returned by GetImagesInformation
+func (c *PublicClient) TagImages(ctx context.Context, imagesToTag []*ecr.Image, tag string) []TagResult {
+	results := make([]TagResult, 0, len(imagesToTag))
+	for _, image := range imagesToTag {
+		result := TagResult{Image: image, Tag: tag}
+		if *image.ImageId.ImageTag == tag {
+			log.WithFields(log.Fields{"image": FormatImageName(image), "newTag": tag}).Debug("Image already has tag")
+			result.Status = TagStatusAlreadyTagged
+			results = append(results, result)
+			continue
+		}
+		registryID, err := c.registryID(ctx, strings.TrimPrefix(*image.RegistryId, publicRegistryHost+"/"))
+		if err == nil {
+			putInput := &ecrpublic.PutImageInput{
+				ImageManifest:          image.ImageManifest,
+				ImageManifestMediaType: image.ImageManifestMediaType,
+				ImageTag:               aws.String(tag),
+				RepositoryName:         image.RepositoryName,
+				RegistryId:             aws.String(registryID),
+			}
+			err = c.base.retry(ctx, "PutImage", func() error {
+				_, err := c.PutImageWithContext(ctx, putInput)
+				return err
+			})
+		}
+		switch {
+		case err == nil:
+			result.Status = TagStatusTagged
+		case ErrorCode(err) == ecrpublic.ErrCodeImageAlreadyExistsException:
+			// The image already carries the tag
+			result.Status = TagStatusAlreadyTagged
+		default:
+			result.Status = TagStatusFailed
+			result.Err = err
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// UntagImage removes the given tag from an image of the repository with BatchDeleteImage.
+// If the digest is not empty, the tag is only removed if it still points to the image with that digest.
+// ECR Public deletes images whose last tag is removed, so the last tag of an image is never removed
+func (c *PublicClient) UntagImage(ctx context.Context, registryID, repository, digest, tag string) error {
+	publicRegistryID, err := c.registryID(ctx, strings.TrimPrefix(registryID, publicRegistryHost+"/"))
+	if err != nil {
+		return err
+	}
+	imageID := &ecrpublic.ImageIdentifier{ImageTag: aws.String(tag)}
+	describeID := imageID
+	if digest != "" {
+		imageID.ImageDigest = aws.String(digest)
+		describeID = &ecrpublic.ImageIdentifier{ImageDigest: aws.String(digest)}
+	}
+	describeInput := &ecrpublic.DescribeImagesInput{
+		ImageIds:       []*ecrpublic.ImageIdentifier{describeID},
+		RepositoryName: aws.String(repository),
+		RegistryId:     aws.String(publicRegistryID),
+	}
+	var described *ecrpublic.DescribeImagesOutput
+	err = c.base.retry(ctx, "DescribeImages", func() (err error) {
+		described, err = c.DescribeImagesWithContext(ctx, describeInput)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, imageDetail := range described.ImageDetails {
+		if isLastTag(imageDetail.ImageTags, tag) {
+			return ErrLastTag
+		}
+	}
+	input := &ecrpublic.BatchDeleteImageInput{
+		RegistryId:     aws.String(publicRegistryID),
+		RepositoryName: aws.String(repository),
+		ImageIds:       []*ecrpublic.ImageIdentifier{imageID},
+	}
+	var output *ecrpublic.BatchDeleteImageOutput
+	err = c.base.retry(ctx, "BatchDeleteImage", func() error {
+		var err error
+		output, err = c.BatchDeleteImageWithContext(ctx, input)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(output.Failures) > 0 {
+		return classifyFailure("BatchDeleteImage", &ecr.ImageFailure{
+			FailureCode:   output.Failures[0].FailureCode,
+			FailureReason: output.Failures[0].FailureReason,
+		})
+	}
+	return nil
+}
+
+// LastSuccess returns the time at which a call to the ECR Public API last succeeded
+func (c *PublicClient) LastSuccess() time.Time {
+	return c.base.LastSuccess()
+}
+
+// registryID returns the ID of the account's public registry with the given alias.
+// The aliases are listed once with DescribeRegistries, without holding the lock so that concurrent callers
+// can give up waiting for them. A failure is returned to the callers for a minute before trying again
+func (c *PublicClient) registryID(ctx context.Context, alias string) (string, error) {
+	for {
+		c.mu.Lock()
+		if c.registryIDs != nil {
+			registryID, ok := c.registryIDs[alias]
+			c.mu.Unlock()
+			if !ok {
+				return "", fmt.Errorf("Public registry '%s' does not belong to the account", alias)
+			}
+			return registryID, nil
+		}
+		if listing := c.listing; listing != nil {
+			c.mu.Unlock()
+			select {
+			case <-listing:
+				continue
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+		if c.listErr != nil && time.Since(c.failedAt) < registriesRetryPeriod {
+			err := c.listErr
+			c.mu.Unlock()
+			return "", err
+		}
+		listing := make(chan struct{})
+		c.listing = listing
+		c.mu.Unlock()
+
+		registryIDs, err := c.listRegistries(ctx)
+
+		c.mu.Lock()
+		c.listing = nil
+		close(listing)
+		if err != nil {
+			// Calls cut short by the caller say nothing about the registries
+			if ctx.Err() == nil {
+				c.listErr, c.failedAt = err, time.Now()
+			}
+			c.mu.Unlock()
+			return "", err
+		}
+		c.registryIDs = registryIDs
+		c.mu.Unlock()
+	}
+}
+
+// listRegistries maps the aliases of the account's public registries to their registry IDs
+func (c *PublicClient) listRegistries(ctx context.Context) (map[string]string, error) {
+	registryIDs := make(map[string]string)
+	input := &ecrpublic.DescribeRegistriesInput{}
+	for {
+		var output *ecrpublic.DescribeRegistriesOutput
+		err := c.base.retry(ctx, "DescribeRegistries", func() (err error) {
+			output, err = c.DescribeRegistriesWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, registry := range output.Registries {
+			for _, registryAlias := range registry.Aliases {
+				registryIDs[aws.StringValue(registryAlias.Name)] = aws.StringValue(registry.RegistryId)
+			}
+		}
+		if output.NextToken == nil {
+			return registryIDs, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/ecrpublic"
+	"github.com/aws/aws-sdk-go/service/ecrpublic/ecrpubliciface"
+	"github.com/google/go-cmp/cmp"
+)
+
+// mockECRPublicClient owns the public registry with the alias "team" and records the images it is asked to put
+type mockECRPublicClient struct {
+	ecrpubliciface.ECRPublicAPI
+	describeRegistriesCalls int
+	putImages               []*ecrpublic.PutImageInput
+	deleteImages            []*ecrpublic.BatchDeleteImageInput
+}
+
+func (m *mockECRPublicClient) DescribeRegistriesWithContext(ctx aws.Context, input *ecrpublic.DescribeRegistriesInput, opts ...request.Option) (*ecrpublic.DescribeRegistriesOutput, error) {
+	m.describeRegistriesCalls++
+	if input.NextToken == nil {
+		return &ecrpublic.DescribeRegistriesOutput{NextToken: aws.String("next")}, nil
+	}
+	return &ecrpublic.DescribeRegistriesOutput{
+		Registries: []*ecrpublic.Registry{{
+			RegistryId: aws.String("123456789012"),
+			Aliases:    []*ecrpublic.RegistryAlias{{Name: aws.String("team")}},
+		}},
+	}, nil
+}
+
+func (m *mockECRPublicClient) DescribeImagesWithContext(ctx aws.Context, input *ecrpublic.DescribeImagesInput, opts ...request.Option) (*ecrpublic.DescribeImagesOutput, error) {
+	return &ecrpublic.DescribeImagesOutput{
+		ImageDetails: []*ecrpublic.ImageDetail{{ImageTags: aws.StringSlice([]string{"v1", "deployed1"})}},
+	}, nil
+}
+
+func (m *mockECRPublicClient) PutImageWithContext(ctx aws.Context, input *ecrpublic.PutImageInput, opts ...request.Option) (*ecrpublic.PutImageOutput, error) {
+	m.putImages = append(m.putImages, input)
+	return &ecrpublic.PutImageOutput{}, nil
+}
+
+func (m *mockECRPublicClient) BatchDeleteImageWithContext(ctx aws.Context, input *ecrpublic.BatchDeleteImageInput, opts ...request.Option) (*ecrpublic.BatchDeleteImageOutput, error) {
+	m.deleteImages = append(m.deleteImages, input)
+	if aws.StringValue(input.ImageIds[0].ImageDigest) != "sha256:1234" {
+		return &ecrpublic.BatchDeleteImageOutput{
+			Failures: []*ecrpublic.ImageFailure{{FailureCode: aws.String(ecrpublic.ImageFailureCodeImageNotFound)}},
+		}, nil
+	}
+	return &ecrpublic.BatchDeleteImageOutput{}, nil
+}
+
+func TestPublicParseImageName(t *testing.T) {
+	mock := &mockECRPublicClient{}
+	client := &PublicClient{ECRPublicAPI: mock, base: &Client{}}
+
+	var tests = []struct {
+		description string
+		imageName   string
+		expected    *ecr.Image
+	}{
+		{
+			"owned registry",
+			"public.ecr.aws/team/tools/app:v1",
+			&ecr.Image{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("v1")},
+				RepositoryName: aws.String("tools/app"),
+				RegistryId:     aws.String("public.ecr.aws/team"),
+			},
+		},
+		{"registry of another account", "public.ecr.aws/docker/library/nginx:latest", nil},
+		{"no tag", "public.ecr.aws/team/app", nil},
+		{"private registry", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/app:v1", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			image, err := client.ParseImageName(context.Background(), test.imageName)
+			if test.expected == nil {
+				if err == nil {
+					t.Errorf("Expected an error, but got '%v' instead", image)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(image, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", image, diff)
+			}
+		})
+	}
+	if mock.describeRegistriesCalls != 2 {
+		t.Errorf("Expected the registries to be listed once in 2 pages, but got %d calls instead", mock.describeRegistriesCalls)
+	}
+	if !client.Owns("public.ecr.aws/team") || client.Owns("123456789012") {
+		t.Error("Expected the client to own public registries only")
+	}
+}
+
+// mockBlockingECRPublicClient fails to list the registries once release is closed
+type mockBlockingECRPublicClient struct {
+	ecrpubliciface.ECRPublicAPI
+	release chan struct{}
+	calls   int32
+}
+
+func (m *mockBlockingECRPublicClient) DescribeRegistriesWithContext(ctx aws.Context, input *ecrpublic.DescribeRegistriesInput, opts ...request.Option) (*ecrpublic.DescribeRegistriesOutput, error) {
+	atomic.AddInt32(&m.calls, 1)
+	<-m.release
+	return nil, errors.New("AccessDeniedException")
+}
+
+func TestPublicRegistryIDFailure(t *testing.T) {
+	mock := &mockBlockingECRPublicClient{release: make(chan struct{})}
+	client := &PublicClient{ECRPublicAPI: mock, base: &Client{}}
+
+	listed := make(chan error)
+	go func() {
+		_, err := client.registryID(context.Background(), "team")
+		listed <- err
+	}()
+	// The registries are being listed, a caller whose context is done does not wait for them
+	for atomic.LoadInt32(&mock.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := client.registryID(ctx, "team"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context canceled error, but got '%v' instead", err)
+	}
+	close(mock.release)
+	if err := <-listed; err == nil {
+		t.Fatal("Expected an error while listing the registries")
+	}
+
+	// The failure is returned without listing the registries again until the retry period is over
+	if _, err := client.registryID(context.Background(), "team"); err == nil {
+		t.Error("Expected the failure to be returned")
+	}
+	if calls := atomic.LoadInt32(&mock.calls); calls != 1 {
+		t.Errorf("Expected the registries to be listed once, but got %d calls instead", calls)
+	}
+	client.failedAt = time.Now().Add(-registriesRetryPeriod)
+	_, _ = client.registryID(context.Background(), "team")
+	if calls := atomic.LoadInt32(&mock.calls); calls != 2 {
+		t.Errorf("Expected the registries to be listed again after the retry period, but got %d calls instead", calls)
+	}
+}
+
+func TestPublicClient(t *testing.T) {
+	// public.ecr.aws is played by a fake registry prefixing repositories with the registry alias
+	registry := newFakeDistributionRegistry(true)
+	defer registry.server.Close()
+	registry.manifests["team/app"] = map[string]string{"v1": testManifest}
+	mock := &mockECRPublicClient{}
+	client := &PublicClient{
+		ECRPublicAPI: mock,
+		base:         &Client{},
+		manifests:    NewOCIClient(registry.host(), OCIOptions{Username: "user", Password: "secret", PlainHTTP: true}),
+	}
+
+	image, err := client.ParseImageName(context.Background(), "public.ecr.aws/team/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := client.GetImageTags(context.Background(), image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(aws.StringValueSlice(tags), []string{"v1", "deployed1"}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", tags, diff)
+	}
+	information, err := client.GetImagesInformation(context.Background(), []*ecr.Image{image})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(information) != 1 || aws.StringValue(information[0].ImageManifest) != testManifest {
+		t.Fatalf("Expected image manifest '%s', but got '%v' instead", testManifest, information)
+	}
+	if actual := aws.StringValue(information[0].RepositoryName); actual != "app" {
+		t.Errorf("Expected repository 'app', but got '%s' instead", actual)
+	}
+	if actual := aws.StringValue(information[0].RegistryId); actual != "public.ecr.aws/team" {
+		t.Errorf("Expected registry 'public.ecr.aws/team', but got '%s' instead", actual)
+	}
+
+	results := client.TagImages(context.Background(), information, "deployed2")
+	if len(results) != 1 || results[0].Status != TagStatusTagged {
+		t.Fatalf("Expected image to be tagged, but got '%v' instead", results)
+	}
+	expected := &ecrpublic.PutImageInput{
+		ImageManifest:          aws.String(testManifest),
+		ImageManifestMediaType: information[0].ImageManifestMediaType,
+		ImageTag:               aws.String("deployed2"),
+		RepositoryName:         aws.String("app"),
+		RegistryId:             aws.String("123456789012"),
+	}
+	if diff := cmp.Diff(mock.putImages, []*ecrpublic.PutImageInput{expected}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", mock.putImages, diff)
+	}
+
+	if err := client.UntagImage(context.Background(), "public.ecr.aws/team", "app", "sha256:1234", "deployed1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UntagImage(context.Background(), "public.ecr.aws/team", "app", "sha256:5678", "deployed1"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Expected image not found error, but got '%v' instead", err)
+	}
+	if actual := aws.StringValue(mock.deleteImages[0].RegistryId); actual != "123456789012" {
+		t.Errorf("Expected registry ID '123456789012', but got '%s' instead", actual)
+	}
+}
+
+// mockPullThroughECRClient has a pull through cache rule for quay.io in the registry 123456789012 only
+type mockPullThroughECRClient struct {
+	ecriface.ECRAPI
+	calls int
+}
+
+func (m *mockPullThroughECRClient) DescribePullThroughCacheRulesWithContext(ctx aws.Context, input *ecr.DescribePullThroughCacheRulesInput, opts ...request.Option) (*ecr.DescribePullThroughCacheRulesOutput, error) {
+	m.calls++
+	if aws.StringValue(input.RegistryId) != "123456789012" {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return &ecr.DescribePullThroughCacheRulesOutput{
+		PullThroughCacheRules: []*ecr.PullThroughCacheRule{
+			{EcrRepositoryPrefix: aws.String("quay"), UpstreamRegistryUrl: aws.String("quay.io")},
+		},
+	}, nil
+}
+
+func TestUpstream(t *testing.T) {
+	mock := &mockPullThroughECRClient{}
+	client := &Client{ECRAPI: mock}
+
+	var tests = []struct {
+		description string
+		image       *ecr.Image
+		expected    string
+	}{
+		{
+			"tag",
+			&ecr.Image{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("v1")},
+				RepositoryName: aws.String("quay/prometheus/node-exporter"),
+				RegistryId:     aws.String("123456789012"),
+			},
+			"quay.io/prometheus/node-exporter:v1",
+		},
+		{
+			"digest",
+			&ecr.Image{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("v1"), ImageDigest: aws.String("sha256:1234")},
+				RepositoryName: aws.String("quay/prometheus/node-exporter"),
+				RegistryId:     aws.String("123456789012"),
+			},
+			"quay.io/prometheus/node-exporter@sha256:1234",
+		},
+		{
+			"prefix is not a path segment",
+			&ecr.Image{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("v1")},
+				RepositoryName: aws.String("quaylity/app"),
+				RegistryId:     aws.String("123456789012"),
+			},
+			"",
+		},
+		{
+			"rules cannot be listed",
+			&ecr.Image{
+				ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("v1")},
+				RepositoryName: aws.String("quay/prometheus/node-exporter"),
+				RegistryId:     aws.String("210987654321"),
+			},
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			upstream, ok := client.Upstream(context.Background(), test.image)
+			if ok != (test.expected != "") || upstream != test.expected {
+				t.Errorf("Expected upstream '%s', but got '%s' instead", test.expected, upstream)
+			}
+		})
+	}
+	if mock.calls != 2 {
+		t.Errorf("Expected the rules of each registry to be listed once, but got %d calls instead", mock.calls)
+	}
+	client.pullThrough.entries["123456789012"].fetchedAt = time.Now().Add(-pullThroughRefreshPeriod)
+	client.Upstream(context.Background(), tests[0].image)
+	if mock.calls != 3 {
+		t.Errorf("Expected the rules to be listed again after the refresh period, but got %d calls instead", mock.calls-2)
+	}
+	client.pullThrough.entries["210987654321"].fetchedAt = time.Now().Add(-pullThroughRetryPeriod)
+	client.Upstream(context.Background(), tests[3].image)
+	if mock.calls != 4 {
+		t.Errorf("Expected the rules to be listed again after the retry period, but got %d calls instead", mock.calls-3)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+)
+
+// pullThroughRefreshPeriod is the period after which the pull through cache rules of a registry are listed again
+const pullThroughRefreshPeriod = time.Hour
+
+// pullThroughRetryPeriod is the period after which the pull through cache rules of a registry are listed again
+// when listing them failed
+const pullThroughRetryPeriod = 5 * time.Minute
+
+// pullThroughCache holds the pull through cache rules of each registry
+type pullThroughCache struct {
+	mu      sync.Mutex
+	entries map[string]*pullThroughEntry
+}
+
+type pullThroughEntry struct {
+	rules     []*ecr.PullThroughCacheRule
+	fetchedAt time.Time
+	// failed is set when the rules could not be listed
+	failed bool
+	// fetching is closed once the rules being listed are known, it is nil when they are not being listed
+	fetching chan struct{}
+}
+
+// fresh reports whether the entry can be used instead of listing the rules again
+func (e *pullThroughEntry) fresh() bool {
+	period := pullThroughRefreshPeriod
+	if e.failed {
+		period = pullThroughRetryPeriod
+	}
+	return !e.fetchedAt.IsZero() && time.Since(e.fetchedAt) < period
+}
+
+// Upstream returns the name of the upstream image cached by the given image
+// if its repository was created by a pull through cache rule.
+// A registry whose rules cannot be listed is assumed to have none
+func (c *Client) Upstream(ctx context.Context, image *ecr.Image) (string, bool) {
+	repository := aws.StringValue(image.RepositoryName)
+	for _, rule := range c.pullThroughCacheRules(ctx, aws.StringValue(image.RegistryId)) {
+		prefix := aws.StringValue(rule.EcrRepositoryPrefix) + "/"
+		if !strings.HasPrefix(repository, prefix) {
+			continue
+		}
+		upstream := aws.StringValue(rule.UpstreamRegistryUrl) + "/" + strings.TrimPrefix(repository, prefix)
+		if image.ImageId.ImageDigest != nil {
+			return upstream + "@" + *image.ImageId.ImageDigest, true
+		}
+		return upstream + ":" + aws.StringValue(image.ImageId.ImageTag), true
+	}
+	return "", false
+}
+
+// pullThroughCacheRules returns the pull through cache rules of the given registry,
+// listing them with DescribePullThroughCacheRules at most once per refresh period.
+// The lock is not held while the rules are listed, concurrent callers wait for them instead
+func (c *Client) pullThroughCacheRules(ctx context.Context, registryID string) []*ecr.PullThroughCacheRule {
+	for {
+		c.pullThrough.mu.Lock()
+		if c.pullThrough.entries == nil {
+			c.pullThrough.entries = make(map[string]*pullThroughEntry)
+		}
+		entry, ok := c.pullThrough.entries[registryID]
+		if !ok {
+			entry = &pullThroughEntry{}
+			c.pullThrough.entries[registryID] = entry
+		}
+		if fetching := entry.fetching; fetching != nil {
+			c.pullThrough.mu.Unlock()
+			select {
+			case <-fetching:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if entry.fresh() {
+			rules := entry.rules
+			c.pullThrough.mu.Unlock()
+			return rules
+		}
+		fetching := make(chan struct{})
+		entry.fetching = fetching
+		c.pullThrough.mu.Unlock()
+
+		rules, err := c.listPullThroughCacheRules(ctx, registryID)
+
+		c.pullThrough.mu.Lock()
+		entry.fetching = nil
+		close(fetching)
+		switch {
+		case err == nil:
+			entry.rules, entry.fetchedAt, entry.failed = rules, time.Now(), false
+		case ctx.Err() == nil:
+			// Calls cut short by the caller say nothing about the registry
+			log.WithError(err).WithField("registry", registryID).Debug("Could not list pull through cache rules")
+			entry.rules, entry.fetchedAt, entry.failed = nil, time.Now(), true
+		}
+		c.pullThrough.mu.Unlock()
+		return rules
+	}
+}
+
+// listPullThroughCacheRules lists the pull through cache rules of the given registry
+func (c *Client) listPullThroughCacheRules(ctx context.Context, registryID string) ([]*ecr.PullThroughCacheRule, error) {
+	var rules []*ecr.PullThroughCacheRule
+	input := &ecr.DescribePullThroughCacheRulesInput{RegistryId: aws.String(registryID)}
+	for {
+		var output *ecr.DescribePullThroughCacheRulesOutput
+		err := c.retry(ctx, "DescribePullThroughCacheRules", func() (err error) {
+			output, err = c.DescribePullThroughCacheRulesWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, output.PullThroughCacheRules...)
+		if output.NextToken == nil {
+			return rules, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is the budget of a single ECR API operation
+type RateLimit struct {
+	// Rate is the number of calls per second that are allowed on average
+	Rate float64
+	// Burst is the maximum number of calls that can be made at once
+	Burst int
+}
+
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%g:%d", r.Rate, r.Burst)
+}
+
+// operations are the ECR API operations called by the clients, which are the ones that can be rate limited
+var operations = map[string]bool{
+	"BatchDeleteImage":              true,
+	"BatchGetImage":                 true,
+	"DescribeImageScanFindings":     true,
+	"DescribeImages":                true,
+	"DescribePullThroughCacheRules": true,
+	"DescribeRegistries":            true,
+	"DescribeRepositories":          true,
+	"GetAuthorizationToken":         true,
+	"GetLifecyclePolicy":            true,
+	"PutImage":                      true,
+	"PutLifecyclePolicy":            true,
+	"TagResource":                   true,
+}
+
+// ParseRateLimits parses rate limits given as a map from ECR API operation name
+// to a value of the form 'RATE' or 'RATE:BURST'. The burst defaults to the rate rounded up
+func ParseRateLimits(values map[string]string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit, len(values))
+	for operation, value := range values {
+		if !operations[operation] {
+			return nil, fmt.Errorf("Unknown operation '%s'", operation)
+		}
+		parts := strings.SplitN(value, ":", 2)
+		limitRate, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || limitRate <= 0 {
+			return nil, fmt.Errorf("Invalid rate '%s' for operation '%s'", parts[0], operation)
+		}
+		burst := int(math.Ceil(limitRate))
+		if len(parts) == 2 {
+			burst, err = strconv.Atoi(parts[1])
+			if err != nil || burst <= 0 {
+				return nil, fmt.Errorf("Invalid burst '%s' for operation '%s'", parts[1], operation)
+			}
+		}
+		limits[operation] = RateLimit{Rate: limitRate, Burst: burst}
+	}
+	return limits, nil
+}
+
+// newLimiters creates a token bucket for each of the given operations
+func newLimiters(limits map[string]RateLimit) map[string]*rate.Limiter {
+	limiters := make(map[string]*rate.Limiter, len(limits))
+	for operation, limit := range limits {
+		limiters[operation] = rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)
+	}
+	return limiters
+}
+
+// wait blocks until the budget of the given operation allows another call or ctx is done.
+// Operations without a configured budget are not limited
+func (c *Client) wait(ctx context.Context, operation string) error {
+	limiter, ok := c.limiters[operation]
+	if !ok {
+		return nil
+	}
+	return limiter.Wait(ctx)
+}
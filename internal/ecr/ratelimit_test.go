@@ -0,0 +1,83 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	var tests = []struct {
+		description string
+		values      map[string]string
+		expected    map[string]RateLimit
+		valid       bool
+	}{
+		{"empty", nil, map[string]RateLimit{}, true},
+		{"rate only", map[string]string{"PutImage": "2.5"}, map[string]RateLimit{"PutImage": {Rate: 2.5, Burst: 3}}, true},
+		{"rate and burst", map[string]string{"PutImage": "5:10"}, map[string]RateLimit{"PutImage": {Rate: 5, Burst: 10}}, true},
+		{"invalid rate", map[string]string{"PutImage": "fast"}, nil, false},
+		{"negative rate", map[string]string{"PutImage": "-1"}, nil, false},
+		{"invalid burst", map[string]string{"PutImage": "5:0"}, nil, false},
+		{"unknown operation", map[string]string{"PutImages": "5"}, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			limits, err := ParseRateLimits(test.values)
+			if test.valid != (err == nil) {
+				t.Errorf("Expected valid to be %t, but got error '%v'", test.valid, err)
+				return
+			}
+			if diff := cmp.Diff(limits, test.expected); test.valid && diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+			}
+		})
+	}
+}
+
+func TestRateLimitIsSharedAcrossGoroutines(t *testing.T) {
+	client := &Client{
+		limiters: newLimiters(map[string]RateLimit{"PutImage": {Rate: 20, Burst: 1}}),
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = client.wait(context.Background(), "PutImage")
+		}()
+	}
+	wg.Wait()
+	// The first call uses the burst, the 4 others wait 50ms each
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Expected calls to be limited, but they took only %s", elapsed)
+	}
+
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		_ = client.wait(context.Background(), "DescribeImages")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Expected operations without budget not to be limited, but they took %s", elapsed)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	log "github.com/sirupsen/logrus"
+)
+
+// Registry is a container image registry whose images can be tagged.
+// Images are described with the types of the ECR API, the registry ID of images that are not from ECR is the
+// host of their registry
+type Registry interface {
+	// Owns reports whether the images with the given registry ID are stored in the registry
+	Owns(registryID string) bool
+	// ParseImageName parses the name of an image from the registry
+	ParseImageName(ctx context.Context, imageName string) (*ecr.Image, error)
+	// GetImageTags returns all tags of the given image
+	GetImageTags(ctx context.Context, image *ecr.Image) ([]*string, error)
+	// GetImagesInformation returns the given images with their manifests
+	GetImagesInformation(ctx context.Context, images []*ecr.Image) ([]*ecr.Image, error)
+	// TagImages adds the given tag to images returned by GetImagesInformation
+	TagImages(ctx context.Context, images []*ecr.Image, tag string) []TagResult
+	// UntagImage removes a tag from an image. If the digest is not empty,
+	// the tag is only removed if it still points to the image with that digest.
+	// It fails with ErrLastTag if the registry would delete the image along with its last tag
+	UntagImage(ctx context.Context, registryID, repository, digest, tag string) error
+}
+
+var (
+	_ Registry = (*Client)(nil)
+	_ Registry = (*OCIClient)(nil)
+	_ Registry = Registries(nil)
+)
+
+// ecrRegistryIDRegex matches the IDs of ECR registries, which are AWS account IDs
+var ecrRegistryIDRegex = regexp.MustCompile(`^\d+$`)
+
+// Owns reports whether the given registry ID is the one of an ECR registry
+func (c *Client) Owns(registryID string) bool {
+	return ecrRegistryIDRegex.MatchString(registryID)
+}
+
+// ParseImageName parses the name of an image from ECR
+func (c *Client) ParseImageName(ctx context.Context, imageName string) (*ecr.Image, error) {
+	return ParseImageName(imageName)
+}
+
+// Registries dispatches calls to the first of its registries that owns the images
+type Registries []Registry
+
+func (r Registries) registryOf(registryID string) (Registry, error) {
+	for _, registry := range r {
+		if registry.Owns(registryID) {
+			return registry, nil
+		}
+	}
+	return nil, fmt.Errorf("No registry owns images of '%s'", registryID)
+}
+
+// Owns reports whether one of the registries owns the images with the given registry ID
+func (r Registries) Owns(registryID string) bool {
+	_, err := r.registryOf(registryID)
+	return err == nil
+}
+
+// ParseImageName parses the image name with the first registry that can parse it
+func (r Registries) ParseImageName(ctx context.Context, imageName string) (*ecr.Image, error) {
+	for _, registry := range r {
+		if image, err := registry.ParseImageName(ctx, imageName); err == nil {
+			return image, nil
+		}
+	}
+	return nil, fmt.Errorf("Could not parse image name '%s'", imageName)
+}
+
+// GetImageTags returns all tags of the given image
+func (r Registries) GetImageTags(ctx context.Context, image *ecr.Image) ([]*string, error) {
+	registry, err := r.registryOf(*image.RegistryId)
+	if err != nil {
+		return nil, err
+	}
+	return registry.GetImageTags(ctx, image)
+}
+
+// GetImagesInformation returns the given images with their manifests.
+// The images of a registry that fails are logged and left out of the result
+func (r Registries) GetImagesInformation(ctx context.Context, images []*ecr.Image) ([]*ecr.Image, error) {
+	var imageInformation []*ecr.Image
+	for _, registry := range r {
+		owned := ownedImages(registry, images)
+		if len(owned) == 0 {
+			continue
+		}
+		information, err := registry.GetImagesInformation(ctx, owned)
+		if err != nil {
+			// The images of the other registries can still be tagged
+			log.WithError(err).WithField("registry", aws.StringValue(owned[0].RegistryId)).Error("Could not get images' manifests")
+			continue
+		}
+		imageInformation = append(imageInformation, information...)
+	}
+	return imageInformation, nil
+}
+
+// TagImages adds the given tag to images returned by GetImagesInformation
+func (r Registries) TagImages(ctx context.Context, images []*ecr.Image, tag string) []TagResult {
+	var results []TagResult
+	for _, registry := range r {
+		if owned := ownedImages(registry, images); len(owned) > 0 {
+			results = append(results, registry.TagImages(ctx, owned, tag)...)
+		}
+	}
+	return results
+}
+
+// UntagImage removes a tag from an image
+func (r Registries) UntagImage(ctx context.Context, registryID, repository, digest, tag string) error {
+	registry, err := r.registryOf(registryID)
+	if err != nil {
+		return err
+	}
+	return registry.UntagImage(ctx, registryID, repository, digest, tag)
+}
+
+// ownedImages returns the images that are stored in the given registry
+func ownedImages(registry Registry, images []*ecr.Image) []*ecr.Image {
+	var owned []*ecr.Image
+	for _, image := range images {
+		if registry.Owns(*image.RegistryId) {
+			owned = append(owned, image)
+		}
+	}
+	return owned
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// lastUsedLayout is the layout of the date set by the last used resource tag
+const lastUsedLayout = "2006-01-02"
+
+// repositoryRetryPeriod is how long TagRepository leaves a repository alone after failing to tag it
+const repositoryRetryPeriod = time.Hour
+
+// repositoryCache holds the ARN of repositories and the resource tags last added to them
+type repositoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*repositoryEntry
+}
+
+type repositoryEntry struct {
+	arn  string
+	tags map[string]string
+	// failedAt is the time at which tagging the repository last failed
+	failedAt time.Time
+	// tagging is set while the repository is being tagged
+	tagging bool
+}
+
+// RepositoryTagsEnabled reports whether TagRepository adds resource tags to repositories
+func (c *Client) RepositoryTagsEnabled() bool {
+	return len(c.options.RepositoryTags) > 0 || c.options.RepositoryLastUsedTag != ""
+}
+
+// TagRepository adds the resource tags given by the RepositoryTags and RepositoryLastUsedTag options
+// to the given repository with TagResource, marking it as in use on the given date.
+// TagResource is only called if the tags differ from the ones it last added,
+// which is at most once a day per repository. A repository that could not be tagged
+// is left alone for an hour, during which TagRepository returns nil
+func (c *Client) TagRepository(ctx context.Context, registryID, repository string, now time.Time) error {
+	if !c.RepositoryTagsEnabled() {
+		return nil
+	}
+	tags := make(map[string]string, len(c.options.RepositoryTags)+1)
+	for key, value := range c.options.RepositoryTags {
+		tags[key] = value
+	}
+	if c.options.RepositoryLastUsedTag != "" {
+		tags[c.options.RepositoryLastUsedTag] = now.UTC().Format(lastUsedLayout)
+	}
+
+	// The lock is not held during the calls to ECR, the entry is marked instead so that it is tagged only once
+	c.repositories.mu.Lock()
+	key := registryID + "/" + repository
+	entry, ok := c.repositories.entries[key]
+	if !ok {
+		entry = &repositoryEntry{}
+		if c.repositories.entries == nil {
+			c.repositories.entries = make(map[string]*repositoryEntry)
+		}
+		c.repositories.entries[key] = entry
+	}
+	if entry.tagging || equalTags(entry.tags, tags) || now.Sub(entry.failedAt) < repositoryRetryPeriod {
+		c.repositories.mu.Unlock()
+		return nil
+	}
+	entry.tagging = true
+	arn := entry.arn
+	c.repositories.mu.Unlock()
+
+	arn, err := c.tagRepository(ctx, registryID, repository, arn, tags)
+
+	c.repositories.mu.Lock()
+	defer c.repositories.mu.Unlock()
+	entry.tagging = false
+	entry.arn = arn
+	if err != nil {
+		// Calls cut short by the caller say nothing about the repository
+		if ctx.Err() == nil {
+			entry.failedAt = now
+		}
+		return err
+	}
+	entry.tags = tags
+	entry.failedAt = time.Time{}
+	return nil
+}
+
+// tagRepository adds the given resource tags to the repository with the given ARN, which is looked up
+// with DescribeRepositories if it is empty. It returns the ARN of the repository
+func (c *Client) tagRepository(ctx context.Context, registryID, repository, arn string, tags map[string]string) (string, error) {
+	if arn == "" {
+		input := &ecr.DescribeRepositoriesInput{
+			RegistryId:      aws.String(registryID),
+			RepositoryNames: aws.StringSlice([]string{repository}),
+		}
+		var output *ecr.DescribeRepositoriesOutput
+		err := c.retry(ctx, "DescribeRepositories", func() (err error) {
+			output, err = c.DescribeRepositoriesWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(output.Repositories) == 0 {
+			return "", ErrRepositoryNotFound
+		}
+		arn = aws.StringValue(output.Repositories[0].RepositoryArn)
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	resourceTags := make([]*ecr.Tag, 0, len(keys))
+	for _, key := range keys {
+		resourceTags = append(resourceTags, &ecr.Tag{Key: aws.String(key), Value: aws.String(tags[key])})
+	}
+	input := &ecr.TagResourceInput{ResourceArn: aws.String(arn), Tags: resourceTags}
+	err := c.retry(ctx, "TagResource", func() error {
+		_, err := c.TagResourceWithContext(ctx, input)
+		return err
+	})
+	return arn, err
+}
+
+func equalTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-cmp/cmp"
+)
+
+// mockRepositoryECRClient has the repository "test-image" only and records the resource tags added to it
+type mockRepositoryECRClient struct {
+	ecriface.ECRAPI
+	describeCalls int
+	tagInputs     []*ecr.TagResourceInput
+}
+
+func (m *mockRepositoryECRClient) DescribeRepositoriesWithContext(ctx aws.Context, input *ecr.DescribeRepositoriesInput, opts ...request.Option) (*ecr.DescribeRepositoriesOutput, error) {
+	m.describeCalls++
+	if aws.StringValue(input.RepositoryNames[0]) != "test-image" {
+		return nil, awserr.New(ecr.ErrCodeRepositoryNotFoundException, "repository not found", nil)
+	}
+	return &ecr.DescribeRepositoriesOutput{
+		Repositories: []*ecr.Repository{{
+			RepositoryArn: aws.String("arn:aws:ecr:eu-central-1:123456789012:repository/test-image"),
+		}},
+	}, nil
+}
+
+func (m *mockRepositoryECRClient) TagResourceWithContext(ctx aws.Context, input *ecr.TagResourceInput, opts ...request.Option) (*ecr.TagResourceOutput, error) {
+	m.tagInputs = append(m.tagInputs, input)
+	return &ecr.TagResourceOutput{}, nil
+}
+
+func TestTagRepository(t *testing.T) {
+	mock := &mockRepositoryECRClient{}
+	client := &Client{ECRAPI: mock}
+	now := time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC)
+
+	if err := client.TagRepository(context.Background(), "123456789012", "test-image", now); err != nil {
+		t.Fatal(err)
+	}
+	if mock.describeCalls != 0 || len(mock.tagInputs) != 0 {
+		t.Fatal("Expected repositories not to be tagged without resource tags")
+	}
+
+	client.options = Options{
+		RepositoryTags:        map[string]string{"in-use-by-cluster": "prod-eu"},
+		RepositoryLastUsedTag: "last-used",
+	}
+	for _, at := range []time.Time{now, now.Add(30 * time.Minute), now.Add(2 * time.Hour)} {
+		if err := client.TagRepository(context.Background(), "123456789012", "test-image", at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []*ecr.TagResourceInput{
+		{
+			ResourceArn: aws.String("arn:aws:ecr:eu-central-1:123456789012:repository/test-image"),
+			Tags: []*ecr.Tag{
+				{Key: aws.String("in-use-by-cluster"), Value: aws.String("prod-eu")},
+				{Key: aws.String("last-used"), Value: aws.String("2026-10-17")},
+			},
+		},
+		{
+			ResourceArn: aws.String("arn:aws:ecr:eu-central-1:123456789012:repository/test-image"),
+			Tags: []*ecr.Tag{
+				{Key: aws.String("in-use-by-cluster"), Value: aws.String("prod-eu")},
+				{Key: aws.String("last-used"), Value: aws.String("2026-10-18")},
+			},
+		},
+	}
+	if diff := cmp.Diff(mock.tagInputs, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", mock.tagInputs, diff)
+	}
+	if mock.describeCalls != 1 {
+		t.Errorf("Expected the repository to be described once, but got %d calls instead", mock.describeCalls)
+	}
+
+	err := client.TagRepository(context.Background(), "123456789012", "missing", now)
+	if !errors.Is(err, ErrRepositoryNotFound) {
+		t.Errorf("Expected repository not found error, but got '%v' instead", err)
+	}
+	// The failure is cached until the retry period is over
+	if err := client.TagRepository(context.Background(), "123456789012", "missing", now.Add(time.Minute)); err != nil {
+		t.Errorf("Expected no error while the failure is cached, but got '%v' instead", err)
+	}
+	if mock.describeCalls != 2 {
+		t.Errorf("Expected the missing repository to be described once, but got %d calls instead", mock.describeCalls-1)
+	}
+	err = client.TagRepository(context.Background(), "123456789012", "missing", now.Add(repositoryRetryPeriod))
+	if !errors.Is(err, ErrRepositoryNotFound) || mock.describeCalls != 3 {
+		t.Errorf("Expected the missing repository to be described again, but got error '%v' and %d calls", err, mock.describeCalls)
+	}
+}
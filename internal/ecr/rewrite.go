@@ -0,0 +1,126 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// regexRulePrefix marks rewrite rules whose source is a regular expression
+const regexRulePrefix = "regex:"
+
+// RewriteRule translates the references of images, as written in Pod specs,
+// to the references of the images that are actually pulled, e.g. from a mirror in ECR
+type RewriteRule struct {
+	// prefix is replaced by replacement in references starting with it
+	prefix string
+	// pattern, if set, is replaced by replacement in references matching it instead
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// ParseRewriteRule parses a rewrite rule of the form PREFIX=REPLACEMENT or regex:PATTERN=REPLACEMENT.
+// The rule is split on its first '=', so the replacement may contain '=' but the source may not.
+// The replacement of a regular expression can refer to its capturing groups, e.g. ${1}
+func ParseRewriteRule(rule string) (RewriteRule, error) {
+	i := strings.Index(rule, "=")
+	if i <= 0 {
+		return RewriteRule{}, fmt.Errorf("Could not parse rewrite rule '%s', expected SOURCE=REPLACEMENT", rule)
+	}
+	source, replacement := rule[:i], rule[i+1:]
+	if replacement == "" {
+		return RewriteRule{}, fmt.Errorf("Rewrite rule '%s' has an empty replacement", rule)
+	}
+	if !strings.HasPrefix(source, regexRulePrefix) {
+		return RewriteRule{prefix: source, replacement: replacement}, nil
+	}
+	pattern, err := regexp.Compile(strings.TrimPrefix(source, regexRulePrefix))
+	if err != nil {
+		return RewriteRule{}, fmt.Errorf("Could not parse rewrite rule '%s': %v", rule, err)
+	}
+	return RewriteRule{pattern: pattern, replacement: replacement}, nil
+}
+
+// rewrite returns the rewritten reference and whether the rule applies to it
+func (r RewriteRule) rewrite(reference string) (string, bool) {
+	if r.pattern != nil {
+		if !r.pattern.MatchString(reference) {
+			return reference, false
+		}
+		return r.pattern.ReplaceAllString(reference, r.replacement), true
+	}
+	if !strings.HasPrefix(reference, r.prefix) {
+		return reference, false
+	}
+	return r.replacement + strings.TrimPrefix(reference, r.prefix), true
+}
+
+// RewriteRules are rewrite rules applied in order, only the first one matching an image applies
+type RewriteRules []RewriteRule
+
+// ParseRewriteRules parses the given rewrite rules
+func ParseRewriteRules(rules []string) (RewriteRules, error) {
+	parsed := make(RewriteRules, 0, len(rules))
+	for _, rule := range rules {
+		rewriteRule, err := ParseRewriteRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rewriteRule)
+	}
+	return parsed, nil
+}
+
+// Rewrite returns the reference of the image that backs the given image name.
+// Rules are matched against the fully qualified reference, e.g. docker.io/library/nginx:latest for nginx.
+// The image name is returned unchanged if no rule matches
+func (r RewriteRules) Rewrite(imageName string) string {
+	if len(r) == 0 {
+		return imageName
+	}
+	reference := normalizeImageName(imageName)
+	for _, rule := range r {
+		if rewritten, ok := rule.rewrite(reference); ok {
+			return rewritten
+		}
+	}
+	return imageName
+}
+
+// normalizeImageName returns the fully qualified reference of the given image name
+// as resolved by container runtimes: images without a registry are from Docker Hub,
+// Docker Hub images without a namespace are official images and images without a tag or a digest are tagged latest
+func normalizeImageName(imageName string) string {
+	domain, remainder := "", imageName
+	if i := strings.Index(imageName, "/"); i >= 0 {
+		first := imageName[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			domain, remainder = first, imageName[i+1:]
+		}
+	}
+	if domain == "" || domain == "index.docker.io" {
+		domain = "docker.io"
+	}
+	if domain == "docker.io" && !strings.Contains(remainder, "/") {
+		remainder = "library/" + remainder
+	}
+	if last := remainder[strings.LastIndex(remainder, "/")+1:]; !strings.ContainsAny(last, ":@") {
+		remainder += ":latest"
+	}
+	return domain + "/" + remainder
+}
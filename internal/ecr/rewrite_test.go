@@ -0,0 +1,82 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"testing"
+)
+
+func TestRewriteRules(t *testing.T) {
+	rules, err := ParseRewriteRules([]string{
+		"docker.io/library/=123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/library/",
+		`regex:^quay\.io/([^/]+)/(.+)$=123456789012.dkr.ecr.eu-central-1.amazonaws.com/quay-${1}/${2}`,
+		"docker.io/=123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/",
+		`regex:^registry\.example\.com/(.+):(.+)$=mirror/${1}=${2}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		description string
+		imageName   string
+		expected    string
+	}{
+		{"replacement containing '='", "registry.example.com/app:v1", "mirror/app=v1"},
+		{"official image", "nginx", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/library/nginx:latest"},
+		{"official image with registry", "docker.io/library/nginx:1.19", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/library/nginx:1.19"},
+		{"first matching rule applies", "bitnami/redis:6.0", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/docker-hub/bitnami/redis:6.0"},
+		{"regular expression", "quay.io/prometheus/node-exporter:v1.0.1", "123456789012.dkr.ecr.eu-central-1.amazonaws.com/quay-prometheus/node-exporter:v1.0.1"},
+		{"no matching rule", "gcr.io/project/app:v1", "gcr.io/project/app:v1"},
+		{"registry with port", "localhost:5000/app", "localhost:5000/app"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if actual := rules.Rewrite(test.imageName); actual != test.expected {
+				t.Errorf("Expected image '%s', but got '%s' instead", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestParseRewriteRule(t *testing.T) {
+	var tests = []struct {
+		description string
+		rule        string
+		valid       bool
+	}{
+		{"prefix", "docker.io/=mirror/", true},
+		{"regular expression", "regex:^docker\\.io/(.+)$=mirror/${1}", true},
+		{"regular expression with repetition", "regex:^docker\\.io/([a-z]{1,3})/(.+)$=mirror/${1}/${2}", true},
+		{"no replacement", "docker.io/", false},
+		{"empty replacement", "docker.io/=", false},
+		{"empty source", "=mirror/", false},
+		{"invalid regular expression", "regex:(=mirror/", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			_, err := ParseRewriteRule(test.rule)
+			if test.valid && err != nil {
+				t.Errorf("Expected rule to be valid, but got '%v' instead", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("Expected rule to be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+// ScanResult is the outcome of the image scan of an image
+type ScanResult struct {
+	// Status is the status of the scan, e.g. COMPLETE, IN_PROGRESS or FAILED. It is empty if the image was not scanned
+	Status string
+	// SeverityCounts maps the severities of the scan findings, e.g. CRITICAL, to their number
+	SeverityCounts map[string]int64
+}
+
+// GetScanFindings returns the result of the image scan of the given image with DescribeImageScanFindings.
+// Completed scans are cached
+func (c *Client) GetScanFindings(ctx context.Context, image *ecr.Image) (*ScanResult, error) {
+	if scan, ok := c.cache.getScan(image); ok {
+		return scan, nil
+	}
+	imageID := &ecr.ImageIdentifier{ImageTag: image.ImageId.ImageTag}
+	if image.ImageId.ImageDigest != nil {
+		imageID = &ecr.ImageIdentifier{ImageDigest: image.ImageId.ImageDigest}
+	}
+	input := &ecr.DescribeImageScanFindingsInput{
+		ImageId:        imageID,
+		RepositoryName: image.RepositoryName,
+		RegistryId:     image.RegistryId,
+		// Only the severity counts of the findings are needed
+		MaxResults: aws.Int64(1),
+	}
+	var output *ecr.DescribeImageScanFindingsOutput
+	err := c.retry(ctx, "DescribeImageScanFindings", func() (err error) {
+		output, err = c.DescribeImageScanFindingsWithContext(ctx, input)
+		return err
+	})
+	if ErrorCode(err) == ecr.ErrCodeScanNotFoundException {
+		return &ScanResult{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scan := &ScanResult{SeverityCounts: make(map[string]int64)}
+	if output.ImageScanStatus != nil {
+		scan.Status = aws.StringValue(output.ImageScanStatus.Status)
+	}
+	if output.ImageScanFindings != nil {
+		for severity, count := range output.ImageScanFindings.FindingSeverityCounts {
+			scan.SeverityCounts[severity] = aws.Int64Value(count)
+		}
+	}
+	if scan.Status == ecr.ScanStatusComplete && output.ImageId != nil {
+		c.cache.putScan(image, aws.StringValue(output.ImageId.ImageDigest), scan)
+	}
+	return scan, nil
+}
+
+// ScanPolicy decides whether images may be tagged given the findings of their image scan
+type ScanPolicy struct {
+	// Thresholds maps severities to the maximum number of findings of that severity an image may have
+	Thresholds map[string]int64
+	// RequireScan makes images without a completed scan violate the policy
+	RequireScan bool
+}
+
+// ParseScanThresholds parses thresholds given as SEVERITY=COUNT, e.g. CRITICAL=0
+func ParseScanThresholds(thresholds map[string]string) (map[string]int64, error) {
+	parsed := make(map[string]int64, len(thresholds))
+	for severity, value := range thresholds {
+		severity = strings.ToUpper(severity)
+		valid := false
+		for _, known := range ecr.FindingSeverity_Values() {
+			if severity == known {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("Unknown finding severity '%s'", severity)
+		}
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("Could not parse threshold '%s' of severity '%s'", value, severity)
+		}
+		parsed[severity] = count
+	}
+	return parsed, nil
+}
+
+// Violation returns why the given scan result violates the policy, if it does
+func (p *ScanPolicy) Violation(scan *ScanResult) (string, bool) {
+	if scan.Status != ecr.ScanStatusComplete {
+		if !p.RequireScan {
+			return "", false
+		}
+		if scan.Status == "" {
+			return "image was not scanned", true
+		}
+		return fmt.Sprintf("scan status is %s", scan.Status), true
+	}
+	severities := make([]string, 0, len(p.Thresholds))
+	for severity := range p.Thresholds {
+		severities = append(severities, severity)
+	}
+	sort.Strings(severities)
+	var violations []string
+	for _, severity := range severities {
+		if count := scan.SeverityCounts[severity]; count > p.Thresholds[severity] {
+			violations = append(violations, fmt.Sprintf("%d %s findings exceed the threshold of %d", count, severity, p.Thresholds[severity]))
+		}
+	}
+	if len(violations) == 0 {
+		return "", false
+	}
+	return strings.Join(violations, ", "), true
+}
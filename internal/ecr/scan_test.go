@@ -0,0 +1,129 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-cmp/cmp"
+)
+
+// mockScanECRClient has a completed scan for images tagged "scanned" and no scan for all others
+type mockScanECRClient struct {
+	ecriface.ECRAPI
+	calls int
+}
+
+func (m *mockScanECRClient) DescribeImageScanFindingsWithContext(ctx aws.Context, input *ecr.DescribeImageScanFindingsInput, opts ...request.Option) (*ecr.DescribeImageScanFindingsOutput, error) {
+	m.calls++
+	if aws.StringValue(input.ImageId.ImageTag) != "scanned" {
+		return nil, awserr.New(ecr.ErrCodeScanNotFoundException, "scan not found", nil)
+	}
+	return &ecr.DescribeImageScanFindingsOutput{
+		ImageId:         &ecr.ImageIdentifier{ImageTag: input.ImageId.ImageTag, ImageDigest: aws.String("sha256:1234")},
+		ImageScanStatus: &ecr.ImageScanStatus{Status: aws.String(ecr.ScanStatusComplete)},
+		ImageScanFindings: &ecr.ImageScanFindings{
+			FindingSeverityCounts: map[string]*int64{ecr.FindingSeverityCritical: aws.Int64(1)},
+		},
+	}, nil
+}
+
+func TestGetScanFindings(t *testing.T) {
+	mock := &mockScanECRClient{}
+	client := &Client{ECRAPI: mock, cache: newImageCache(time.Minute, 10)}
+	scanned := &ecr.Image{
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("scanned")},
+		RepositoryName: aws.String("test-image"),
+		RegistryId:     aws.String("123456789012"),
+	}
+
+	for i := 0; i < 2; i++ {
+		scan, err := client.GetScanFindings(context.Background(), scanned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &ScanResult{Status: ecr.ScanStatusComplete, SeverityCounts: map[string]int64{ecr.FindingSeverityCritical: 1}}
+		if diff := cmp.Diff(scan, expected); diff != "" {
+			t.Errorf("%T differ (-got, +want): %s", scan, diff)
+		}
+	}
+	if mock.calls != 1 {
+		t.Errorf("Expected completed scan to be cached, but got %d calls instead", mock.calls)
+	}
+
+	unscanned := &ecr.Image{
+		ImageId:        &ecr.ImageIdentifier{ImageTag: aws.String("latest")},
+		RepositoryName: aws.String("test-image"),
+		RegistryId:     aws.String("123456789012"),
+	}
+	scan, err := client.GetScanFindings(context.Background(), unscanned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(scan, &ScanResult{}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", scan, diff)
+	}
+}
+
+func TestScanPolicy(t *testing.T) {
+	thresholds, err := ParseScanThresholds(map[string]string{"critical": "0", "HIGH": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(thresholds, map[string]int64{"CRITICAL": 0, "HIGH": 5}); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", thresholds, diff)
+	}
+	for _, invalid := range []map[string]string{{"SEVERE": "0"}, {"HIGH": "-1"}, {"HIGH": "many"}} {
+		if _, err := ParseScanThresholds(invalid); err == nil {
+			t.Errorf("Expected thresholds '%v' to be invalid", invalid)
+		}
+	}
+
+	var tests = []struct {
+		description string
+		requireScan bool
+		scan        *ScanResult
+		expected    string
+	}{
+		{"below thresholds", false, &ScanResult{Status: ecr.ScanStatusComplete, SeverityCounts: map[string]int64{"HIGH": 5, "MEDIUM": 10}}, ""},
+		{
+			"above thresholds",
+			false,
+			&ScanResult{Status: ecr.ScanStatusComplete, SeverityCounts: map[string]int64{"CRITICAL": 1, "HIGH": 6}},
+			"1 CRITICAL findings exceed the threshold of 0, 6 HIGH findings exceed the threshold of 5",
+		},
+		{"not scanned", false, &ScanResult{}, ""},
+		{"scan required", true, &ScanResult{}, "image was not scanned"},
+		{"scan in progress", true, &ScanResult{Status: ecr.ScanStatusInProgress}, "scan status is IN_PROGRESS"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			policy := &ScanPolicy{Thresholds: thresholds, RequireScan: test.requireScan}
+			violation, ok := policy.Violation(test.scan)
+			if ok != (test.expected != "") || violation != test.expected {
+				t.Errorf("Expected violation '%s', but got '%s' instead", test.expected, violation)
+			}
+		})
+	}
+}
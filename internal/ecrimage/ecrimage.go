@@ -0,0 +1,119 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ecrimage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Resource is the resource of the cluster-scoped EcrImage objects
+var Resource = schema.GroupVersionResource{Group: "kube-ecr-tagger.io", Version: "v1alpha1", Resource: "ecrimages"}
+
+// Kind of the EcrImage objects
+const Kind = "EcrImage"
+
+// ManagedByLabel marks the EcrImage objects maintained by the tagger with the ManagedBy value
+const (
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "kube-ecr-tagger"
+)
+
+// maxRepositoryLength is the length beyond which repository names are truncated in object names,
+// which cannot be longer than 253 characters
+const maxRepositoryLength = 200
+
+// EcrImage mirrors the state of an image from ECR used by Pods in the cluster
+type EcrImage struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec identifies the image
+type Spec struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Digest     string `json:"digest"`
+}
+
+// Status is the state of the image as last seen by the tagger
+type Status struct {
+	// Tags are the image's tags known to the tagger
+	Tags []string `json:"tags,omitempty"`
+	// Protected reports whether one of the tags starts with a prefix managed by the tagger
+	Protected bool `json:"protected"`
+	// Workloads are the workloads whose Pods use the image
+	Workloads []string `json:"workloads,omitempty"`
+	// LastChecked is the time at which the tagger last checked the image's tags
+	LastChecked *metav1.Time `json:"lastChecked,omitempty"`
+}
+
+// New returns an EcrImage named after the given image
+func New(registryID, repository, digest string) *EcrImage {
+	return &EcrImage{
+		TypeMeta: metav1.TypeMeta{APIVersion: Resource.GroupVersion().String(), Kind: Kind},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   Name(registryID, repository, digest),
+			Labels: map[string]string{ManagedByLabel: ManagedBy},
+		},
+		Spec: Spec{Registry: registryID, Repository: repository, Digest: digest},
+	}
+}
+
+// Name returns the name of the EcrImage of the given image.
+// It is made of the repository name, the first 12 characters of the digest, the registry ID and a short hash
+// of the three, which tells apart images whose names only differ once sanitised or truncated, e.g.
+// team.app.3c3a4604a545.123456789012.a8b7da0c
+func Name(registryID, repository, digest string) string {
+	sum := sha256.Sum256([]byte(registryID + "/" + repository + "@" + digest))
+	hash := hex.EncodeToString(sum[:4])
+	name := strings.NewReplacer("/", ".", "_", "-").Replace(strings.ToLower(repository))
+	if len(name) > maxRepositoryLength {
+		name = strings.TrimRight(name[:maxRepositoryLength], ".-")
+	}
+	digest = digest[strings.Index(digest, ":")+1:]
+	if len(digest) > 12 {
+		digest = digest[:12]
+	}
+	return name + "." + digest + "." + registryID + "." + hash
+}
+
+// FromUnstructured converts an object returned by the dynamic client to an EcrImage
+func FromUnstructured(obj *unstructured.Unstructured) (*EcrImage, error) {
+	var image EcrImage
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &image); err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// ToUnstructured converts the EcrImage to an object that can be passed to the dynamic client
+func (i *EcrImage) ToUnstructured() (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(i)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package ecrimage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	var tests = []struct {
+		description string
+		repository  string
+		digest      string
+		expected    string
+	}{
+		{"nested repository", "team/app", "sha256:3c3a4604a545cdc127456d94e421cd355bca5b528f4a9c1905b15da2eb4a4c6b", "team.app.3c3a4604a545.123456789012.a8b7da0c"},
+		{"underscores", "team/my_app", "sha256:1234", "team.my-app.1234.123456789012.0b91595c"},
+		{"long repository", strings.Repeat("a", 199) + "/app", "sha256:1234", strings.Repeat("a", 199) + ".1234.123456789012.ea709a6a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual := Name("123456789012", test.repository, test.digest)
+			if actual != test.expected {
+				t.Errorf("Expected name '%s', but got '%s' instead", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestNameCollisions(t *testing.T) {
+	var tests = []struct {
+		description string
+		repository  string
+		other       string
+	}{
+		{"sanitised", "team/my_app", "team/my-app"},
+		{"truncated", strings.Repeat("a", 200) + "/app", strings.Repeat("a", 200) + "/web"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			name := Name("123456789012", test.repository, "sha256:1234")
+			if other := Name("123456789012", test.other, "sha256:1234"); name == other {
+				t.Errorf("Expected the names of '%s' and '%s' to differ, but both are '%s'", test.repository, test.other, name)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Checker tracks the state of the tagger to answer liveness and readiness probes.
+// All of its methods can be called on a nil Checker, in which case they do nothing
+type Checker struct {
+	// ecrWindow is how recent the last successful ECR call must be for the tagger to be ready
+	ecrWindow time.Duration
+	// stallTimeout is how long a worker can spend on a single Pod before the tagger is considered stalled
+	stallTimeout time.Duration
+	// pingECR makes a call to ECR to check whether it is reachable
+	pingECR func(ctx context.Context) error
+	// lastECRSuccess returns the time of the last successful ECR call
+	lastECRSuccess func() time.Time
+
+	mu      sync.Mutex
+	synced  bool
+	standby bool
+	nextID  uint64
+	working map[uint64]time.Time
+	now     func() time.Time
+}
+
+// NewChecker instantiates a new Checker
+func NewChecker(ecrWindow, stallTimeout time.Duration, lastECRSuccess func() time.Time, pingECR func(ctx context.Context) error) *Checker {
+	return &Checker{
+		ecrWindow:      ecrWindow,
+		stallTimeout:   stallTimeout,
+		pingECR:        pingECR,
+		lastECRSuccess: lastECRSuccess,
+		working:        make(map[uint64]time.Time),
+		now:            time.Now,
+	}
+}
+
+// SetSynced records that the informer's cache was synced
+func (c *Checker) SetSynced(synced bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.synced = synced
+}
+
+// SetStandby records whether the replica is waiting to become the leader.
+// A replica on standby does not process Pods and is considered ready
+func (c *Checker) SetStandby(standby bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.standby = standby
+}
+
+// StartWork records that a worker started processing a Pod. The returned function must be called once it is done
+func (c *Checker) StartWork() func() {
+	if c == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.nextID
+	c.nextID++
+	c.working[id] = c.now()
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.working, id)
+	}
+}
+
+// Live returns an error if a worker has been processing the same Pod for longer than the stall timeout
+func (c *Checker) Live() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, started := range c.working {
+		if elapsed := c.now().Sub(started); elapsed > c.stallTimeout {
+			return fmt.Errorf("a worker has been processing the same Pod for %s", elapsed.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// pingTimeout bounds the ping made to ECR when answering a readiness probe
+const pingTimeout = 2 * time.Second
+
+// Ready returns an error if the informer's cache is not synced yet or if ECR was not reached recently.
+// ECR is pinged once, within pingTimeout, when the last successful call is too old
+func (c *Checker) Ready() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	synced, standby := c.synced, c.standby
+	c.mu.Unlock()
+	if standby {
+		return nil
+	}
+	if !synced {
+		return errors.New("informer cache is not synced")
+	}
+	if c.now().Sub(c.lastECRSuccess()) <= c.ecrWindow {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	if err := c.pingECR(ctx); err != nil {
+		return fmt.Errorf("ECR is not reachable: %v", err)
+	}
+	return nil
+}
+
+// LivenessHandler returns an HTTP handler answering liveness probes
+func (c *Checker) LivenessHandler() http.Handler {
+	return handler(c.Live)
+}
+
+// ReadinessHandler returns an HTTP handler answering readiness probes
+func (c *Checker) ReadinessHandler() http.Handler {
+	return handler(c.Ready)
+}
+
+func handler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+}
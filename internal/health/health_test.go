@@ -0,0 +1,112 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	now := time.Now()
+	lastSuccess := now.Add(-time.Hour)
+	var pingErr error
+	pings := 0
+	checker := NewChecker(
+		time.Minute,
+		time.Minute,
+		func() time.Time { return lastSuccess },
+		func(ctx context.Context) error {
+			if _, ok := ctx.Deadline(); !ok {
+				t.Error("Expected ECR to be pinged with a deadline")
+			}
+			pings++
+			return pingErr
+		},
+	)
+	checker.now = func() time.Time { return now }
+
+	if err := checker.Ready(); err == nil {
+		t.Error("Expected checker not to be ready before the cache is synced")
+	}
+	checker.SetStandby(true)
+	if err := checker.Ready(); err != nil {
+		t.Errorf("Expected checker on standby to be ready, but got '%v'", err)
+	}
+	checker.SetStandby(false)
+
+	checker.SetSynced(true)
+	pingErr = errors.New("unreachable")
+	if err := checker.Ready(); err == nil {
+		t.Error("Expected checker not to be ready when ECR is unreachable")
+	}
+	pingErr = nil
+	if err := checker.Ready(); err != nil {
+		t.Errorf("Expected checker to be ready once ECR is reachable, but got '%v'", err)
+	}
+
+	lastSuccess = now
+	pings = 0
+	if err := checker.Ready(); err != nil || pings != 0 {
+		t.Errorf("Expected checker to be ready without pinging ECR, but got '%v' and %d pings", err, pings)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	now := time.Now()
+	checker := NewChecker(time.Minute, time.Minute, time.Now, func(context.Context) error { return nil })
+	checker.now = func() time.Time { return now }
+
+	done := checker.StartWork()
+	if err := checker.Live(); err != nil {
+		t.Errorf("Expected checker to be live, but got '%v'", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := checker.Live(); err == nil {
+		t.Error("Expected checker to detect the stalled worker")
+	}
+	done()
+	if err := checker.Live(); err != nil {
+		t.Errorf("Expected checker to be live once the worker is done, but got '%v'", err)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	checker := NewChecker(time.Minute, time.Minute, time.Now, func(context.Context) error { return nil })
+	var tests = []struct {
+		description string
+		handler     http.Handler
+		expected    int
+	}{
+		{"liveness", checker.LivenessHandler(), http.StatusOK},
+		{"readiness", checker.ReadinessHandler(), http.StatusServiceUnavailable},
+		{"nil checker", (*Checker)(nil).ReadinessHandler(), http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			test.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+			if recorder.Code != test.expected {
+				t.Errorf("Expected status %d, but got %d instead", test.expected, recorder.Code)
+			}
+		})
+	}
+}
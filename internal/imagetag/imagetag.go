@@ -0,0 +1,35 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagetag
+
+import "strings"
+
+// HasPrefix reports whether one of the given tags starts with the given prefix,
+// which is how tag prefixes protect images, both for the tagger and for the tag prefixes of lifecycle policy rules
+func HasPrefix(tags []string, prefix string) bool {
+	_, ok := WithPrefix(tags, prefix)
+	return ok
+}
+
+// WithPrefix returns the first of the given tags that starts with the given prefix
+func WithPrefix(tags []string, prefix string) (string, bool) {
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return tag, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,45 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package imagetag
+
+import "testing"
+
+func TestWithPrefix(t *testing.T) {
+	var tests = []struct {
+		description string
+		tags        []string
+		prefix      string
+		expected    string
+		found       bool
+	}{
+		{"no tags", nil, "deployed", "", false},
+		{"no match", []string{"latest", "v1"}, "deployed", "", false},
+		{"first match", []string{"latest", "deployed1599999999", "deployed1600000000"}, "deployed", "deployed1599999999", true},
+		{"exact tag", []string{"production"}, "production", "production", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, found := WithPrefix(test.tags, test.prefix)
+			if actual != test.expected || found != test.found {
+				t.Errorf("Expected tag '%s' (%t), but got '%s' (%t) instead", test.expected, test.found, actual, found)
+			}
+			if HasPrefix(test.tags, test.prefix) != test.found {
+				t.Errorf("Expected HasPrefix to be %t", test.found)
+			}
+		})
+	}
+}
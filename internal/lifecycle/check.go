@@ -0,0 +1,86 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lifecycle
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Finding is a rule of a lifecycle policy that could expire images with a managed tag
+type Finding struct {
+	Rule    Rule
+	Message string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("rule %d: %s", f.Rule.RulePriority, f.Message)
+}
+
+// Check returns the rules of the policy that could expire images with a tag starting with the given prefix.
+// Images with such a tag are safe once a rule keeping all of them was evaluated
+func (p *Policy) Check(tagPrefix string) []Finding {
+	var findings []Finding
+	for _, rule := range p.SortedRules() {
+		if rule.Action.Type != ActionExpire || rule.Selection.TagStatus == TagStatusUntagged {
+			continue
+		}
+		keepsAll := rule.Selection.CountType == CountTypeImageCountMoreThan && rule.Selection.CountNumber >= maxImageCount
+		if !rule.Selection.selectsPrefix(tagPrefix) {
+			if keepsAll {
+				continue
+			}
+			findings = append(findings, Finding{
+				Rule:    rule,
+				Message: fmt.Sprintf("selects images with tags starting with '%s' before a rule keeps images with a tag starting with '%s' and could expire them", strings.Join(rule.Selection.TagPrefixList, "', '"), tagPrefix),
+			})
+			continue
+		}
+		switch rule.Selection.CountType {
+		case CountTypeImageCountMoreThan:
+			if !keepsAll {
+				findings = append(findings, Finding{
+					Rule:    rule,
+					Message: fmt.Sprintf("expires images with a tag starting with '%s' beyond the %d most recent", tagPrefix, rule.Selection.CountNumber),
+				})
+			}
+		case CountTypeSinceImagePushed:
+			findings = append(findings, Finding{
+				Rule:    rule,
+				Message: fmt.Sprintf("expires images with a tag starting with '%s' pushed more than %d days ago", tagPrefix, rule.Selection.CountNumber),
+			})
+		}
+		// All images with a managed tag are selected by this rule, lower priority rules cannot expire them
+		return findings
+	}
+	return findings
+}
+
+// selectsPrefix reports whether the selection selects all images with a tag starting with the given prefix
+func (s Selection) selectsPrefix(tagPrefix string) bool {
+	switch s.TagStatus {
+	case TagStatusAny:
+		return true
+	case TagStatusUntagged:
+		return false
+	}
+	for _, prefix := range s.TagPrefixList {
+		if !strings.HasPrefix(tagPrefix, prefix) {
+			return false
+		}
+	}
+	return true
+}
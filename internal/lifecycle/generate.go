@@ -0,0 +1,101 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+)
+
+// maxImageCount is the maximum number of images in an ECR repository.
+// A count rule keeping this many images never expires any of them
+const maxImageCount = 10000
+
+// GenerateOptions configures the rules of a generated lifecycle policy
+type GenerateOptions struct {
+	// TagPrefix is the prefix of the tags of the images that are kept
+	TagPrefix string
+	// UntaggedDays is the number of days after which untagged images expire, 0 keeps them
+	UntaggedDays int
+	// KeepCount is the number of most recently pushed images that are kept among the other images, 0 keeps them all
+	KeepCount int
+	// MaxAgeDays is the number of days after which the other images expire, 0 keeps them
+	MaxAgeDays int
+}
+
+// Generate returns a lifecycle policy that keeps the images with a tag starting with the given prefix
+// and expires the other images by age or count
+func Generate(options GenerateOptions) (*Policy, error) {
+	if options.TagPrefix == "" {
+		return nil, errors.New("The tag prefix of the images to keep cannot be empty")
+	}
+	if options.KeepCount > 0 && options.MaxAgeDays > 0 {
+		return nil, errors.New("Other images can either be expired by count or by age, not both")
+	}
+	policy := &Policy{
+		Rules: []Rule{{
+			RulePriority: 1,
+			Description:  fmt.Sprintf("Keep images with a tag starting with '%s'", options.TagPrefix),
+			Selection: Selection{
+				TagStatus:     TagStatusTagged,
+				TagPrefixList: []string{options.TagPrefix},
+				CountType:     CountTypeImageCountMoreThan,
+				CountNumber:   maxImageCount,
+			},
+			Action: Action{Type: ActionExpire},
+		}},
+	}
+	if options.UntaggedDays > 0 {
+		policy.Rules = append(policy.Rules, Rule{
+			RulePriority: len(policy.Rules) + 1,
+			Description:  fmt.Sprintf("Expire untagged images after %d days", options.UntaggedDays),
+			Selection: Selection{
+				TagStatus:   TagStatusUntagged,
+				CountType:   CountTypeSinceImagePushed,
+				CountUnit:   CountUnitDays,
+				CountNumber: options.UntaggedDays,
+			},
+			Action: Action{Type: ActionExpire},
+		})
+	}
+	// Rules selecting any image must be evaluated last
+	switch {
+	case options.KeepCount > 0:
+		policy.Rules = append(policy.Rules, Rule{
+			RulePriority: len(policy.Rules) + 1,
+			Description:  fmt.Sprintf("Keep the %d most recent other images", options.KeepCount),
+			Selection: Selection{
+				TagStatus:   TagStatusAny,
+				CountType:   CountTypeImageCountMoreThan,
+				CountNumber: options.KeepCount,
+			},
+			Action: Action{Type: ActionExpire},
+		})
+	case options.MaxAgeDays > 0:
+		policy.Rules = append(policy.Rules, Rule{
+			RulePriority: len(policy.Rules) + 1,
+			Description:  fmt.Sprintf("Expire other images after %d days", options.MaxAgeDays),
+			Selection: Selection{
+				TagStatus:   TagStatusAny,
+				CountType:   CountTypeSinceImagePushed,
+				CountUnit:   CountUnitDays,
+				CountNumber: options.MaxAgeDays,
+			},
+			Action: Action{Type: ActionExpire},
+		})
+	}
+	return policy, nil
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lifecycle
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/imagetag"
+)
+
+// Values of the fields of a lifecycle policy rule, see
+// https://docs.aws.amazon.com/AmazonECR/latest/userguide/LifecyclePolicies.html#lifecycle_policy_parameters
+const (
+	TagStatusTagged   = "tagged"
+	TagStatusUntagged = "untagged"
+	TagStatusAny      = "any"
+
+	CountTypeImageCountMoreThan = "imageCountMoreThan"
+	CountTypeSinceImagePushed   = "sinceImagePushed"
+
+	CountUnitDays = "days"
+
+	ActionExpire = "expire"
+)
+
+// Policy is an ECR lifecycle policy
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule is a rule of an ECR lifecycle policy
+type Rule struct {
+	RulePriority int       `json:"rulePriority"`
+	Description  string    `json:"description,omitempty"`
+	Selection    Selection `json:"selection"`
+	Action       Action    `json:"action"`
+}
+
+// Selection selects the images to which a rule applies
+type Selection struct {
+	TagStatus     string   `json:"tagStatus"`
+	TagPrefixList []string `json:"tagPrefixList,omitempty"`
+	CountType     string   `json:"countType"`
+	CountUnit     string   `json:"countUnit,omitempty"`
+	CountNumber   int      `json:"countNumber"`
+}
+
+// Action is the action taken on the images selected by a rule
+type Action struct {
+	Type string `json:"type"`
+}
+
+// Image is an image of a repository as seen by the lifecycle policy
+type Image struct {
+	Digest   string
+	Tags     []string
+	PushedAt time.Time
+}
+
+// Result is the outcome of the evaluation of a lifecycle policy for a single image
+type Result struct {
+	Image Image
+	// Rule is the rule that selected the image, or nil if no rule did
+	Rule *Rule
+	// Expired reports whether the image would be expired by the rule
+	Expired bool
+}
+
+// Parse parses the given lifecycle policy text
+func Parse(text string) (*Policy, error) {
+	var policy Policy
+	if err := json.Unmarshal([]byte(text), &policy); err != nil {
+		return nil, fmt.Errorf("Could not parse lifecycle policy: %v", err)
+	}
+	return &policy, nil
+}
+
+// String returns the lifecycle policy text
+func (p *Policy) String() string {
+	text, _ := json.MarshalIndent(p, "", "  ")
+	return string(text)
+}
+
+// SortedRules returns the rules of the policy sorted by priority, from the first evaluated to the last
+func (p *Policy) SortedRules() []Rule {
+	rules := append([]Rule(nil), p.Rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].RulePriority < rules[j].RulePriority
+	})
+	return rules
+}
+
+// Matches reports whether the rule's tag selection applies to the given tags
+func (s Selection) Matches(tags []string) bool {
+	switch s.TagStatus {
+	case TagStatusUntagged:
+		return len(tags) == 0
+	case TagStatusTagged:
+		if len(tags) == 0 {
+			return false
+		}
+		// An image is only selected if each prefix of the list matches one of its tags
+		for _, prefix := range s.TagPrefixList {
+			if !imagetag.HasPrefix(tags, prefix) {
+				return false
+			}
+		}
+		return true
+	case TagStatusAny:
+		return true
+	}
+	return false
+}
+
+// Evaluate returns which of the given images the policy would expire at the given time.
+// Rules are evaluated by priority and an image selected by a rule cannot be expired by a rule with a lower priority
+func (p *Policy) Evaluate(images []Image, now time.Time) []Result {
+	results := make([]Result, len(images))
+	selected := make([]bool, len(images))
+	for i, image := range images {
+		results[i].Image = image
+	}
+	for _, rule := range p.SortedRules() {
+		rule := rule
+		var candidates []int
+		for i, image := range images {
+			if !selected[i] && rule.Selection.Matches(image.Tags) {
+				candidates = append(candidates, i)
+			}
+		}
+		// Images are considered from the most recently pushed to the oldest
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return images[candidates[a]].PushedAt.After(images[candidates[b]].PushedAt)
+		})
+		for n, i := range candidates {
+			selected[i] = true
+			results[i].Rule = &rule
+			if rule.Action.Type != ActionExpire {
+				continue
+			}
+			switch rule.Selection.CountType {
+			case CountTypeImageCountMoreThan:
+				results[i].Expired = n >= rule.Selection.CountNumber
+			case CountTypeSinceImagePushed:
+				age := time.Duration(rule.Selection.CountNumber) * 24 * time.Hour
+				results[i].Expired = now.Sub(images[i].PushedAt) > age
+			}
+		}
+	}
+	return results
+}
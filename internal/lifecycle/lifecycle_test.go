@@ -0,0 +1,184 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lifecycle
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	policy, err := Parse(`{"rules": [{"rulePriority": 1, "selection": {"tagStatus": "untagged", "countType": "sinceImagePushed", "countUnit": "days", "countNumber": 14}, "action": {"type": "expire"}}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Policy{Rules: []Rule{{
+		RulePriority: 1,
+		Selection:    Selection{TagStatus: TagStatusUntagged, CountType: CountTypeSinceImagePushed, CountUnit: CountUnitDays, CountNumber: 14},
+		Action:       Action{Type: ActionExpire},
+	}}}
+	if diff := cmp.Diff(policy, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", policy, diff)
+	}
+	if _, err := Parse("not json"); err == nil {
+		t.Error("Expected an error for an invalid policy")
+	}
+}
+
+func TestSelectionMatches(t *testing.T) {
+	var tests = []struct {
+		description string
+		selection   Selection
+		tags        []string
+		expected    bool
+	}{
+		{"untagged image", Selection{TagStatus: TagStatusUntagged}, nil, true},
+		{"untagged rule and tagged image", Selection{TagStatus: TagStatusUntagged}, []string{"latest"}, false},
+		{"tagged rule and untagged image", Selection{TagStatus: TagStatusTagged}, nil, false},
+		{"prefix", Selection{TagStatus: TagStatusTagged, TagPrefixList: []string{"prod"}}, []string{"latest", "production"}, true},
+		{"all prefixes must match", Selection{TagStatus: TagStatusTagged, TagPrefixList: []string{"prod", "v1"}}, []string{"production"}, false},
+		{"any", Selection{TagStatus: TagStatusAny}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if actual := test.selection.Matches(test.tags); actual != test.expected {
+				t.Errorf("Expected %t, but got %t instead", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	images := []Image{
+		{Digest: "sha256:1", Tags: []string{"v1", "deployed1"}, PushedAt: now.Add(-30 * day)},
+		{Digest: "sha256:2", Tags: []string{"v2"}, PushedAt: now.Add(-20 * day)},
+		{Digest: "sha256:3", Tags: []string{"v3"}, PushedAt: now.Add(-10 * day)},
+		{Digest: "sha256:4", PushedAt: now.Add(-2 * day)},
+	}
+	keep := Rule{RulePriority: 1, Selection: Selection{TagStatus: TagStatusTagged, TagPrefixList: []string{"deployed"}, CountType: CountTypeImageCountMoreThan, CountNumber: 9999}, Action: Action{Type: ActionExpire}}
+	untagged := Rule{RulePriority: 2, Selection: Selection{TagStatus: TagStatusUntagged, CountType: CountTypeSinceImagePushed, CountUnit: CountUnitDays, CountNumber: 1}, Action: Action{Type: ActionExpire}}
+	count := Rule{RulePriority: 3, Selection: Selection{TagStatus: TagStatusAny, CountType: CountTypeImageCountMoreThan, CountNumber: 1}, Action: Action{Type: ActionExpire}}
+
+	var tests = []struct {
+		description string
+		rules       []Rule
+		expected    []bool
+	}{
+		{"count only", []Rule{count}, []bool{true, true, true, false}},
+		{"higher priority rule protects images", []Rule{count, untagged, keep}, []bool{false, true, false, true}},
+		{"no rules", nil, []bool{false, false, false, false}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			policy := &Policy{Rules: test.rules}
+			var actual []bool
+			for _, result := range policy.Evaluate(images, now) {
+				actual = append(actual, result.Expired)
+			}
+			if diff := cmp.Diff(actual, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", actual, diff)
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	images := []Image{
+		{Digest: "sha256:1", Tags: []string{"v1", "production1"}, PushedAt: now.Add(-400 * day)},
+		{Digest: "sha256:2", Tags: []string{"v2"}, PushedAt: now.Add(-300 * day)},
+		{Digest: "sha256:3", PushedAt: now.Add(-30 * day)},
+		{Digest: "sha256:4", Tags: []string{"v4"}, PushedAt: now.Add(-2 * day)},
+	}
+
+	var tests = []struct {
+		description string
+		options     GenerateOptions
+		expected    []bool
+		expectedErr bool
+	}{
+		{"count", GenerateOptions{TagPrefix: "production", UntaggedDays: 14, KeepCount: 1}, []bool{false, true, true, false}, false},
+		{"age", GenerateOptions{TagPrefix: "production", MaxAgeDays: 90}, []bool{false, true, false, false}, false},
+		{"no prefix", GenerateOptions{KeepCount: 1}, nil, true},
+		{"count and age", GenerateOptions{TagPrefix: "production", KeepCount: 1, MaxAgeDays: 90}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			policy, err := Generate(test.options)
+			if (err != nil) != test.expectedErr {
+				t.Fatalf("Expected error to be %t, but got '%v' instead", test.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+			var actual []bool
+			for _, result := range policy.Evaluate(images, now) {
+				actual = append(actual, result.Expired)
+			}
+			if diff := cmp.Diff(actual, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", actual, diff)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	expire := Action{Type: ActionExpire}
+	keepDeployed := Rule{RulePriority: 1, Selection: Selection{TagStatus: TagStatusTagged, TagPrefixList: []string{"deployed"}, CountType: CountTypeImageCountMoreThan, CountNumber: maxImageCount}, Action: expire}
+	untagged := Rule{RulePriority: 2, Selection: Selection{TagStatus: TagStatusUntagged, CountType: CountTypeSinceImagePushed, CountUnit: CountUnitDays, CountNumber: 14}, Action: expire}
+	versions := Rule{RulePriority: 3, Selection: Selection{TagStatus: TagStatusTagged, TagPrefixList: []string{"v"}, CountType: CountTypeImageCountMoreThan, CountNumber: 10}, Action: expire}
+	anyAge := Rule{RulePriority: 4, Selection: Selection{TagStatus: TagStatusAny, CountType: CountTypeSinceImagePushed, CountUnit: CountUnitDays, CountNumber: 90}, Action: expire}
+
+	var tests = []struct {
+		description string
+		rules       []Rule
+		tagPrefix   string
+		expected    []int
+	}{
+		{"generated policy", []Rule{keepDeployed, untagged, versions, anyAge}, "deployed", nil},
+		{"shorter prefix", []Rule{keepDeployed, untagged, anyAge}, "deployed-production", nil},
+		{"no rule keeps managed images", []Rule{untagged, versions, anyAge}, "deployed", []int{3, 4}},
+		{"other prefix", []Rule{keepDeployed, anyAge}, "production", []int{4}},
+		{"any rule with higher priority", []Rule{keepDeployed, untagged, withPriority(anyAge, 0)}, "deployed", []int{0}},
+		{"only untagged rules", []Rule{untagged}, "deployed", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			policy := &Policy{Rules: test.rules}
+			var actual []int
+			for _, finding := range policy.Check(test.tagPrefix) {
+				actual = append(actual, finding.Rule.RulePriority)
+			}
+			if diff := cmp.Diff(actual, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", actual, diff)
+			}
+		})
+	}
+}
+
+func withPriority(rule Rule, priority int) Rule {
+	rule.RulePriority = priority
+	return rule
+}
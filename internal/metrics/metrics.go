@@ -0,0 +1,122 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "kube_ecr_tagger"
+
+// Reasons for which an image is skipped instead of being tagged
+const (
+	SkippedNotECR         = "not-ecr"
+	SkippedCurrentTag     = "current-tag"
+	SkippedRecorded       = "recorded"
+	SkippedHasTag         = "has-tag"
+	SkippedAlreadyTagged  = "already-tagged"
+	SkippedImageNotFound  = "image-not-found"
+	SkippedLookupFailed   = "lookup-failed"
+	SkippedManifestFailed = "manifest-failed"
+	SkippedScanFindings   = "scan-findings"
+)
+
+var (
+	// ImagesDiscovered counts the ECR images found in Pod specs
+	ImagesDiscovered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_discovered_total",
+		Help:      "Number of ECR images found in Pod specs.",
+	})
+	// ImagesTagged counts the images that were tagged on ECR
+	ImagesTagged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_tagged_total",
+		Help:      "Number of images tagged on ECR.",
+	})
+	// ImagesUntagged counts the images no longer in use whose managed tags were removed from ECR
+	ImagesUntagged = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_untagged_total",
+		Help:      "Number of images no longer in use whose managed tags were removed from ECR.",
+	})
+	// ImagesSkipped counts the images that were not tagged, by reason
+	ImagesSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_skipped_total",
+		Help:      "Number of images that were not tagged, by reason.",
+	}, []string{"reason"})
+	// ImagesFailed counts the images that could not be tagged, by AWS error code
+	ImagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_failed_total",
+		Help:      "Number of images that could not be tagged, by AWS error code.",
+	}, []string{"code"})
+	// APICallDuration observes the latency of ECR API calls, by operation
+	APICallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ecr_api_call_duration_seconds",
+		Help:      "Latency of ECR API calls, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	// ImagesQuarantined counts the images tagged with the quarantine tag because of their scan findings
+	ImagesQuarantined = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_quarantined_total",
+		Help:      "Number of images tagged with the quarantine tag because of their scan findings.",
+	})
+	// ImagesMissing is the number of images used by Pods that are missing from ECR
+	ImagesMissing = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "images_missing",
+		Help:      "Number of images used by Pods whose repository or image is missing from ECR.",
+	})
+	// QueueDepth is the number of Pods waiting to be processed
+	QueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_depth",
+		Help:      "Number of Pods waiting to be processed.",
+	})
+	// LastSuccessfulSync is the time at which a Pod was last processed successfully
+	LastSuccessfulSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time at which a Pod was last processed successfully.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ImagesDiscovered,
+		ImagesTagged,
+		ImagesUntagged,
+		ImagesSkipped,
+		ImagesFailed,
+		ImagesQuarantined,
+		ImagesMissing,
+		APICallDuration,
+		QueueDepth,
+		LastSuccessfulSync,
+	)
+}
+
+// Handler returns the HTTP handler serving the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
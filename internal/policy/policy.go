@@ -0,0 +1,344 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Group and version of the TaggingPolicy and ClusterTaggingPolicy custom resources
+const (
+	Group   = "kube-ecr-tagger.io"
+	Version = "v1alpha1"
+)
+
+var (
+	// TaggingPolicyResource is the resource of the namespaced TaggingPolicy objects
+	TaggingPolicyResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "taggingpolicies"}
+	// ClusterTaggingPolicyResource is the resource of the cluster-scoped ClusterTaggingPolicy objects
+	ClusterTaggingPolicyResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "clustertaggingpolicies"}
+)
+
+// ConditionReady is the type of the condition reporting whether a policy is applied
+const ConditionReady = "Ready"
+
+// Reasons of the Ready condition
+const (
+	ReasonApplied     = "Applied"
+	ReasonInvalidSpec = "InvalidSpec"
+)
+
+// TaggingPolicy configures how the images used by the Pods it selects are tagged.
+// ClusterTaggingPolicy objects have the same fields and an empty namespace
+type TaggingPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec is the desired configuration of a policy
+type Spec struct {
+	// Selector selects the Pods to which the policy applies. All Pods are selected when it is nil
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// Tag is added to the images, it cannot be set together with TagPrefix
+	Tag string `json:"tag,omitempty"`
+	// TagPrefix is the prefix of the tags added to the images
+	TagPrefix string `json:"tagPrefix,omitempty"`
+	// TagTemplate is a text/template rendering the tags added to the images. They must start with TagPrefix
+	TagTemplate string `json:"tagTemplate,omitempty"`
+	// Rotation limits the number of images no longer in use that keep a managed tag
+	Rotation *Rotation `json:"rotation,omitempty"`
+	// Cleanup removes the managed tags of images that were not used for some time
+	Cleanup *Cleanup `json:"cleanup,omitempty"`
+}
+
+// Rotation limits the number of images no longer in use that keep a managed tag
+type Rotation struct {
+	// KeepLast is the number of most recently tagged images of each repository that keep their managed tags
+	// once they are no longer in use
+	KeepLast int `json:"keepLast"`
+}
+
+// Cleanup removes the managed tags of images that were not used for some time
+type Cleanup struct {
+	// UntagAfter is how long an image must not have been used before its managed tags are removed
+	UntagAfter metav1.Duration `json:"untagAfter"`
+}
+
+// Status is the observed state of a policy
+type Status struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// CoveredImages is the number of images used by the Pods selected by the policy
+	CoveredImages int         `json:"coveredImages"`
+	Conditions    []Condition `json:"conditions,omitempty"`
+}
+
+// Condition describes one aspect of the state of a policy
+type Condition struct {
+	Type               string                 `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+}
+
+// TemplateData holds the values available to tag templates
+type TemplateData struct {
+	// Prefix is the policy's tag prefix
+	Prefix string
+	// Timestamp is the current unix time
+	Timestamp int64
+	// Date is the current date formatted as YYYYMMDD
+	Date      string
+	Namespace string
+	Pod       string
+}
+
+// FromUnstructured converts an object returned by the dynamic client to a TaggingPolicy
+func FromUnstructured(obj *unstructured.Unstructured) (*TaggingPolicy, error) {
+	var policy TaggingPolicy
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.UnstructuredContent(), &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// ToUnstructured converts the policy to an object that can be passed to the dynamic client
+func (p *TaggingPolicy) ToUnstructured() (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// Key returns the namespace and name of the policy, or only its name if it is cluster-scoped
+func (p *TaggingPolicy) Key() string {
+	if p.Namespace == "" {
+		return p.Name
+	}
+	return p.Namespace + "/" + p.Name
+}
+
+// Policy is a TaggingPolicy whose spec was validated
+type Policy struct {
+	*TaggingPolicy
+	// Err is the reason why the spec is invalid, the policy is then ignored
+	Err error
+
+	selector labels.Selector
+	template *template.Template
+}
+
+// Compile validates the spec of the given policy and prepares its selector and template
+func Compile(taggingPolicy *TaggingPolicy) *Policy {
+	policy := &Policy{TaggingPolicy: taggingPolicy}
+	policy.Err = policy.compile()
+	return policy
+}
+
+func (p *Policy) compile() error {
+	spec := p.Spec
+	if (spec.Tag == "") == (spec.TagPrefix == "") {
+		return fmt.Errorf("Exactly one of tag and tagPrefix must be set")
+	}
+	if spec.Rotation != nil && spec.Rotation.KeepLast < 1 {
+		return fmt.Errorf("rotation.keepLast must be at least 1")
+	}
+	if spec.Cleanup != nil && spec.Cleanup.UntagAfter.Duration <= 0 {
+		return fmt.Errorf("cleanup.untagAfter must be positive")
+	}
+	selector := labels.Everything()
+	if spec.Selector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(spec.Selector)
+		if err != nil {
+			return fmt.Errorf("Invalid selector: %v", err)
+		}
+	}
+	p.selector = selector
+	if spec.TagTemplate == "" {
+		return nil
+	}
+	if spec.TagPrefix == "" {
+		return fmt.Errorf("tagTemplate requires tagPrefix to be set")
+	}
+	tmpl, err := template.New(p.Key()).Option("missingkey=error").Parse(spec.TagTemplate)
+	if err != nil {
+		return fmt.Errorf("Invalid tagTemplate: %v", err)
+	}
+	p.template = tmpl
+	// Render the template once to catch references to unknown fields and tags without the prefix
+	_, err = p.renderTag(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod"}}, time.Now())
+	return err
+}
+
+// Selects reports whether the policy applies to the given Pod
+func (p *Policy) Selects(pod *corev1.Pod) bool {
+	if p.Err != nil {
+		return false
+	}
+	if p.Namespace != "" && p.Namespace != pod.Namespace {
+		return false
+	}
+	return p.selector.Matches(labels.Set(pod.Labels))
+}
+
+// ManagedPrefix returns the prefix of the tags managed by the policy
+func (p *Policy) ManagedPrefix() string {
+	if p.Spec.Tag != "" {
+		return p.Spec.Tag
+	}
+	return p.Spec.TagPrefix
+}
+
+// NextTag returns the tag to add to the images of the given Pod and the prefix of the tags that make adding it unnecessary
+func (p *Policy) NextTag(pod *corev1.Pod, now time.Time) (tag, tagPrefix string, err error) {
+	if p.Spec.Tag != "" {
+		return p.Spec.Tag, p.Spec.Tag, nil
+	}
+	if p.template == nil {
+		return p.Spec.TagPrefix + strconv.FormatInt(now.Unix(), 10), p.Spec.TagPrefix, nil
+	}
+	tag, err = p.renderTag(pod, now)
+	if err != nil {
+		return "", "", err
+	}
+	return tag, p.Spec.TagPrefix, nil
+}
+
+func (p *Policy) renderTag(pod *corev1.Pod, now time.Time) (string, error) {
+	data := TemplateData{
+		Prefix:    p.Spec.TagPrefix,
+		Timestamp: now.Unix(),
+		Date:      now.UTC().Format("20060102"),
+		Namespace: pod.Namespace,
+		Pod:       pod.Name,
+	}
+	var buffer bytes.Buffer
+	if err := p.template.Execute(&buffer, data); err != nil {
+		return "", fmt.Errorf("Could not render tagTemplate: %v", err)
+	}
+	tag := buffer.String()
+	if !strings.HasPrefix(tag, p.Spec.TagPrefix) {
+		return "", fmt.Errorf("Tag '%s' rendered by tagTemplate does not start with tagPrefix '%s'", tag, p.Spec.TagPrefix)
+	}
+	return tag, nil
+}
+
+// UpdatedStatus returns the status of a policy covering the given number of images,
+// and whether it differs from the policy's current status
+func (p *Policy) UpdatedStatus(coveredImages int, now time.Time) (Status, bool) {
+	status := Status{
+		ObservedGeneration: p.Generation,
+		CoveredImages:      coveredImages,
+	}
+	condition := Condition{
+		Type:    ConditionReady,
+		Status:  corev1.ConditionTrue,
+		Reason:  ReasonApplied,
+		Message: fmt.Sprintf("Policy covers %d images", coveredImages),
+	}
+	if p.Err != nil {
+		status.CoveredImages = 0
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = ReasonInvalidSpec
+		condition.Message = p.Err.Error()
+	}
+	condition.LastTransitionTime = metav1.NewTime(now)
+	for _, previous := range p.Status.Conditions {
+		if previous.Type == condition.Type && previous.Status == condition.Status {
+			condition.LastTransitionTime = previous.LastTransitionTime
+		}
+	}
+	status.Conditions = []Condition{condition}
+	return status, !equality.Semantic.DeepEqual(status, p.Status)
+}
+
+// Set holds the policies the tagger knows about. Its methods can be called concurrently
+type Set struct {
+	mu       sync.RWMutex
+	policies map[string]*Policy
+}
+
+// NewSet instantiates a new, empty, Set
+func NewSet() *Set {
+	return &Set{policies: make(map[string]*Policy)}
+}
+
+// Put adds a policy to the set, replacing the one with the same key
+func (s *Set) Put(policy *Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policies[policy.Key()] = policy
+}
+
+// Delete removes the policy with the given key from the set
+func (s *Set) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.policies, key)
+}
+
+// List returns the policies of the set ordered by key
+func (s *Set) List() []*Policy {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	policies := make([]*Policy, 0, len(s.policies))
+	for _, policy := range s.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Key() < policies[j].Key()
+	})
+	return policies
+}
+
+// Match returns the policy that applies to the given Pod, or nil if there is none.
+// TaggingPolicies in the Pod's namespace take precedence over ClusterTaggingPolicies,
+// and policies of the same kind are ordered by name
+func (s *Set) Match(pod *corev1.Pod) *Policy {
+	var match *Policy
+	for _, policy := range s.List() {
+		if !policy.Selects(pod) {
+			continue
+		}
+		if match == nil || (match.Namespace == "" && policy.Namespace != "") {
+			match = policy
+		}
+	}
+	return match
+}
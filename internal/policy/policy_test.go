@@ -0,0 +1,195 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package policy
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func definePolicy(namespace, name string, spec Spec) *Policy {
+	return Compile(&TaggingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Generation: 1},
+		Spec:       spec,
+	})
+}
+
+func definePod(namespace, name string, labels map[string]string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+}
+
+func TestFromUnstructured(t *testing.T) {
+	object := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Group + "/" + Version,
+		"kind":       "ClusterTaggingPolicy",
+		"metadata":   map[string]interface{}{"name": "production"},
+		"spec": map[string]interface{}{
+			"selector":  map[string]interface{}{"matchLabels": map[string]interface{}{"env": "production"}},
+			"tagPrefix": "production",
+			"cleanup":   map[string]interface{}{"untagAfter": "720h"},
+		},
+	}}
+	policy, err := FromUnstructured(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Key() != "production" {
+		t.Errorf("Expected key 'production', but got '%s' instead", policy.Key())
+	}
+	if policy.Spec.Cleanup == nil || policy.Spec.Cleanup.UntagAfter.Duration != 720*time.Hour {
+		t.Errorf("Expected cleanup after 720h, but got '%v' instead", policy.Spec.Cleanup)
+	}
+	if err := Compile(policy).Err; err != nil {
+		t.Errorf("Expected policy to be valid, but got '%v' instead", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	var tests = []struct {
+		description string
+		spec        Spec
+		valid       bool
+	}{
+		{"prefix", Spec{TagPrefix: "deployed"}, true},
+		{"tag", Spec{Tag: "production"}, true},
+		{"template", Spec{TagPrefix: "deployed-", TagTemplate: "{{.Prefix}}{{.Namespace}}-{{.Date}}"}, true},
+		{"tag and prefix", Spec{Tag: "production", TagPrefix: "deployed"}, false},
+		{"neither tag nor prefix", Spec{}, false},
+		{"template without prefix", Spec{Tag: "production", TagTemplate: "{{.Date}}"}, false},
+		{"template with unknown field", Spec{TagPrefix: "deployed", TagTemplate: "{{.Prefix}}{{.Cluster}}"}, false},
+		{"template without prefix in tag", Spec{TagPrefix: "deployed", TagTemplate: "{{.Date}}"}, false},
+		{"invalid selector", Spec{TagPrefix: "deployed", Selector: &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "env", Operator: "Unknown"}},
+		}}, false},
+		{"negative rotation", Spec{TagPrefix: "deployed", Rotation: &Rotation{KeepLast: -1}}, false},
+		{"zero rotation", Spec{TagPrefix: "deployed", Rotation: &Rotation{KeepLast: 0}}, false},
+		{"zero cleanup", Spec{TagPrefix: "deployed", Cleanup: &Cleanup{}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := definePolicy("default", "policy", test.spec).Err
+			if test.valid && err != nil {
+				t.Errorf("Expected policy to be valid, but got '%v' instead", err)
+			}
+			if !test.valid && err == nil {
+				t.Error("Expected policy to be invalid")
+			}
+		})
+	}
+}
+
+func TestNextTag(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	pod := definePod("team-a", "app", nil)
+	var tests = []struct {
+		description    string
+		spec           Spec
+		expectedTag    string
+		expectedPrefix string
+	}{
+		{"tag", Spec{Tag: "production"}, "production", "production"},
+		{"prefix", Spec{TagPrefix: "deployed"}, "deployed1600000000", "deployed"},
+		{"template", Spec{TagPrefix: "deployed-", TagTemplate: "{{.Prefix}}{{.Namespace}}-{{.Date}}"}, "deployed-team-a-20200913", "deployed-"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			tag, tagPrefix, err := definePolicy("", "policy", test.spec).NextTag(pod, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tag != test.expectedTag || tagPrefix != test.expectedPrefix {
+				t.Errorf("Expected tag '%s' and prefix '%s', but got '%s' and '%s' instead", test.expectedTag, test.expectedPrefix, tag, tagPrefix)
+			}
+		})
+	}
+}
+
+func TestSetMatch(t *testing.T) {
+	set := NewSet()
+	set.Put(definePolicy("", "b-all", Spec{TagPrefix: "cluster-b"}))
+	set.Put(definePolicy("", "a-production", Spec{TagPrefix: "cluster-a", Selector: &metav1.LabelSelector{
+		MatchLabels: map[string]string{"env": "production"},
+	}}))
+	set.Put(definePolicy("team-a", "team", Spec{TagPrefix: "team-a"}))
+	set.Put(definePolicy("team-b", "invalid", Spec{}))
+
+	var tests = []struct {
+		description string
+		pod         *corev1.Pod
+		expected    string
+	}{
+		{"namespaced policy first", definePod("team-a", "app", map[string]string{"env": "production"}), "team-a/team"},
+		{"cluster policies by name", definePod("team-c", "app", map[string]string{"env": "production"}), "a-production"},
+		{"selector", definePod("team-c", "app", nil), "b-all"},
+		{"invalid policy ignored", definePod("team-b", "app", nil), "b-all"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			match := set.Match(test.pod)
+			if match == nil || match.Key() != test.expected {
+				t.Errorf("Expected policy '%s' to match, but got '%v' instead", test.expected, match)
+			}
+		})
+	}
+
+	set.Delete("b-all")
+	if match := set.Match(definePod("team-c", "app", nil)); match != nil {
+		t.Errorf("Expected no policy to match, but got '%s' instead", match.Key())
+	}
+	var empty *Set
+	if match := empty.Match(definePod("team-c", "app", nil)); match != nil {
+		t.Errorf("Expected no policy to match, but got '%s' instead", match.Key())
+	}
+}
+
+func TestUpdatedStatus(t *testing.T) {
+	now := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	policy := definePolicy("default", "policy", Spec{TagPrefix: "deployed"})
+	status, changed := policy.UpdatedStatus(3, now)
+	if !changed {
+		t.Error("Expected status to change")
+	}
+	if status.CoveredImages != 3 || status.ObservedGeneration != 1 {
+		t.Errorf("Expected 3 covered images at generation 1, but got %d at generation %d instead", status.CoveredImages, status.ObservedGeneration)
+	}
+	if len(status.Conditions) != 1 || status.Conditions[0].Status != corev1.ConditionTrue || status.Conditions[0].Reason != ReasonApplied {
+		t.Errorf("Expected Ready condition, but got '%v' instead", status.Conditions)
+	}
+
+	policy.Status = status
+	if _, changed := policy.UpdatedStatus(3, now.Add(time.Minute)); changed {
+		t.Error("Expected status to be unchanged")
+	}
+	status, changed = policy.UpdatedStatus(4, now.Add(time.Minute))
+	if !changed {
+		t.Error("Expected status to change")
+	}
+	if !status.Conditions[0].LastTransitionTime.Equal(&metav1.Time{Time: now}) {
+		t.Errorf("Expected last transition time to be kept, but got '%v' instead", status.Conditions[0].LastTransitionTime)
+	}
+
+	status, _ = definePolicy("default", "policy", Spec{}).UpdatedStatus(3, now)
+	if status.CoveredImages != 0 || status.Conditions[0].Status != corev1.ConditionFalse || status.Conditions[0].Reason != ReasonInvalidSpec {
+		t.Errorf("Expected invalid spec condition, but got '%v' instead", status)
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// configMapKey is the key of the ConfigMap's data under which the records are saved
+const configMapKey = "state.json"
+
+// NewConfigMapStore instantiates a Store that persists its records as JSON in the ConfigMap with the given name.
+// The ConfigMap is created if it does not exist, otherwise the records it holds are loaded
+func NewConfigMapStore(clientset kubernetes.Interface, namespace, name string) (Store, error) {
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+	store := &persistentStore{
+		MemoryStore: NewMemoryStore(),
+		delay:       saveDelay,
+		save: func(data []byte) error {
+			return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+				configMap, err := configMaps.Get(context.TODO(), name, metav1.GetOptions{})
+				if err != nil {
+					return err
+				}
+				if configMap.Data == nil {
+					configMap.Data = make(map[string]string)
+				}
+				configMap.Data[configMapKey] = string(data)
+				_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+				return err
+			})
+		},
+	}
+	configMap, err := configMaps.Get(context.TODO(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap, err = configMaps.Create(context.TODO(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name,
+			},
+		}, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := store.unmarshal([]byte(configMap.Data[configMapKey])); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// NewFileStore instantiates a Store that persists its records as JSON in the file at the given path.
+// Records that were previously saved in the file are loaded
+func NewFileStore(path string) (Store, error) {
+	store := &persistentStore{
+		MemoryStore: NewMemoryStore(),
+		delay:       saveDelay,
+		save: func(data []byte) error {
+			return writeFile(path, data)
+		},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := store.unmarshal(data); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// writeFile atomically replaces the content of the file at the given path
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,231 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AnesBenmerzoug/kube-ecr-tagger/internal/imagetag"
+	log "github.com/sirupsen/logrus"
+)
+
+// Record describes the tags that are known to be applied to an image
+type Record struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	// Digest is the image digest, it is empty when only the tag the image was referenced with is known
+	Digest    string    `json:"digest,omitempty"`
+	Tags      []string  `json:"tags"`
+	TaggedAt  time.Time `json:"taggedAt"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// UsedAt is the time at which the image was last seen in use without its tags being checked
+	UsedAt time.Time `json:"usedAt,omitempty"`
+	// Policy is the key of the tagging policy that selected the Pod for which the tagger tagged the image, if any
+	Policy string `json:"policy,omitempty"`
+}
+
+// LastUsed returns the time at which the image was last seen in use, its tags are checked while it is in use
+func (r *Record) LastUsed() time.Time {
+	if r.UsedAt.After(r.CheckedAt) {
+		return r.UsedAt
+	}
+	return r.CheckedAt
+}
+
+// HasTagWithPrefix reports whether one of the record's tags starts with the given prefix
+func (r *Record) HasTagWithPrefix(prefix string) bool {
+	return imagetag.HasPrefix(r.Tags, prefix)
+}
+
+// TagWithPrefix returns the first of the record's tags that starts with the given prefix
+func (r *Record) TagWithPrefix(prefix string) (string, bool) {
+	return imagetag.WithPrefix(r.Tags, prefix)
+}
+
+// HasTag reports whether the record holds the given tag
+func (r *Record) HasTag(tag string) bool {
+	for _, recordTag := range r.Tags {
+		if recordTag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the key under which the record of an image is stored.
+// Images are identified by their digest when it is known and by their tag otherwise
+func Key(registry, repository, digest, tag string) string {
+	if digest != "" {
+		return fmt.Sprintf("%s/%s@%s", registry, repository, digest)
+	}
+	return fmt.Sprintf("%s/%s:%s", registry, repository, tag)
+}
+
+// Store keeps track of the images that were already tagged
+type Store interface {
+	// Get returns the record stored under the given key, if any
+	Get(key string) (*Record, bool)
+	// Put stores a record under the given key
+	Put(key string, record *Record) error
+	// Delete removes the record stored under the given key, if any
+	Delete(key string) error
+	// List returns all records indexed by key
+	List() map[string]*Record
+	// Flush persists all records
+	Flush() error
+}
+
+// MemoryStore is a Store that keeps records in memory only
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]*Record
+}
+
+// NewMemoryStore instantiates a new, empty, MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]*Record)}
+}
+
+// Get returns the record stored under the given key, if any
+func (s *MemoryStore) Get(key string) (*Record, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.records[key]
+	return record, ok
+}
+
+// Put stores a record under the given key
+func (s *MemoryStore) Put(key string, record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = record
+	return nil
+}
+
+// Delete removes the record stored under the given key, if any
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// List returns all records indexed by key
+func (s *MemoryStore) List() map[string]*Record {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make(map[string]*Record, len(s.records))
+	for key, record := range s.records {
+		records[key] = record
+	}
+	return records
+}
+
+// Flush does nothing since records are not persisted
+func (s *MemoryStore) Flush() error {
+	return nil
+}
+
+// marshal encodes all records as JSON
+func (s *MemoryStore) marshal() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return json.MarshalIndent(s.records, "", "  ")
+}
+
+// unmarshal replaces all records with the ones encoded in the given JSON data
+func (s *MemoryStore) unmarshal(data []byte) error {
+	records := make(map[string]*Record)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &records); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = records
+	return nil
+}
+
+// saveDelay is how long a persistent store waits after a record changed before saving all records,
+// so that the changes made in the meantime are saved at once
+const saveDelay = 10 * time.Second
+
+// persistentStore is a MemoryStore that saves all of its records shortly after one of them changes
+type persistentStore struct {
+	*MemoryStore
+	// saveMu makes sure that records are saved in the order in which they were changed
+	saveMu sync.Mutex
+	save   func(data []byte) error
+	// delay is how long changes are collected before they are saved
+	delay time.Duration
+
+	timerMu sync.Mutex
+	// timer saves the records once the delay is over, it is nil if no change is waiting to be saved
+	timer *time.Timer
+}
+
+// Put stores a record under the given key, all records are persisted after the store's delay
+func (s *persistentStore) Put(key string, record *Record) error {
+	if err := s.MemoryStore.Put(key, record); err != nil {
+		return err
+	}
+	s.scheduleSave()
+	return nil
+}
+
+// Delete removes the record stored under the given key, all records are persisted after the store's delay
+func (s *persistentStore) Delete(key string) error {
+	if err := s.MemoryStore.Delete(key); err != nil {
+		return err
+	}
+	s.scheduleSave()
+	return nil
+}
+
+// scheduleSave persists all records after the store's delay, unless this is already scheduled
+func (s *persistentStore) scheduleSave() {
+	s.timerMu.Lock()
+	defer s.timerMu.Unlock()
+	if s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(s.delay, func() {
+		if err := s.Flush(); err != nil {
+			log.WithError(err).Error("Could not save state of images")
+		}
+	})
+}
+
+// Flush persists all records
+func (s *persistentStore) Flush() error {
+	s.timerMu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.timerMu.Unlock()
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	data, err := s.marshal()
+	if err != nil {
+		return err
+	}
+	return s.save(data)
+}
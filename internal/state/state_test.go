@@ -0,0 +1,173 @@
+/*
+Copyright © 2019 Anes Benmerzoug
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package state
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testRecord() *Record {
+	return &Record{
+		Registry:   "530519006690",
+		Repository: "test",
+		Digest:     "sha256:1234",
+		Tags:       []string{"latest", "deployed1599999999"},
+		TaggedAt:   time.Date(2020, 9, 13, 12, 26, 39, 0, time.UTC),
+		CheckedAt:  time.Date(2020, 9, 13, 12, 26, 39, 0, time.UTC),
+	}
+}
+
+func TestKey(t *testing.T) {
+	if key := Key("530519006690", "test", "sha256:1234", "latest"); key != "530519006690/test@sha256:1234" {
+		t.Errorf("Expected key to use the digest, but got '%s' instead", key)
+	}
+	if key := Key("530519006690", "test", "", "latest"); key != "530519006690/test:latest" {
+		t.Errorf("Expected key to use the tag, but got '%s' instead", key)
+	}
+}
+
+func TestRecordTags(t *testing.T) {
+	record := testRecord()
+	if !record.HasTagWithPrefix("deployed") {
+		t.Error("Expected record to have a tag with prefix 'deployed'")
+	}
+	if record.HasTagWithPrefix("production") {
+		t.Error("Expected record not to have a tag with prefix 'production'")
+	}
+	if !record.HasTag("latest") || record.HasTag("deployed") {
+		t.Error("Expected HasTag to only match whole tags")
+	}
+}
+
+func TestPersistentStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	clientset := fake.NewSimpleClientset()
+
+	var tests = []struct {
+		description string
+		newStore    func() (Store, error)
+	}{
+		{"file", func() (Store, error) { return NewFileStore(path) }},
+		{"configmap", func() (Store, error) { return NewConfigMapStore(clientset, "kube-system", "state") }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			store, err := test.newStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := Key("530519006690", "test", "sha256:1234", "")
+			if _, ok := store.Get(key); ok {
+				t.Fatal("Expected new store to be empty")
+			}
+			if err := store.Put(key, testRecord()); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A new store must load the records saved by the previous one
+			store, err = test.newStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			record, ok := store.Get(key)
+			if !ok {
+				t.Fatal("Expected record to be loaded")
+			}
+			if diff := cmp.Diff(record, testRecord()); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", record, diff)
+			}
+		})
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), "state", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := configMap.Data[configMapKey]; !ok {
+		t.Errorf("Expected records to be saved in ConfigMap under key '%s'", configMapKey)
+	}
+}
+
+func TestPersistentStoreBatchesSaves(t *testing.T) {
+	saved := make(chan []byte, 10)
+	store := &persistentStore{
+		MemoryStore: NewMemoryStore(),
+		save: func(data []byte) error {
+			saved <- data
+			return nil
+		},
+		delay: 50 * time.Millisecond,
+	}
+	for _, digest := range []string{"sha256:1", "sha256:2", "sha256:3"} {
+		if err := store.Put(Key("530519006690", "test", digest, ""), testRecord()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete(Key("530519006690", "test", "sha256:3", "")); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 0 {
+		t.Fatal("Expected records not to be saved before the delay is over")
+	}
+	select {
+	case <-saved:
+	case <-time.After(time.Second):
+		t.Fatal("Expected records to be saved once the delay is over")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if len(saved) != 0 {
+		t.Errorf("Expected the changes to be saved at once, but got %d more saves", len(saved))
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewMemoryStore()
+	if err := loaded.unmarshal(<-saved); err != nil {
+		t.Fatal(err)
+	}
+	if records := loaded.List(); len(records) != 2 {
+		t.Errorf("Expected 2 records to be saved, but got %d instead", len(records))
+	}
+}
+
+func TestRecordLastUsed(t *testing.T) {
+	record := testRecord()
+	if !record.LastUsed().Equal(record.CheckedAt) {
+		t.Errorf("Expected image to be last used when it was checked, but got '%v' instead", record.LastUsed())
+	}
+	record.UsedAt = record.CheckedAt.Add(time.Hour)
+	if !record.LastUsed().Equal(record.UsedAt) {
+		t.Errorf("Expected image to be last used at '%v', but got '%v' instead", record.UsedAt, record.LastUsed())
+	}
+}